@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var allowCommand = &command{
+	name:  "allow-me",
+	usage: "allow-me [-config file] [-url url] [-token token] -port service -for duration    open a service to your address through the worker",
+	run:   runAllow,
+}
+
+func runAllow(args []string) error {
+	fs := flag.NewFlagSet("allow-me", flag.ExitOnError)
+	configFile := fs.String("config", "", "Path to configuration file")
+	baseUrl := fs.String("url", "", "Url of the worker API, ALIYUN_SGMGR_API_BASE_URL by default")
+	port := fs.String("port", "ssh", "Service opened, e.g. ssh or tcp/8080")
+	duration := fs.Duration("for", 4*time.Hour, "How long the service is open")
+	token := fs.String("token", "", "Bearer token or JWT of your API user, ALIYUN_SGMGR_API_TOKEN by default")
+	fs.Parse(args)
+
+	client, err := newApiClient(*configFile, *baseUrl, *token)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Ip    string `json:"ip"`
+		Rules []struct {
+			Rule     string    `json:"rule"`
+			ExpireAt time.Time `json:"expire_at"`
+		} `json:"rules"`
+		Request *accessRequest `json:"request"`
+	}
+	status, err := client.do(http.MethodPost, "/api/v1/allow-me", map[string]string{"port": *port, "for": duration.String()}, &result)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusAccepted && result.Request != nil {
+		fmt.Printf("%s needs approval, pending as request %s\n", *port, result.Request.Id)
+		return nil
+	}
+	for _, rule := range result.Rules {
+		fmt.Printf("allowed %s until %s: %s\n", result.Ip, rule.ExpireAt.Local().Format(time.RFC3339), rule.Rule)
+	}
+	return nil
+}
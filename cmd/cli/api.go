@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiClient calls the HTTP API of the worker
+type apiClient struct {
+	baseUrl string
+	token   string
+}
+
+// newApiClient returns a client of the worker at baseUrl with token, taken
+// from the configuration when empty
+func newApiClient(configFile string, baseUrl string, token string) (*apiClient, error) {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if baseUrl == "" && config.Api.BaseUrl != nil {
+		baseUrl = *config.Api.BaseUrl
+	}
+	if baseUrl == "" {
+		return nil, fmt.Errorf("no worker url given and ALIYUN_SGMGR_API_BASE_URL is not set")
+	}
+	if token == "" && config.Api.Token != nil {
+		token = *config.Api.Token
+	}
+	return &apiClient{baseUrl: strings.TrimSuffix(baseUrl, "/"), token: token}, nil
+}
+
+// do sends body as JSON to path and decodes the answer into result,
+// returning the status of a successful answer
+func (c *apiClient) do(method string, path string, body any, result any) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, c.baseUrl+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	response, err := (&http.Client{Timeout: 30 * time.Second}).Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return 0, err
+	}
+	if response.StatusCode >= 300 {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &failure) != nil || failure.Error == "" {
+			return 0, fmt.Errorf("unexpected answer from the worker: %s", response.Status)
+		}
+		return 0, fmt.Errorf("%s: %s", response.Status, failure.Error)
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return 0, fmt.Errorf("unexpected answer from the worker: %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"aliyun-security-group-mgr/internal/audit"
+
+	"flag"
+	"fmt"
+)
+
+var auditCommand = &command{
+	name:  "audit",
+	usage: "audit verify [-config file] [audit-log]    check that no record of the audit log was modified, removed or inserted",
+	run:   runAudit,
+}
+
+func runAudit(args []string) error {
+	if len(args) == 0 || args[0] != "verify" {
+		return fmt.Errorf("usage: sgmgr audit verify [-config file] [audit-log]")
+	}
+	fs := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	configFile := fs.String("config", "", "Path to configuration file")
+	fs.Parse(args[1:])
+
+	path := fs.Arg(0)
+	if path == "" {
+		config, err := loadConfig(*configFile)
+		if err != nil {
+			return err
+		}
+		if config.Audit.Path == nil || *config.Audit.Path == "" {
+			return fmt.Errorf("no audit log given and ALIYUN_SGMGR_AUDIT_PATH is empty")
+		}
+		path = *config.Audit.Path
+	}
+
+	count, err := audit.Verify(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d records, chain intact\n", path, count)
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"aliyun-security-group-mgr/internal/analyzer"
+	"aliyun-security-group-mgr/internal/ecs"
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"flag"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+var checkCommand = &command{
+	name:  "check",
+	usage: "check -src ip|-dst ip -proto p [-port n] [-direction d] [-live] [-config file] [rules-file]    tell which rule decides some traffic",
+	run:   runCheck,
+}
+
+func runCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	src := fs.String("src", "", "Source address of ingress traffic")
+	dst := fs.String("dst", "", "Destination address of egress traffic")
+	proto := fs.String("proto", "tcp", "Protocol")
+	port := fs.Int("port", 0, "Port, not needed for protocols without ports")
+	direction := fs.String("direction", "", "ingress or egress, by default from -src or -dst")
+	live := fs.Bool("live", false, "Check the live rules of the security group instead of the rules file")
+	configFile := fs.String("config", "", "Path to configuration file")
+	fs.Parse(args)
+
+	if (*src == "") == (*dst == "") {
+		return fmt.Errorf("exactly one of -src and -dst is required")
+	}
+	addr := *src
+	if *direction == "" {
+		*direction = ecs.DirectionIngress
+		if *dst != "" {
+			*direction = ecs.DirectionEgress
+		}
+	}
+	if *dst != "" {
+		addr = *dst
+	}
+	*direction = strings.ToLower(*direction)
+	if *direction != ecs.DirectionIngress && *direction != ecs.DirectionEgress {
+		return fmt.Errorf("invalid direction: %s", *direction)
+	}
+
+	packet := analyzer.Packet{
+		Direction:  *direction,
+		IpProtocol: strings.ToUpper(*proto),
+		Port:       *port,
+	}
+	var err error
+	if packet.Addr, err = netip.ParseAddr(addr); err != nil {
+		return fmt.Errorf("invalid address: %s", addr)
+	}
+	if !reloader.IsProtocol(packet.IpProtocol) {
+		return fmt.Errorf("invalid protocol: %s", *proto)
+	}
+	if packet.Port < 0 || packet.Port > 65535 {
+		return fmt.Errorf("invalid port: %d", packet.Port)
+	}
+	if packet.Port == 0 && (packet.IpProtocol == reloader.ProtocolTCP || packet.IpProtocol == reloader.ProtocolUDP) {
+		return fmt.Errorf("-port is required for %s", *proto)
+	}
+
+	var entries []reloader.Entry
+	if *live {
+		entries, err = liveEntries(*configFile)
+	} else {
+		var path string
+		if path, err = rulesPath(fs.Args(), *configFile); err == nil {
+			entries, err = reloader.ReadEntriesFromFile(path)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	decision := analyzer.Evaluate(entries, packet, time.Now())
+	verdict := "denied"
+	if decision.Allowed {
+		verdict = "allowed"
+	}
+	if decision.Entry == nil {
+		fmt.Printf("%s: no rule matches, %s traffic is %s by default\n", verdict, *direction, verdict)
+		return nil
+	}
+	fmt.Printf("%s: %s\n", verdict, decision.Entry)
+	if decision.Entry.SecurityGroup.Id != "" {
+		fmt.Printf("rule id: %s\n", decision.Entry.SecurityGroup.Id)
+	}
+	return nil
+}
+
+// liveEntries fetches the rules of the configured security group
+func liveEntries(configFile string) ([]reloader.Entry, error) {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	clerk, err := ecs.NewClerk(config)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := clerk.DescribeSecurityGroupAttribute()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]reloader.Entry, len(rules))
+	for i, rule := range rules {
+		entries[i] = reloader.Entry{SecurityGroup: rule}
+	}
+	return entries, nil
+}
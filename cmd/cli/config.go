@@ -0,0 +1,93 @@
+package main
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/logging"
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"fmt"
+	"os"
+	"os/user"
+)
+
+// loadConfig loads the worker configuration from the given .env file,
+// or from .env in the working directory when it exists
+func loadConfig(configFile string) (*conf.GlobalConfiguration, error) {
+	if err := conf.LoadFile(configFile); err != nil {
+		return nil, err
+	}
+	config, err := conf.LoadGlobalFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return config, logging.Setup(config, os.Stderr)
+}
+
+// rulesPath returns the rules file given on the command line, falling
+// back to the worker's watch path
+func rulesPath(args []string, configFile string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return "", err
+	}
+	if config.Reloader.WatchPath == nil {
+		return "", fmt.Errorf("no rules file given and ALIYUN_SGMGR_RELOADER_WATCH_PATH is not set")
+	}
+	return *config.Reloader.WatchPath, nil
+}
+
+// rulesRoots are rules files loaded with their includes: the configured
+// one, when set, and those given on the command line. A file given that
+// another one includes is checked as a part of it, with the aliases of the
+// files including it in scope.
+type rulesRoots struct {
+	paths    []string
+	rulesets map[string]*reloader.Ruleset
+	errs     map[string]error
+}
+
+func loadRulesRoots(watchPath string, paths []string, options reloader.LoadOptions) *rulesRoots {
+	r := &rulesRoots{
+		rulesets: make(map[string]*reloader.Ruleset),
+		errs:     make(map[string]error),
+	}
+	if watchPath != "" {
+		r.paths = append(r.paths, watchPath)
+	}
+	for _, path := range append(r.paths, paths...) {
+		if _, ok := r.rulesets[path]; ok {
+			continue
+		}
+		if path != watchPath {
+			r.paths = append(r.paths, path)
+		}
+		r.rulesets[path], r.errs[path] = reloader.LoadRulesWithOptions(path, options)
+	}
+	return r
+}
+
+// root returns the first of the roots other than path including it, or
+// else path itself
+func (r *rulesRoots) root(path string) string {
+	for _, root := range r.paths {
+		if root != path && r.rulesets[root].Loaded(path) {
+			return root
+		}
+	}
+	return path
+}
+
+// cliActor names the user running the CLI in the records of the changes
+// made, as user@hostname
+func cliActor() string {
+	name := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	hostname, _ := os.Hostname()
+	return name + "@" + hostname
+}
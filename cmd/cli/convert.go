@@ -0,0 +1,54 @@
+package main
+
+import (
+	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/utils"
+
+	"flag"
+	"fmt"
+	"os"
+)
+
+var convertCommand = &command{
+	name:  "convert",
+	usage: "convert [-to conf|yaml|json] input [output]    translate a rules file between the line, YAML and JSON formats, keeping its includes",
+	run:   runConvert,
+}
+
+func runConvert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	to := fs.String("to", "", "Output format: conf, yaml or json (default: from the output file extension)")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return fmt.Errorf("expected an input file and an optional output file")
+	}
+	input := fs.Arg(0)
+	output := fs.Arg(1)
+
+	format := *to
+	if format == "" && output != "" {
+		format = reloader.FileFormat(output)
+	}
+	switch format {
+	case reloader.FormatLine, reloader.FormatYAML, reloader.FormatJSON:
+	case "":
+		return fmt.Errorf("output format required: use -to or an output file")
+	default:
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+
+	data, warnings, err := reloader.ConvertFile(input, format)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "sgmgr convert: warning: %s\n", warning)
+	}
+
+	if output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return utils.WriteFileAtomic(output, data, 0644)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/service"
+
+	"flag"
+	"fmt"
+)
+
+var driftCommand = &command{
+	name:  "drift",
+	usage: "drift [-config file] [rules-file]    report live rules added, modified or removed outside of the rules files",
+	run:   runDrift,
+}
+
+func runDrift(args []string) error {
+	fs := flag.NewFlagSet("drift", flag.ExitOnError)
+	configFile := fs.String("config", "", "Path to configuration file")
+	fs.Parse(args)
+
+	path, err := rulesPath(fs.Args(), *configFile)
+	if err != nil {
+		return err
+	}
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	ttlPolicy, err := reloader.TTLPolicyFromConfig(config.Ttl)
+	if err != nil {
+		return err
+	}
+	ruleset, err := reloader.LoadRulesWithOptions(path, reloader.LoadOptions{TTLPolicy: ttlPolicy})
+	if err != nil {
+		return err
+	}
+
+	svc, err := service.NewService(config)
+	if err != nil {
+		return err
+	}
+	if err := svc.Connect(); err != nil {
+		return err
+	}
+	drift, err := svc.DetectDrift(ruleset.Entries)
+	if err != nil {
+		return err
+	}
+	for _, d := range drift {
+		fmt.Println(d)
+	}
+	if len(drift) > 0 {
+		return fmt.Errorf("%d differences", len(drift))
+	}
+	return nil
+}
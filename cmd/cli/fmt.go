@@ -0,0 +1,70 @@
+package main
+
+import (
+	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/utils"
+
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var fmtCommand = &command{
+	name:  "fmt",
+	usage: "fmt [-w] [-l] [-sort] [-config file] [rules-file...]    canonicalize rules files",
+	run:   runFmt,
+}
+
+func runFmt(args []string) error {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := fs.Bool("w", false, "Write the result to the file instead of stdout")
+	list := fs.Bool("l", false, "List files whose formatting differs")
+	sortRules := fs.Bool("sort", false, "Sort rules within each block of consecutive rule lines")
+	configFile := fs.String("config", "", "Path to configuration file")
+	fs.Parse(args)
+
+	paths := fs.Args()
+	watchPath, err := rulesPath(nil, *configFile)
+	if err != nil {
+		if len(paths) == 0 {
+			return err
+		}
+		watchPath = ""
+	}
+	if len(paths) == 0 {
+		paths = []string{watchPath}
+	}
+
+	// included files may use the aliases of the files including them
+	roots := loadRulesRoots(watchPath, paths, reloader.LoadOptions{})
+
+	for _, path := range paths {
+		if reloader.FileFormat(path) != reloader.FormatLine {
+			return fmt.Errorf("%s: only the line format can be formatted", path)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		formatted, err := reloader.Format(path, data, reloader.FormatOptions{Sort: *sortRules, Ruleset: roots.rulesets[roots.root(path)]})
+		if err != nil {
+			return err
+		}
+
+		changed := !bytes.Equal(data, formatted)
+		if *list && changed {
+			fmt.Println(path)
+		}
+		if *write && changed {
+			if err := utils.WriteFileAtomic(path, formatted, 0644); err != nil {
+				return err
+			}
+		}
+		if !*list && !*write {
+			os.Stdout.Write(formatted)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"aliyun-security-group-mgr/internal/state"
+
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var historyCommand = &command{
+	name:  "history",
+	usage: "history [-n count] [-config file]    list the last syncs and their results",
+	run:   runHistory,
+}
+
+var showCommand = &command{
+	name:  "show",
+	usage: "show [-config file] <rule-id>    tell where a live rule comes from and when it was applied",
+	run:   runShow,
+}
+
+// loadState reads the state file of the worker
+func loadState(configFile string) (*state.State, error) {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if config.State.Dir == nil || *config.State.Dir == "" {
+		return nil, fmt.Errorf("ALIYUN_SGMGR_STATE_DIR is empty, no state is kept")
+	}
+	return state.NewStore(*config.State.Dir, 0).Load()
+}
+
+func runHistory(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	count := fs.Int("n", 20, "Number of syncs to list")
+	configFile := fs.String("config", "", "Path to configuration file")
+	fs.Parse(args)
+
+	st, err := loadState(*configFile)
+	if err != nil {
+		return err
+	}
+
+	history := st.History
+	if *count > 0 && len(history) > *count {
+		history = history[len(history)-*count:]
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SYNC\tSTARTED\tACTOR\tREVISION\tCHANGES\tRESULT")
+	for i := len(history) - 1; i >= 0; i-- {
+		record := history[i]
+		revision := record.Revision
+		if record.RollbackOf != "" {
+			revision = "rollback of " + record.RollbackOf
+		}
+		result := record.Result
+		if record.Error != "" {
+			result += ": " + record.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t+%d ~%d -%d\t%s\n",
+			record.SyncId, record.StartedAt.Local().Format(time.DateTime), record.Actor, revision,
+			record.Added, record.Updated, record.Deleted, result)
+	}
+	return w.Flush()
+}
+
+func runShow(args []string) error {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	configFile := fs.String("config", "", "Path to configuration file")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a rule id")
+	}
+
+	st, err := loadState(*configFile)
+	if err != nil {
+		return err
+	}
+	record, ok := st.Rules[fs.Arg(0)]
+	if !ok {
+		return fmt.Errorf("no record of rule %s, it was not applied by the worker", fs.Arg(0))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	source := "-"
+	if record.File != "" {
+		source = fmt.Sprintf("%s:%d", record.File, record.Line)
+	}
+	expireAt := "never"
+	if !record.ExpireAt.IsZero() {
+		expireAt = record.ExpireAt.Format(time.RFC3339)
+	}
+	for _, field := range [][2]string{
+		{"Rule id", record.RuleId},
+		{"Security group", record.SecurityGroupId},
+		{"Rule", record.Rule},
+		{"Source", source},
+		{"Expires", expireAt},
+		{"Content hash", record.ContentHash},
+		{"Applied by", record.Creator},
+		{"Applied at", record.AppliedAt.Format(time.RFC3339)},
+		{"Sync", record.SyncId},
+		{"Revision", record.Revision},
+	} {
+		fmt.Fprintf(w, "%s:\t%s\n", field[0], field[1])
+	}
+	return w.Flush()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"aliyun-security-group-mgr/internal/analyzer"
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"flag"
+	"fmt"
+	"time"
+)
+
+var lintCommand = &command{
+	name:  "lint",
+	usage: "lint [-config file] [rules-file]    report duplicate, shadowed, redundant, conflicting and colliding rules",
+	run:   runLint,
+}
+
+func runLint(args []string) error {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	configFile := fs.String("config", "", "Path to configuration file")
+	fs.Parse(args)
+
+	path, err := rulesPath(fs.Args(), *configFile)
+	if err != nil {
+		return err
+	}
+
+	entries, err := reloader.ReadEntriesFromFile(path)
+	if err != nil {
+		return err
+	}
+	findings := analyzer.Analyze(entries, time.Now())
+	for _, finding := range findings {
+		fmt.Println(finding)
+	}
+	if len(findings) > 0 {
+		return fmt.Errorf("%d findings", len(findings))
+	}
+	return nil
+}
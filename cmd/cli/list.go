@@ -0,0 +1,42 @@
+package main
+
+import (
+	"aliyun-security-group-mgr/internal/optimizer"
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"flag"
+	"fmt"
+)
+
+var listCommand = &command{
+	name:  "list",
+	usage: "list [-aggregate] [-config file] [rules-file]    print the rules of a rules file, one per line",
+	run:   runList,
+}
+
+func runList(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	aggregate := fs.Bool("aggregate", false, "Print the rules synced with cidr aggregation, and the lines they come from")
+	configFile := fs.String("config", "", "Path to configuration file")
+	fs.Parse(args)
+
+	path, err := rulesPath(fs.Args(), *configFile)
+	if err != nil {
+		return err
+	}
+
+	entries, err := reloader.ReadEntriesFromFile(path)
+	if err != nil {
+		return err
+	}
+	if *aggregate {
+		for _, mapping := range optimizer.Aggregate(entries) {
+			fmt.Println(mapping)
+		}
+		return nil
+	}
+	for _, entry := range entries {
+		fmt.Println(entry)
+	}
+	return nil
+}
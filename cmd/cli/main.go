@@ -1,4 +1,62 @@
 package main
 
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []*command{
+	listCommand,
+	fmtCommand,
+	validateCommand,
+	convertCommand,
+	lintCommand,
+	checkCommand,
+	driftCommand,
+	rollbackCommand,
+	historyCommand,
+	showCommand,
+	auditCommand,
+	allowCommand,
+	requestsCommand,
+}
+
 func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := flag.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		if err := cmd.run(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "sgmgr %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "sgmgr: unknown command %q\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: sgmgr <command> [arguments]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n", cmd.usage)
+	}
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var requestsCommand = &command{
+	name:  "requests",
+	usage: "requests list|approve|deny [-config file] [-url url] [-token token] [-status status] [-comment text] [id]    list and decide on access requests waiting for approval",
+	run:   runRequests,
+}
+
+// accessRequest is an access request as the worker API shows it
+type accessRequest struct {
+	Id        string     `json:"id"`
+	Status    string     `json:"status"`
+	Requester string     `json:"requester"`
+	Rules     []string   `json:"rules"`
+	Ttl       string     `json:"ttl"`
+	CreatedAt time.Time  `json:"created_at"`
+	DecidedBy string     `json:"decided_by"`
+	Comment   string     `json:"comment"`
+	ExpireAt  *time.Time `json:"expire_at"`
+}
+
+func runRequests(args []string) error {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "approve" && args[0] != "deny") {
+		return fmt.Errorf("usage: sgmgr requests list|approve|deny [flags] [id]")
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("requests "+action, flag.ExitOnError)
+	configFile := fs.String("config", "", "Path to configuration file")
+	baseUrl := fs.String("url", "", "Url of the worker API, ALIYUN_SGMGR_API_BASE_URL by default")
+	token := fs.String("token", "", "Bearer token or JWT of your API user, ALIYUN_SGMGR_API_TOKEN by default")
+	status := fs.String("status", "pending", "Status of the requests listed: pending, approved, denied, or empty for all")
+	comment := fs.String("comment", "", "Comment kept with the decision")
+	fs.Parse(args[1:])
+
+	client, err := newApiClient(*configFile, *baseUrl, *token)
+	if err != nil {
+		return err
+	}
+
+	if action == "list" {
+		var result struct {
+			Requests []accessRequest `json:"requests"`
+		}
+		if _, err := client.do(http.MethodGet, "/api/v1/requests?status="+url.QueryEscape(*status), nil, &result); err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTATUS\tREQUESTER\tTTL\tCREATED\tDECIDED BY\tRULES")
+		for _, request := range result.Requests {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", request.Id, request.Status, request.Requester, request.Ttl,
+				request.CreatedAt.Local().Format(time.RFC3339), request.DecidedBy, strings.Join(request.Rules, "; "))
+		}
+		return w.Flush()
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: sgmgr requests %s [flags] id", action)
+	}
+	path := "/api/v1/requests/" + url.PathEscape(fs.Arg(0)) + "/" + action
+	body := map[string]string{"comment": *comment}
+	if action == "deny" {
+		var denied accessRequest
+		if _, err := client.do(http.MethodPost, path, body, &denied); err != nil {
+			return err
+		}
+		fmt.Printf("denied request %s of %s\n", denied.Id, denied.Requester)
+		return nil
+	}
+	var approved struct {
+		Request accessRequest `json:"request"`
+	}
+	if _, err := client.do(http.MethodPost, path, body, &approved); err != nil {
+		return err
+	}
+	fmt.Printf("approved request %s of %s", approved.Request.Id, approved.Request.Requester)
+	if approved.Request.ExpireAt != nil {
+		fmt.Printf(", open until %s", approved.Request.ExpireAt.Local().Format(time.RFC3339))
+	}
+	fmt.Println()
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"aliyun-security-group-mgr/internal/ecs"
+	"aliyun-security-group-mgr/internal/service"
+
+	"flag"
+	"fmt"
+)
+
+var rollbackCommand = &command{
+	name:  "rollback",
+	usage: "rollback [-config file] [sync-id]    restore the live rules from before a sync, or list the syncs",
+	run:   runRollback,
+}
+
+func runRollback(args []string) error {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	configFile := fs.String("config", "", "Path to configuration file")
+	fs.Parse(args)
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	svc, err := service.NewService(config)
+	if err != nil {
+		return err
+	}
+	if svc.State == nil {
+		return fmt.Errorf("ALIYUN_SGMGR_STATE_DIR is empty, no snapshots are kept")
+	}
+
+	if fs.NArg() == 0 {
+		syncIds, err := svc.State.Snapshots()
+		if err != nil {
+			return err
+		}
+		for _, syncId := range syncIds {
+			fmt.Println(syncId)
+		}
+		return nil
+	}
+
+	if svc.Ecs, err = ecs.NewClerk(config); err != nil {
+		return err
+	}
+	svc.Actor = cliActor()
+	rollbackId, err := svc.Rollback(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored the rules from before %s, undo with: sgmgr rollback %s\n", fs.Arg(0), rollbackId)
+	return nil
+}
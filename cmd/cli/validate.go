@@ -0,0 +1,93 @@
+package main
+
+import (
+	"aliyun-security-group-mgr/internal/guard"
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var validateCommand = &command{
+	name:  "validate",
+	usage: "validate [-config file] [rules-file...]    check rules files, their includes, the ttl classes and the configured guardrails",
+	run:   runValidate,
+}
+
+func runValidate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := fs.String("config", "", "Path to configuration file")
+	fs.Parse(args)
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	paths := fs.Args()
+	var watchPath string
+	if config.Reloader.WatchPath != nil {
+		watchPath = *config.Reloader.WatchPath
+	}
+	if len(paths) == 0 {
+		if watchPath == "" {
+			return fmt.Errorf("no rules file given and ALIYUN_SGMGR_RELOADER_WATCH_PATH is not set")
+		}
+		paths = []string{watchPath}
+	}
+
+	ttlPolicy, err := reloader.TTLPolicyFromConfig(config.Ttl)
+	if err != nil {
+		return err
+	}
+
+	// guardrails are checked when enabled in the configuration
+	var g *guard.Guard
+	if config.Guard.Enabled != nil && *config.Guard.Enabled {
+		if g, err = guard.NewGuard(config.Guard); err != nil {
+			return err
+		}
+	}
+
+	// included files are checked as a part of the files including them
+	roots := loadRulesRoots(watchPath, paths, reloader.LoadOptions{TTLPolicy: ttlPolicy})
+	checked := make(map[string]bool)
+	count := 0
+	for _, path := range paths {
+		root := roots.root(path)
+		if checked[root] {
+			continue
+		}
+		checked[root] = true
+		ruleset := roots.rulesets[root]
+		for _, err := range unwrapErrors(roots.errs[root]) {
+			fmt.Fprintln(os.Stderr, err)
+			count++
+		}
+		if g == nil {
+			continue
+		}
+		for _, violation := range g.Check(ruleset.Entries) {
+			fmt.Fprintln(os.Stderr, violation)
+			count++
+		}
+	}
+	if count > 0 {
+		return fmt.Errorf("%d errors found", count)
+	}
+	return nil
+}
+
+// unwrapErrors lists the errors joined in err
+func unwrapErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	var joined interface{ Unwrap() []error }
+	if errors.As(err, &joined) {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
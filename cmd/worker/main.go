@@ -1,9 +1,14 @@
 package main
 
 import (
+	"aliyun-security-group-mgr/internal/api"
 	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/logging"
+	"aliyun-security-group-mgr/internal/notify"
 	"aliyun-security-group-mgr/internal/service"
 	"flag"
+	"log/slog"
+	"os"
 )
 
 var (
@@ -23,12 +28,41 @@ func main() {
 		panic(err)
 	}
 
+	if err := logging.Setup(config, os.Stderr); err != nil {
+		panic(err)
+	}
+	slog.Debug("configuration loaded", "config", logging.Redact(redactConfig(config)))
+
 	service, err := service.NewService(config)
 	if err != nil {
 		panic(err)
 	}
 
+	if config.Api.Listen != nil && *config.Api.Listen != "" {
+		server, err := api.NewServer(service)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			if err := server.ListenAndServe(*config.Api.Listen); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
 	if err := service.Start(); err != nil {
 		panic(err)
 	}
 }
+
+// redactConfig returns a copy of the configuration with the webhook urls,
+// whose tokens are not under credential keys, redacted
+func redactConfig(config *conf.GlobalConfiguration) *conf.GlobalConfiguration {
+	redacted := *config
+	if config.Notify != nil {
+		notifyConfig := *config.Notify
+		notifyConfig.Webhooks = notify.RedactWebhooks(config.Notify.Webhooks)
+		redacted.Notify = &notifyConfig
+	}
+	return &redacted
+}
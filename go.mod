@@ -10,6 +10,7 @@ require (
 	github.com/aliyun/credentials-go v1.4.9
 	github.com/joho/godotenv v1.5.1
 	github.com/kelseyhightower/envconfig v1.4.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,267 @@
+package analyzer
+
+import (
+	"aliyun-security-group-mgr/internal/ecs"
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of findings
+const (
+	// KindDuplicate is a rule matching the same traffic as an earlier rule
+	// with the same policy and priority
+	KindDuplicate = "duplicate"
+	// KindShadowed is a rule whose traffic is all decided by a rule of the
+	// opposite policy that takes precedence
+	KindShadowed = "shadowed"
+	// KindRedundant is a rule whose traffic is all matched by a rule of the
+	// same policy taking precedence, e.g. a /32 inside an accepted /24
+	KindRedundant = "redundant"
+	// KindConflict is a rule partially overlapping a rule of the opposite
+	// policy that takes precedence for the overlap
+	KindConflict = "conflict"
+	// KindCollision is a rule with the cidr, protocol, port range and
+	// direction of a later rule of another policy or priority: a security
+	// group holds one rule per match, so only the later one is synced
+	KindCollision = "collision"
+)
+
+// Finding is a rule reported by Analyze, with the rule it relates to
+type Finding struct {
+	Kind    string
+	Entry   reloader.Entry
+	Other   reloader.Entry
+	Message string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s [%s]", location(f.Entry), f.Message, f.Kind)
+}
+
+// location refers to an entry by its source, or by its rule line when it
+// has none, e.g. for live rules
+func location(entry reloader.Entry) string {
+	if source := entry.Source.String(); source != "" {
+		return source
+	}
+	return reloader.EncodeEntry(entry)
+}
+
+// rule is an entry with its match set parsed
+type rule struct {
+	entry    reloader.Entry
+	prefix   netip.Prefix
+	from, to int
+	priority int
+	drop     bool
+}
+
+func newRule(entry reloader.Entry) (*rule, bool) {
+	prefix, err := netip.ParsePrefix(entry.SecurityGroup.CidrIp)
+	if err != nil {
+		return nil, false
+	}
+	from, to, err := reloader.ParsePortRange(entry.SecurityGroup.PortRange)
+	if err != nil {
+		return nil, false
+	}
+	priority, err := strconv.Atoi(entry.SecurityGroup.Priority)
+	if err != nil {
+		priority, _ = strconv.Atoi(reloader.DefaultPriority)
+	}
+	return &rule{
+		entry:    entry,
+		prefix:   prefix.Masked(),
+		from:     from,
+		to:       to,
+		priority: priority,
+		drop:     strings.EqualFold(entry.SecurityGroup.Policy, ecs.PolicyDrop),
+	}, true
+}
+
+func (r *rule) protocol() string {
+	return strings.ToUpper(r.entry.SecurityGroup.IpProtocol)
+}
+
+// covers reports whether r matches all the traffic other matches
+func (r *rule) covers(other *rule) bool {
+	return strings.EqualFold(r.entry.SecurityGroup.Direction, other.entry.SecurityGroup.Direction) &&
+		(r.protocol() == reloader.ProtocolAll || r.protocol() == other.protocol()) &&
+		r.from <= other.from && other.to <= r.to &&
+		r.prefix.Bits() <= other.prefix.Bits() && r.prefix.Contains(other.prefix.Addr())
+}
+
+// overlaps reports whether some traffic matches both r and other
+func (r *rule) overlaps(other *rule) bool {
+	return strings.EqualFold(r.entry.SecurityGroup.Direction, other.entry.SecurityGroup.Direction) &&
+		(r.protocol() == reloader.ProtocolAll || other.protocol() == reloader.ProtocolAll || r.protocol() == other.protocol()) &&
+		r.from <= other.to && other.from <= r.to &&
+		r.prefix.Overlaps(other.prefix)
+}
+
+// precedes reports whether r decides traffic matched by both rules: the
+// lower priority number wins, and drop wins over accept on a tie
+func (r *rule) precedes(other *rule) bool {
+	if r.priority != other.priority {
+		return r.priority < other.priority
+	}
+	return r.drop && !other.drop
+}
+
+// outlives reports whether r stays in place as long as other does
+func (r *rule) outlives(other *rule) bool {
+	if r.entry.ExpireAt.IsZero() {
+		return true
+	}
+	return !other.entry.ExpireAt.IsZero() && !r.entry.ExpireAt.Before(other.entry.ExpireAt)
+}
+
+func (r *rule) sameMatch(other *rule) bool {
+	return r.covers(other) && other.covers(r)
+}
+
+// Analyze reports duplicate, shadowed, redundant, conflicting and
+// colliding rules, following Aliyun's evaluation order: rules with a lower
+// priority number are evaluated first, and drop wins over accept at the
+// same priority. Rules expired at now are left out. Each rule is reported
+// at most once for being unnecessary, once per conflicting rule, and once
+// for being replaced by a colliding rule.
+func Analyze(entries []reloader.Entry, now time.Time) []Finding {
+	var rules []*rule
+	for _, entry := range entries {
+		if entry.IsExpired(now) {
+			continue
+		}
+		if r, ok := newRule(entry); ok {
+			rules = append(rules, r)
+		}
+	}
+
+	var findings []Finding
+	report := func(kind string, r, other *rule, format string, args ...interface{}) {
+		findings = append(findings, Finding{
+			Kind:    kind,
+			Entry:   r.entry,
+			Other:   other.entry,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	for j, r := range rules {
+		if finding := unnecessary(rules, j); finding != nil {
+			report(finding.kind, r, finding.other, finding.format, location(finding.other.entry))
+		}
+		if other := collision(rules, j); other != nil {
+			report(KindCollision, r, other, "is replaced by %s, which has the same cidr, protocol, port range and direction",
+				location(other.entry))
+		}
+
+		for i, other := range rules {
+			if i == j || r.drop == other.drop || !other.precedes(r) {
+				continue
+			}
+			// full cover is reported as shadowed, and a rule of higher
+			// precedence within r is a deliberate exception
+			if other.covers(r) || r.covers(other) || !other.overlaps(r) {
+				continue
+			}
+			report(KindConflict, r, other, "partially overlaps %s, which %s the overlapping traffic",
+				location(other.entry), strings.ToLower(other.entry.SecurityGroup.Policy)+"s")
+		}
+	}
+	return findings
+}
+
+type unnecessaryFinding struct {
+	kind   string
+	other  *rule
+	format string
+}
+
+// unnecessary finds a rule making rules[j] useless, preferring duplicates
+// over shadowing over redundancy
+func unnecessary(rules []*rule, j int) *unnecessaryFinding {
+	r := rules[j]
+	var shadowed, redundant *rule
+	for i, other := range rules {
+		if i == j || !other.covers(r) || !other.outlives(r) {
+			continue
+		}
+		if other.drop == r.drop && other.priority == r.priority && other.sameMatch(r) {
+			// only the later of two duplicates is reported
+			if i < j {
+				return &unnecessaryFinding{KindDuplicate, other, "duplicate of %s"}
+			}
+			continue
+		}
+		if other.drop != r.drop && other.precedes(r) && shadowed == nil {
+			shadowed = other
+		}
+		if other.drop == r.drop && other.priority <= r.priority && redundant == nil {
+			redundant = other
+		}
+	}
+	if shadowed != nil {
+		return &unnecessaryFinding{KindShadowed, shadowed, "never applies, %s takes precedence over it"}
+	}
+	if redundant != nil {
+		return &unnecessaryFinding{KindRedundant, redundant, "already covered by %s"}
+	}
+	return nil
+}
+
+// collision finds the last rule after rules[j] replacing it when synced:
+// rules are synced by cidr, protocol, port range and direction, so a later
+// rule of another policy or priority takes the place of rules[j]
+func collision(rules []*rule, j int) *rule {
+	r := rules[j].entry.SecurityGroup
+	for i := len(rules) - 1; i > j; i-- {
+		other := rules[i].entry.SecurityGroup
+		if other.CidrIp != r.CidrIp || other.IpProtocol != r.IpProtocol ||
+			other.PortRange != r.PortRange || other.Direction != r.Direction {
+			continue
+		}
+		if other.Policy != r.Policy || other.Priority != r.Priority {
+			return rules[i]
+		}
+		// an identical rule replaces r, and is checked in its own turn
+		return nil
+	}
+	return nil
+}
+
+// ComparePrecedence orders entries by Aliyun's evaluation order: it is
+// negative when a is evaluated before b. Entries evaluated together are
+// ordered by direction, protocol, port range and cidr, so that sorting
+// with it is deterministic.
+func ComparePrecedence(a, b reloader.Entry) int {
+	ra, okA := newRule(a)
+	rb, okB := newRule(b)
+	if okA && okB {
+		if ra.precedes(rb) {
+			return -1
+		}
+		if rb.precedes(ra) {
+			return 1
+		}
+	}
+
+	x, y := a.SecurityGroup, b.SecurityGroup
+	for _, pair := range [][2]string{
+		{x.Direction, y.Direction},
+		{x.IpProtocol, y.IpProtocol},
+		{x.PortRange, y.PortRange},
+		{x.CidrIp, y.CidrIp},
+		{x.Policy, y.Policy},
+	} {
+		if c := strings.Compare(pair[0], pair[1]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
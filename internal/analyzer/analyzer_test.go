@@ -0,0 +1,175 @@
+package analyzer
+
+import (
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func parseEntries(t *testing.T, lines []string) []reloader.Entry {
+	t.Helper()
+	parser := reloader.NewParser()
+	var entries []reloader.Entry
+	for i, line := range lines {
+		parsed, err := parser.ParseLine(line)
+		if err != nil {
+			t.Fatalf("ParseLine(%q) returned error: %v", line, err)
+		}
+		for _, entry := range parsed {
+			entry.Source = reloader.Source{File: "rules.conf", Line: i + 1}
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{
+			name: "duplicate",
+			lines: []string{
+				"accept ingress ssh from 203.0.113.0/24 until never # a",
+				"accept ingress tcp 22 from 203.0.113.0/24 until never # b",
+			},
+			want: []string{"rules.conf:2: duplicate of rules.conf:1 [duplicate]"},
+		},
+		{
+			name: "cidr subsumed",
+			lines: []string{
+				"accept ingress ssh from 203.0.113.7 until never",
+				"accept ingress tcp 1/1024 from 203.0.113.0/24 until never",
+			},
+			want: []string{"rules.conf:1: already covered by rules.conf:2 [redundant]"},
+		},
+		{
+			name: "redundant only when the cover outlives it",
+			lines: []string{
+				"accept ingress ssh from 203.0.113.7 until 2026-03-01T00:00:00Z",
+				"accept ingress ssh from 203.0.113.0/24 until 2026-02-01T00:00:00Z",
+			},
+			want: nil,
+		},
+		{
+			name: "shadowed by a drop of higher priority",
+			lines: []string{
+				"drop ingress all from 0.0.0.0/0 priority 1 until never",
+				"accept ingress ssh from 203.0.113.0/24 priority 10 until never",
+			},
+			want: []string{"rules.conf:2: never applies, rules.conf:1 takes precedence over it [shadowed]"},
+		},
+		{
+			name: "drop wins at the same priority",
+			lines: []string{
+				"accept ingress ssh from 203.0.113.0/24 priority 5 until never",
+				"drop ingress tcp 1/1024 from 203.0.0.0/16 priority 5 until never",
+			},
+			want: []string{"rules.conf:1: never applies, rules.conf:2 takes precedence over it [shadowed]"},
+		},
+		{
+			name: "exception of higher priority",
+			lines: []string{
+				"accept ingress ssh from 203.0.113.0/24 priority 1 until never",
+				"drop ingress all from 0.0.0.0/0 priority 100 until never",
+			},
+			want: nil,
+		},
+		{
+			name: "partial overlap",
+			lines: []string{
+				"accept ingress tcp 1/1000 from 10.0.0.0/8 priority 1 until never",
+				"drop ingress tcp 500/2000 from 10.1.0.0/16 priority 2 until never",
+			},
+			want: []string{"rules.conf:2: partially overlaps rules.conf:1, which accepts the overlapping traffic [conflict]"},
+		},
+		{
+			name: "directions and families do not overlap",
+			lines: []string{
+				"drop ingress all from 0.0.0.0/0 priority 1 until never",
+				"accept egress ssh to 203.0.113.0/24 priority 10 until never",
+				"accept ingress ssh from 2001:db8::/32 priority 10 until never",
+			},
+			want: nil,
+		},
+		{
+			name: "same match with another policy or priority",
+			lines: []string{
+				"accept ingress ssh from 203.0.113.0/24 priority 1 until never",
+				"accept ingress ssh from 203.0.113.0/24 priority 5 until never",
+				"accept ingress https from 203.0.113.0/24 priority 1 until never",
+				"drop ingress https from 203.0.113.0/24 priority 1 until never",
+			},
+			want: []string{
+				"rules.conf:1: is replaced by rules.conf:2, which has the same cidr, protocol, port range and direction [collision]",
+				"rules.conf:2: already covered by rules.conf:1 [redundant]",
+				"rules.conf:3: never applies, rules.conf:4 takes precedence over it [shadowed]",
+				"rules.conf:3: is replaced by rules.conf:4, which has the same cidr, protocol, port range and direction [collision]",
+			},
+		},
+		{
+			name: "expired rules are left out",
+			lines: []string{
+				"drop ingress all from 0.0.0.0/0 priority 1 until 2025-01-01T00:00:00Z",
+				"accept ingress ssh from 203.0.113.0/24 priority 10 until never",
+			},
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			findings := Analyze(parseEntries(t, tt.lines), now)
+			var got []string
+			for _, finding := range findings {
+				got = append(got, finding.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Analyze() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	entries := parseEntries(t, []string{
+		"accept ingress postgres from 10.0.0.0/8 priority 10 until never",
+		"drop ingress postgres from 10.1.0.0/16 priority 5 until never",
+		"accept ingress postgres from 10.1.2.0/24 priority 5 until never",
+		"accept ingress tcp 1/65535 from 10.1.2.3 priority 1 until 2025-01-01T00:00:00Z",
+		"drop egress all to 192.0.2.0/24 until never",
+	})
+
+	tests := []struct {
+		packet  Packet
+		allowed bool
+		line    int
+	}{
+		{Packet{"ingress", netip.MustParseAddr("10.2.0.1"), "tcp", 5432}, true, 1},
+		{Packet{"ingress", netip.MustParseAddr("10.1.0.1"), "tcp", 5432}, false, 2},
+		// drop wins at the same priority, and the expired rule is ignored
+		{Packet{"ingress", netip.MustParseAddr("10.1.2.3"), "tcp", 5432}, false, 2},
+		{Packet{"ingress", netip.MustParseAddr("10.2.0.1"), "tcp", 22}, false, 0},
+		{Packet{"ingress", netip.MustParseAddr("10.2.0.1"), "udp", 5432}, false, 0},
+		{Packet{"egress", netip.MustParseAddr("192.0.2.10"), "icmp", 0}, false, 5},
+		{Packet{"egress", netip.MustParseAddr("198.51.100.1"), "tcp", 443}, true, 0},
+	}
+	for _, tt := range tests {
+		decision := Evaluate(entries, tt.packet, now)
+		line := 0
+		if decision.Entry != nil {
+			line = decision.Entry.Source.Line
+		}
+		if decision.Allowed != tt.allowed || line != tt.line {
+			t.Errorf("Evaluate(%+v) = allowed %v by line %d; want allowed %v by line %d",
+				tt.packet, decision.Allowed, line, tt.allowed, tt.line)
+		}
+	}
+}
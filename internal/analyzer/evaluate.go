@@ -0,0 +1,66 @@
+package analyzer
+
+import (
+	"aliyun-security-group-mgr/internal/ecs"
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Packet is the traffic a reachability query asks about
+type Packet struct {
+	Direction string
+	// Addr is the source of ingress traffic or the destination of egress
+	// traffic
+	Addr       netip.Addr
+	IpProtocol string
+	// Port is ignored when 0, e.g. for ICMP
+	Port int
+}
+
+// Decision is the outcome of Evaluate
+type Decision struct {
+	Allowed bool
+	// Entry is the rule deciding the outcome, or nil when no rule matches
+	// and the default of the direction applies
+	Entry *reloader.Entry
+}
+
+// Evaluate returns how the rules decide a packet, following Aliyun's
+// evaluation order. Without a matching rule, ingress traffic is dropped
+// and egress traffic is accepted.
+func Evaluate(entries []reloader.Entry, packet Packet, now time.Time) Decision {
+	var decider *rule
+	for _, entry := range entries {
+		if entry.IsExpired(now) {
+			continue
+		}
+		r, ok := newRule(entry)
+		if !ok || !r.matches(packet) {
+			continue
+		}
+		if decider == nil || r.precedes(decider) {
+			decider = r
+		}
+	}
+
+	if decider == nil {
+		return Decision{Allowed: strings.EqualFold(packet.Direction, ecs.DirectionEgress)}
+	}
+	return Decision{Allowed: !decider.drop, Entry: &decider.entry}
+}
+
+func (r *rule) matches(packet Packet) bool {
+	if !strings.EqualFold(r.entry.SecurityGroup.Direction, packet.Direction) {
+		return false
+	}
+	if r.protocol() != reloader.ProtocolAll && r.protocol() != strings.ToUpper(packet.IpProtocol) {
+		return false
+	}
+	if packet.Port != 0 && (packet.Port < r.from || packet.Port > r.to) {
+		return false
+	}
+	return r.prefix.Contains(packet.Addr.Unmap())
+}
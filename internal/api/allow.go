@@ -0,0 +1,133 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+type allowRequest struct {
+	// Port is the service opened, e.g. "ssh" or "tcp/8080"
+	Port string `json:"port"`
+	// For is how long it is open, e.g. "4h"
+	For string `json:"for"`
+}
+
+type allowResponse struct {
+	Ip       string     `json:"ip"`
+	Revision string     `json:"revision"`
+	Rules    []ruleView `json:"rules"`
+}
+
+// parseTrustedProxies parses the cidrs of the trusted proxies; a single
+// address is a /32 or /128
+func parseTrustedProxies(specs []string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if !strings.Contains(spec, "/") {
+			addr, err := netip.ParseAddr(spec)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", spec)
+			}
+			spec = netip.PrefixFrom(addr, addr.BitLen()).String()
+		}
+		prefix, err := netip.ParsePrefix(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", spec)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+func (s *Server) isTrustedProxy(addr netip.Addr) bool {
+	for _, proxy := range s.trustedProxies {
+		if proxy.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIp returns the address of the client of a request. Behind trusted
+// proxies it is read from the client ip header: for X-Forwarded-For, the
+// last address not of a trusted proxy, as the ones before it are what the
+// client claims.
+func (s *Server) clientIp(r *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid remote address: %s", r.RemoteAddr)
+	}
+	addr = addr.Unmap()
+
+	header := "X-Forwarded-For"
+	if config := s.Service.Config.Api; config.ClientIpHeader != nil && *config.ClientIpHeader != "" {
+		header = *config.ClientIpHeader
+	}
+	if !s.isTrustedProxy(addr) || len(r.Header.Values(header)) == 0 {
+		return addr, nil
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values(header) {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("invalid address in %s: %s", header, hops[i])
+		}
+		hop = hop.Unmap()
+		if i == 0 || !s.isTrustedProxy(hop) {
+			return hop, nil
+		}
+	}
+	return addr, nil
+}
+
+func (s *Server) allowMe(w http.ResponseWriter, r *http.Request) {
+	var request allowRequest
+	if err := decodeBody(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if request.Port == "" {
+		writeError(w, http.StatusBadRequest, errors.New("no port given"))
+		return
+	}
+	ttl, err := time.ParseDuration(request.For)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	addr, err := s.clientIp(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	created, revision, pending, err := s.Service.AllowIp(addr, request.Port, ttl, ifMatch(r), actorOf(r), limitsOf(r))
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	if pending != nil {
+		writePending(w, pending)
+		return
+	}
+	response := allowResponse{Ip: addr.String(), Revision: revision}
+	for _, entry := range created {
+		response.Rules = append(response.Rules, newRuleView(entry))
+	}
+	setRevision(w, revision)
+	writeJSON(w, http.StatusCreated, response)
+}
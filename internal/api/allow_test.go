@@ -0,0 +1,122 @@
+package api
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/service"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientIp(t *testing.T) {
+	config := conf.NewConfig()
+	config.Api.TrustedProxies = []string{"10.0.0.0/8", "::1"}
+	server, err := NewServer(&service.Service{Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"203.0.113.7:5000", nil, "203.0.113.7"},
+		// only trusted proxies are believed
+		{"203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"10.0.0.1:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"[::1]:5000", []string{"2001:db8::7"}, "2001:db8::7"},
+		// addresses before the last untrusted one are the client's claims
+		{"10.0.0.1:5000", []string{"192.0.2.9, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"10.0.0.1:5000", []string{"192.0.2.9", "198.51.100.1"}, "198.51.100.1"},
+		{"[::ffff:10.0.0.1]:5000", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/allow-me", nil)
+		request.RemoteAddr = tc.remoteAddr
+		for _, value := range tc.forwarded {
+			request.Header.Add("X-Forwarded-For", value)
+		}
+		addr, err := server.clientIp(request)
+		if err != nil || addr.String() != tc.want {
+			t.Errorf("clientIp(%s, %q) = %s, %v; want %s", tc.remoteAddr, tc.forwarded, addr, err, tc.want)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/allow-me", nil)
+	request.RemoteAddr = "10.0.0.1:5000"
+	request.Header.Set("X-Forwarded-For", "not-an-ip")
+	if _, err := server.clientIp(request); err == nil {
+		t.Errorf("clientIp with an invalid X-Forwarded-For should fail")
+	}
+
+	if _, err := NewServer(&service.Service{Config: &conf.GlobalConfiguration{Api: &conf.Api{TrustedProxies: []string{"proxy"}}}}); err == nil {
+		t.Errorf("NewServer with an invalid trusted proxy should fail")
+	}
+}
+
+func TestAllowMe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.conf")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := conf.NewConfig()
+	token, maxTtl := "token", 8*time.Hour
+	config.Reloader.WatchPath = &path
+	config.Api.Token = &token
+	config.Api.AllowMaxTtl = &maxTtl
+	config.Ttl.Max = map[string]time.Duration{"ssh": 2 * time.Hour}
+	server, err := NewServer(&service.Service{Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allow := func(remoteAddr string, body string) (*httptest.ResponseRecorder, allowResponse) {
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/allow-me", strings.NewReader(body))
+		request.RemoteAddr = remoteAddr
+		request.Header.Set("Authorization", "Bearer token")
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		var response allowResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder, response
+	}
+
+	// capped by the ttl policy of ssh
+	recorder, response := allow("203.0.113.7:5000", `{"port": "ssh", "for": "4h"}`)
+	if recorder.Code != http.StatusCreated || len(response.Rules) != 1 || response.Rules[0].CidrIp != "203.0.113.7/32" {
+		t.Fatalf("allow-me = %d %s; want a /32 ssh rule", recorder.Code, recorder.Body)
+	}
+	if expireAt := *response.Rules[0].ExpireAt; expireAt.After(time.Now().Add(2 * time.Hour)) {
+		t.Errorf("ssh allowed until %s; want at most 2h", expireAt)
+	}
+	if rule := response.Rules[0]; rule.Owner != "api" || rule.Description != "allow-me by api" {
+		t.Errorf("allowed rule = %+v; want it owned and described by the requester", rule)
+	}
+
+	// capped by the allow-me maximum
+	recorder, response = allow("[2001:db8::7]:5000", `{"port": "tcp/8080", "for": "24h"}`)
+	if recorder.Code != http.StatusCreated || len(response.Rules) != 1 || response.Rules[0].CidrIp != "2001:db8::7/128" {
+		t.Fatalf("allow-me = %d %s; want a /128 rule", recorder.Code, recorder.Body)
+	}
+	if expireAt := *response.Rules[0].ExpireAt; expireAt.After(time.Now().Add(maxTtl)) {
+		t.Errorf("tcp/8080 allowed until %s; want at most %s", expireAt, maxTtl)
+	}
+
+	if recorder, _ := allow("203.0.113.7:5000", `{"port": "ssh", "for": "1h"}`); recorder.Code != http.StatusConflict {
+		t.Errorf("allow-me of an address already allowed = %d; want 409", recorder.Code)
+	}
+	if recorder, _ := allow("203.0.113.7:5000", `{"port": "nosuchservice", "for": "1h"}`); recorder.Code != http.StatusUnprocessableEntity {
+		t.Errorf("allow-me of an unknown service = %d; want 422", recorder.Code)
+	}
+
+	data, _ := os.ReadFile(path)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 || !strings.HasSuffix(lines[0], "owner api # allow-me by api") {
+		t.Errorf("rules file:\n%s\nwant the two rules", data)
+	}
+}
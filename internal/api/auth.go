@@ -0,0 +1,397 @@
+package api
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/logging"
+	"aliyun-security-group-mgr/internal/oidc"
+	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/service"
+
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ScopeRead lets a user list the rules and the last sync
+	ScopeRead = "read"
+	// ScopeRequestTemporary lets a user create temporary rules within their
+	// limits, and delete or renew the ones they own
+	ScopeRequestTemporary = "request-temporary"
+	// ScopeApprove lets a user approve or deny the access requests of others
+	ScopeApprove = "approve"
+	// ScopeAdmin lets a user do anything, without limits
+	ScopeAdmin = "admin"
+
+	// HmacScheme is the authorization scheme of HMAC-signed requests
+	HmacScheme = "SGMGR-HMAC-SHA256"
+
+	// maxSignedBody is the largest body of a signed request read
+	maxSignedBody = 1 << 20
+)
+
+var scopes = map[string]bool{ScopeRead: true, ScopeRequestTemporary: true, ScopeApprove: true, ScopeAdmin: true}
+
+// grant is what a user may do
+type grant struct {
+	scopes map[string]bool
+	// limits is nil for admins
+	limits *service.Limits
+}
+
+func (g grant) has(scope string) bool {
+	return g.scopes[ScopeAdmin] || g.scopes[scope]
+}
+
+// user is who makes a request to the REST API
+type user struct {
+	grant
+	name   string
+	tokens []string
+	secret []byte
+}
+
+// role is the grant of the users signing in with a JWT having its claims
+type role struct {
+	grant
+	name   string
+	claims map[string][]string
+}
+
+// matches reports whether the claims of a JWT have, for each claim of the
+// role, one of its values
+func (r *role) matches(claims oidc.Claims) bool {
+	for name, values := range r.claims {
+		if !slices.ContainsFunc(claims.Values(name), func(value string) bool { return slices.Contains(values, value) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadAuth sets up who may use the API: the users of the users file, the
+// user "api" with every scope when the single api token is set, and the
+// users of JWTs, given the first role their claims match
+func (s *Server) loadAuth(config *conf.Api) error {
+	if config.Token != nil && *config.Token != "" {
+		s.users = append(s.users, &user{
+			name:   "api",
+			grant:  grant{scopes: map[string]bool{ScopeAdmin: true}},
+			tokens: []string{*config.Token},
+		})
+	}
+	if config.Users != nil && *config.Users != "" {
+		apiUsers, err := conf.LoadApiUsers(*config.Users)
+		if err != nil {
+			return err
+		}
+		names := map[string]bool{}
+		for _, u := range s.users {
+			names[u.name] = true
+		}
+		for _, apiUser := range apiUsers.Users {
+			u, err := newUser(apiUser)
+			if err != nil {
+				return err
+			}
+			if names[u.name] {
+				return fmt.Errorf("duplicate api user: %s", u.name)
+			}
+			names[u.name] = true
+			s.users = append(s.users, u)
+		}
+		for _, apiRole := range apiUsers.Roles {
+			grant, err := newGrant(apiRole.ApiGrant)
+			if err != nil {
+				return fmt.Errorf("api role %s: %w", apiRole.Name, err)
+			}
+			s.roles = append(s.roles, &role{grant: grant, name: apiRole.Name, claims: apiRole.Claims})
+		}
+	}
+
+	if config.Jwks == nil || *config.Jwks == "" {
+		return nil
+	}
+	// tokens of any issuer or audience sharing the keys would do otherwise
+	if config.JwtIssuer == nil || *config.JwtIssuer == "" || config.JwtAudience == nil || *config.JwtAudience == "" {
+		return errors.New("jwt issuer and audience must be configured with a jwks")
+	}
+	var refresh, leeway time.Duration
+	if config.JwksRefresh != nil {
+		refresh = *config.JwksRefresh
+	}
+	if config.JwtLeeway != nil {
+		leeway = *config.JwtLeeway
+	}
+	s.verifier = &oidc.Verifier{
+		Keys:     oidc.NewKeySet(*config.Jwks, refresh),
+		Issuer:   *config.JwtIssuer,
+		Audience: *config.JwtAudience,
+		Leeway:   leeway,
+	}
+	s.userClaim = "email"
+	if config.JwtUserClaim != nil && *config.JwtUserClaim != "" {
+		s.userClaim = *config.JwtUserClaim
+	}
+	return nil
+}
+
+func newUser(apiUser conf.ApiUser) (*user, error) {
+	if !validName(apiUser.Name) {
+		return nil, fmt.Errorf("invalid api user name: %q", apiUser.Name)
+	}
+	u := &user{name: apiUser.Name, secret: []byte(apiUser.Secret)}
+	for _, token := range apiUser.Tokens {
+		if token == "" {
+			return nil, fmt.Errorf("empty token of api user %s", u.name)
+		}
+		u.tokens = append(u.tokens, token)
+	}
+	if len(u.tokens) == 0 && len(u.secret) == 0 {
+		return nil, fmt.Errorf("api user %s has neither a token nor a secret", u.name)
+	}
+	var err error
+	if u.grant, err = newGrant(apiUser.ApiGrant); err != nil {
+		return nil, fmt.Errorf("api user %s: %w", u.name, err)
+	}
+	return u, nil
+}
+
+// validName reports whether a name can be written in rule lines as the owner
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\r\n#")
+}
+
+func newGrant(apiGrant conf.ApiGrant) (grant, error) {
+	g := grant{scopes: map[string]bool{}}
+	for _, scope := range apiGrant.Scopes {
+		if !scopes[scope] {
+			return grant{}, fmt.Errorf("unknown scope: %s", scope)
+		}
+		g.scopes[scope] = true
+	}
+	if g.scopes[ScopeAdmin] {
+		return g, nil
+	}
+
+	limits := &service.Limits{MaxTtl: apiGrant.MaxTtl, MaxRules: apiGrant.MaxRules}
+	for _, spec := range apiGrant.Ports {
+		ports, err := reloader.ParseServiceSpec(spec)
+		if err != nil {
+			return grant{}, fmt.Errorf("invalid port: %w", err)
+		}
+		limits.Ports = append(limits.Ports, ports...)
+	}
+	for _, spec := range apiGrant.Cidrs {
+		cidr, err := netip.ParsePrefix(spec)
+		if err != nil {
+			return grant{}, fmt.Errorf("invalid cidr: %s", spec)
+		}
+		limits.Cidrs = append(limits.Cidrs, cidr.Masked())
+	}
+	g.limits = limits
+	return g, nil
+}
+
+type userKey struct{}
+
+// userOf returns who makes an authenticated request
+func userOf(r *http.Request) *user {
+	u, _ := r.Context().Value(userKey{}).(*user)
+	return u
+}
+
+// actorOf returns the name of who makes an authenticated request
+func actorOf(r *http.Request) string {
+	if u := userOf(r); u != nil {
+		return u.name
+	}
+	return ""
+}
+
+// limitsOf returns the limits of who makes an authenticated request
+func limitsOf(r *http.Request) *service.Limits {
+	if u := userOf(r); u != nil {
+		return u.limits
+	}
+	return nil
+}
+
+// authenticated lets through the requests of users having a scope, who
+// bear one of their tokens or a JWT, or sign the request with their secret
+func (s *Server) authenticated(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(s.users) == 0 && s.verifier == nil {
+			writeError(w, http.StatusUnauthorized, errors.New("no api users configured"))
+			return
+		}
+		u, err := s.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer, "+HmacScheme)
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if !u.has(scope) {
+			logger.Warn("api request refused", "method", r.Method, "path", r.URL.Path, "actor", u.name, "scope", scope)
+			writeError(w, http.StatusForbidden, fmt.Errorf("%s lacks the %s scope", u.name, scope))
+			return
+		}
+		logger.Info("api request", "method", r.Method, "path", r.URL.Path, "actor", u.name)
+		handler(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+	}
+}
+
+// authenticate returns the user of a request. Bearer tokens that are not
+// the token of a user are verified as JWTs, when a key set is configured.
+func (s *Server) authenticate(r *http.Request) (*user, error) {
+	authorization := r.Header.Get("Authorization")
+	if token, found := strings.CutPrefix(authorization, "Bearer "); found {
+		for _, u := range s.users {
+			for _, userToken := range u.tokens {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(userToken)) == 1 {
+					return u, nil
+				}
+			}
+		}
+		if s.verifier != nil && strings.Count(token, ".") == 2 {
+			return s.jwtUser(token)
+		}
+		return nil, errors.New("invalid bearer token")
+	}
+	if params, found := strings.CutPrefix(authorization, HmacScheme+" "); found {
+		return s.verifySignature(r, params)
+	}
+	return nil, errors.New("missing bearer token or signature")
+}
+
+// jwtUser returns the user of a JWT, with the grant of the first role
+// their claims match, or no scope when none does
+func (s *Server) jwtUser(token string) (*user, error) {
+	claims, err := s.verifier.Verify(token)
+	if err != nil {
+		logger.Warn("jwt refused", logging.KeyError, err)
+		return nil, errors.New("invalid jwt")
+	}
+	name := claims.String(s.userClaim)
+	if !validName(name) {
+		return nil, fmt.Errorf("invalid %s claim in jwt: %q", s.userClaim, name)
+	}
+	for _, role := range s.roles {
+		if role.matches(claims) {
+			logger.Debug("jwt role", "actor", name, "role", role.name)
+			return &user{grant: role.grant, name: name}, nil
+		}
+	}
+	return &user{grant: grant{scopes: map[string]bool{}}, name: name}, nil
+}
+
+// verifySignature checks a request signed as
+//
+//	Authorization: SGMGR-HMAC-SHA256 user=<name>,timestamp=<unix seconds>,signature=<hex>
+//
+// where the signature is the HMAC-SHA256, by the secret of the user, of
+// StringToSign. A signature is accepted once, within the allowed skew of
+// its timestamp.
+func (s *Server) verifySignature(r *http.Request, params string) (*user, error) {
+	values := map[string]string{}
+	for _, param := range strings.Split(params, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		values[key] = value
+	}
+
+	var signer *user
+	for _, u := range s.users {
+		if u.name == values["user"] && len(u.secret) > 0 {
+			signer = u
+		}
+	}
+	if signer == nil {
+		return nil, errors.New("invalid signature")
+	}
+	unix, err := strconv.ParseInt(values["timestamp"], 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid signature timestamp")
+	}
+	timestamp := time.Unix(unix, 0)
+	skew := 5 * time.Minute
+	if config := s.Service.Config.Api; config.HmacSkew != nil && *config.HmacSkew > 0 {
+		skew = *config.HmacSkew
+	}
+	if d := time.Since(timestamp); d > skew || d < -skew {
+		return nil, errors.New("signature timestamp out of the allowed skew")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSignedBody {
+		return nil, errors.New("request body too large")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	signature, err := hex.DecodeString(values["signature"])
+	if err != nil || !hmac.Equal(signature, Sign(signer.secret, r.Method, r.URL.RequestURI(), timestamp, body)) {
+		return nil, errors.New("invalid signature")
+	}
+	// keyed on the canonical hex, as hex decoding ignores case
+	if !s.replays.check(hex.EncodeToString(signature), timestamp.Add(skew)) {
+		return nil, errors.New("signature already used")
+	}
+	return signer, nil
+}
+
+// StringToSign returns what is signed of a request: its method, its path
+// with the query, the timestamp in unix seconds and the hex SHA-256 of the
+// body, each on a line
+func StringToSign(method string, requestUri string, timestamp time.Time, body []byte) string {
+	sum := sha256.Sum256(body)
+	return method + "\n" + requestUri + "\n" + strconv.FormatInt(timestamp.Unix(), 10) + "\n" + hex.EncodeToString(sum[:])
+}
+
+// Sign returns the HMAC-SHA256 signature of a request
+func Sign(secret []byte, method string, requestUri string, timestamp time.Time, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(StringToSign(method, requestUri, timestamp, body)))
+	return mac.Sum(nil)
+}
+
+// replayCache remembers the signatures accepted until they expire
+type replayCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// check records a signature valid until expireAt, and reports whether it
+// was not seen before
+func (c *replayCache) check(signature string, expireAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for seen, seenExpireAt := range c.seen {
+		if seenExpireAt.Before(now) {
+			delete(c.seen, seen)
+		}
+	}
+	if _, ok := c.seen[signature]; ok {
+		return false
+	}
+	if c.seen == nil {
+		c.seen = map[string]time.Time{}
+	}
+	c.seen[signature] = expireAt
+	return true
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/service"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	rulesPath := filepath.Join(dir, "rules.conf")
+	if err := os.WriteFile(rulesPath, []byte("accept ingress tcp 443 from 0.0.0.0/0 until never # web\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	usersPath := filepath.Join(dir, "users.yaml")
+	users := `users:
+  - name: viewer
+    tokens: [viewer-token]
+    scopes: [read]
+  - name: bob
+    tokens: [bob-token]
+    secret: bob-secret
+    scopes: [read, request-temporary]
+    ports: [ssh]
+    cidrs: [198.51.100.0/24]
+    max_ttl: 4h
+    max_rules: 1
+`
+	if err := os.WriteFile(usersPath, []byte(users), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := conf.NewConfig()
+	config.Reloader.WatchPath = &rulesPath
+	config.Api.Users = &usersPath
+	server, err := NewServer(&service.Service{Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method string, target string, body string, authorization string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Authorization", authorization)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+	signed := func(method string, target string, body string, secret string, timestamp time.Time) string {
+		signature := Sign([]byte(secret), method, target, timestamp, []byte(body))
+		return fmt.Sprintf("%s user=bob,timestamp=%d,signature=%s", HmacScheme, timestamp.Unix(), hex.EncodeToString(signature))
+	}
+
+	// the same signature in upper-case hex
+	upperSigned := func(authorization string) string {
+		prefix, signature, _ := strings.Cut(authorization, "signature=")
+		return prefix + "signature=" + strings.ToUpper(signature)
+	}
+
+	create := `{"rule": "accept ingress ssh from 198.51.100.7", "ttl": "1h"}`
+	now := time.Now()
+	for _, tc := range []struct {
+		name          string
+		method        string
+		target        string
+		body          string
+		authorization string
+		want          int
+	}{
+		{"no credentials", http.MethodGet, "/api/v1/rules", "", "", http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, "/api/v1/rules", "", "Bearer nope", http.StatusUnauthorized},
+		{"read scope", http.MethodGet, "/api/v1/rules", "", "Bearer viewer-token", http.StatusOK},
+		{"missing scope", http.MethodPost, "/api/v1/rules", create, "Bearer viewer-token", http.StatusForbidden},
+		{"admin scope", http.MethodPost, "/api/v1/sync", "", "Bearer bob-token", http.StatusForbidden},
+		{"port not allowed", http.MethodPost, "/api/v1/rules", `{"rule": "accept ingress rdp from 198.51.100.7", "ttl": "1h"}`, "Bearer bob-token", http.StatusForbidden},
+		{"ttl too long", http.MethodPost, "/api/v1/rules", `{"rule": "accept ingress ssh from 198.51.100.7", "ttl": "8h"}`, "Bearer bob-token", http.StatusForbidden},
+		{"wrong secret", http.MethodPost, "/api/v1/rules", create, signed(http.MethodPost, "/api/v1/rules", create, "wrong", now), http.StatusUnauthorized},
+		{"stale signature", http.MethodPost, "/api/v1/rules", create, signed(http.MethodPost, "/api/v1/rules", create, "bob-secret", now.Add(-time.Hour)), http.StatusUnauthorized},
+		{"body not signed", http.MethodPost, "/api/v1/rules", create, signed(http.MethodPost, "/api/v1/rules", "{}", "bob-secret", now), http.StatusUnauthorized},
+		{"signed", http.MethodPost, "/api/v1/rules", create, signed(http.MethodPost, "/api/v1/rules", create, "bob-secret", now), http.StatusCreated},
+		{"replayed", http.MethodPost, "/api/v1/rules", create, signed(http.MethodPost, "/api/v1/rules", create, "bob-secret", now), http.StatusUnauthorized},
+		{"replayed in upper case", http.MethodPost, "/api/v1/rules", create, upperSigned(signed(http.MethodPost, "/api/v1/rules", create, "bob-secret", now)), http.StatusUnauthorized},
+		{"too many rules", http.MethodPost, "/api/v1/rules", `{"rule": "accept ingress ssh from 198.51.100.8", "ttl": "1h"}`, "Bearer bob-token", http.StatusTooManyRequests},
+	} {
+		if response := do(tc.method, tc.target, tc.body, tc.authorization); response.Code != tc.want {
+			t.Errorf("%s: %s %s = %d %s; want %d", tc.name, tc.method, tc.target, response.Code, response.Body, tc.want)
+		}
+	}
+}
+
+func TestLoadAuth(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		users   string
+		wantErr bool
+	}{
+		{"users:\n  - {name: alice, tokens: [a], scopes: [admin]}\n", false},
+		{"users:\n  - {name: alice, scopes: [read]}\n", true},
+		{"users:\n  - {name: alice, tokens: [a], scopes: [write]}\n", true},
+		{"users:\n  - {name: al ice, tokens: [a], scopes: [read]}\n", true},
+		{"users:\n  - {name: alice, tokens: [a], scopes: [read], ports: [nope]}\n", true},
+		{"users:\n  - {name: alice, tokens: [a], scopes: [read], cidrs: [10.0.0.0]}\n", true},
+		{"users:\n  - {name: api, tokens: [a], scopes: [read]}\n", true},
+		{"roles:\n  - {name: eng, claims: {groups: [eng]}, scopes: [read], max_ttl: 4h}\n", false},
+		{"roles:\n  - {name: eng, claims: {groups: [eng]}, scopes: [owner]}\n", true},
+	} {
+		path := filepath.Join(dir, "users.yaml")
+		if err := os.WriteFile(path, []byte(tc.users), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		token := "token"
+		if err := (&Server{}).loadAuth(&conf.Api{Token: &token, Users: &path}); (err != nil) != tc.wantErr {
+			t.Errorf("loadAuth(%q) error = %v; want error %v", tc.users, err, tc.wantErr)
+		}
+	}
+}
+
+func TestJwtAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	rulesPath := filepath.Join(dir, "rules.conf")
+	if err := os.WriteFile(rulesPath, []byte("accept ingress tcp 443 from 0.0.0.0/0 until never # web\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks := fmt.Sprintf(`{"keys": [{"kty": "EC", "kid": "k1", "crv": "P-256", "x": %q, "y": %q}]}`,
+		encode(key.X.FillBytes(make([]byte, 32))), encode(key.Y.FillBytes(make([]byte, 32))))
+	jwksPath := filepath.Join(dir, "jwks.json")
+	if err := os.WriteFile(jwksPath, []byte(jwks), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	usersPath := filepath.Join(dir, "users.yaml")
+	users := `roles:
+  - name: sre
+    claims: {groups: [sre]}
+    scopes: [admin]
+  - name: engineer
+    claims: {groups: [eng, qa]}
+    scopes: [read, request-temporary]
+    ports: [ssh]
+    max_ttl: 4h
+`
+	if err := os.WriteFile(usersPath, []byte(users), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	issuer, audience := "https://sso.example.com", "sgmgr"
+	config := conf.NewConfig()
+	config.Reloader.WatchPath = &rulesPath
+	config.Api.Users = &usersPath
+	config.Api.Jwks = &jwksPath
+	config.Api.JwtIssuer = &issuer
+	config.Api.JwtAudience = &audience
+	server, err := NewServer(&service.Service{Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwt := func(claims map[string]any) string {
+		claims["iss"], claims["exp"] = issuer, time.Now().Add(time.Hour).Unix()
+		if _, ok := claims["aud"]; !ok {
+			claims["aud"] = audience
+		}
+		payload, _ := json.Marshal(claims)
+		signed := encode([]byte(`{"alg":"ES256","kid":"k1"}`)) + "." + encode(payload)
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return "Bearer " + signed + "." + encode(signature)
+	}
+
+	alice := jwt(map[string]any{"email": "alice@example.com", "groups": []string{"dev", "eng"}})
+	for _, tc := range []struct {
+		name          string
+		method        string
+		target        string
+		body          string
+		authorization string
+		want          int
+	}{
+		{"engineer", http.MethodPost, "/api/v1/rules", `{"rule": "accept ingress ssh from 198.51.100.7", "ttl": "1h"}`, alice, http.StatusCreated},
+		{"engineer limits", http.MethodPost, "/api/v1/rules", `{"rule": "accept ingress rdp from 198.51.100.7", "ttl": "1h"}`, alice, http.StatusForbidden},
+		{"engineer admin", http.MethodPost, "/api/v1/sync", "", alice, http.StatusForbidden},
+		{"sre", http.MethodPost, "/api/v1/sync", "", jwt(map[string]any{"email": "carol@example.com", "groups": "sre"}), http.StatusAccepted},
+		{"no role", http.MethodGet, "/api/v1/rules", "", jwt(map[string]any{"email": "dave@example.com", "groups": []string{"sales"}}), http.StatusForbidden},
+		{"no user claim", http.MethodGet, "/api/v1/rules", "", jwt(map[string]any{"groups": []string{"eng"}}), http.StatusUnauthorized},
+		{"other audience", http.MethodGet, "/api/v1/rules", "", jwt(map[string]any{"email": "alice@example.com", "groups": []string{"eng"}, "aud": "other"}), http.StatusUnauthorized},
+	} {
+		request := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+		request.Header.Set("Authorization", tc.authorization)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		if response.Code != tc.want {
+			t.Errorf("%s: %s %s = %d %s; want %d", tc.name, tc.method, tc.target, response.Code, response.Body, tc.want)
+		}
+	}
+
+	ruleset, err := server.Service.LoadRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := ruleset.Entries[len(ruleset.Entries)-1].Owner; owner != "alice@example.com" {
+		t.Errorf("owner of the rule created with a jwt = %q; want alice@example.com", owner)
+	}
+}
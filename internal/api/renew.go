@@ -0,0 +1,69 @@
+package api
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// renewTemplate is the page of renewal links. Opening a link only shows a
+// button, as mail scanners and chat previews fetch the links they see.
+var renewTemplate = template.Must(template.New("renew").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Renew rule</title></head>
+<body>
+{{if .Error}}<p>Renewal failed: {{.Error}}</p>
+{{else if .Rule}}<p>Renewed: {{.Rule}}</p>
+{{else}}<form method="post" action="renew">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Renew rule</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+type renewPageData struct {
+	Token string
+	Rule  string
+	Error string
+}
+
+type renewRequest struct {
+	Token string `json:"token"`
+}
+
+type renewResponse struct {
+	Rule     string    `json:"rule"`
+	ExpireAt time.Time `json:"expire_at"`
+}
+
+func (s *Server) renewPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renewTemplate.Execute(w, renewPageData{Token: r.URL.Query().Get("token")})
+}
+
+func (s *Server) renewForm(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	entry, err := s.Service.Renew(r.PostFormValue("token"), "renewal link from "+r.RemoteAddr)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		renewTemplate.Execute(w, renewPageData{Error: err.Error()})
+		return
+	}
+	renewTemplate.Execute(w, renewPageData{Rule: entry.String()})
+}
+
+func (s *Server) renew(w http.ResponseWriter, r *http.Request) {
+	var request renewRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	entry, err := s.Service.Renew(request.Token, "renewal link from "+r.RemoteAddr)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, renewResponse{Rule: entry.String(), ExpireAt: entry.ExpireAt})
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/service"
+
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenewHandlers(t *testing.T) {
+	config := conf.NewConfig()
+	secret := "secret"
+	config.Renewal.Secret = &secret
+	server, err := NewServer(&service.Service{Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// opening a link does not renew
+	request := httptest.NewRequest(http.MethodGet, "/renew?token=abc.def", nil)
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `<form method="post"`) ||
+		!strings.Contains(recorder.Body.String(), `value="abc.def"`) {
+		t.Errorf("GET /renew = %d %s; want a form posting the token", recorder.Code, recorder.Body)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"form", "/renew", "application/x-www-form-urlencoded", "token=abc.def", http.StatusForbidden},
+		{"json", "/api/v1/renew", "application/json", `{"token":"abc.def"}`, http.StatusForbidden},
+		{"invalid json", "/api/v1/renew", "application/json", `{`, http.StatusBadRequest},
+	} {
+		request := httptest.NewRequest(http.MethodPost, tc.target, strings.NewReader(tc.body))
+		request.Header.Set("Content-Type", tc.contentType)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tc.status {
+			t.Errorf("%s: status = %d; want %d", tc.name, recorder.Code, tc.status)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"aliyun-security-group-mgr/internal/state"
+
+	"net/http"
+	"time"
+)
+
+// requestView is an access request as the API shows it
+type requestView struct {
+	Id        string     `json:"id"`
+	Status    string     `json:"status"`
+	Requester string     `json:"requester"`
+	Rules     []string   `json:"rules"`
+	Ttl       string     `json:"ttl"`
+	CreatedAt time.Time  `json:"created_at"`
+	DecidedBy string     `json:"decided_by,omitempty"`
+	DecidedAt *time.Time `json:"decided_at,omitempty"`
+	Comment   string     `json:"comment,omitempty"`
+	ExpireAt  *time.Time `json:"expire_at,omitempty"`
+	Revision  string     `json:"revision,omitempty"`
+}
+
+func newRequestView(request *state.AccessRequest) requestView {
+	view := requestView{
+		Id:        request.Id,
+		Status:    request.Status,
+		Requester: request.Requester,
+		Rules:     request.Rules,
+		Ttl:       request.Ttl.String(),
+		CreatedAt: request.CreatedAt,
+		DecidedBy: request.DecidedBy,
+		Comment:   request.Comment,
+		Revision:  request.Revision,
+	}
+	if !request.DecidedAt.IsZero() {
+		view.DecidedAt = &request.DecidedAt
+	}
+	if !request.ExpireAt.IsZero() {
+		view.ExpireAt = &request.ExpireAt
+	}
+	return view
+}
+
+// pendingResponse answers a change that waits for approval
+type pendingResponse struct {
+	Request requestView `json:"request"`
+}
+
+type requestsResponse struct {
+	Requests []requestView `json:"requests"`
+}
+
+type decisionRequest struct {
+	// Comment is kept with the decision and audited
+	Comment string `json:"comment"`
+}
+
+type approvalResponse struct {
+	Request  requestView `json:"request"`
+	Revision string      `json:"revision"`
+	Rules    []ruleView  `json:"rules"`
+}
+
+// writePending answers a change kept as a pending access request
+func writePending(w http.ResponseWriter, request *state.AccessRequest) {
+	writeJSON(w, http.StatusAccepted, pendingResponse{Request: newRequestView(request)})
+}
+
+func (s *Server) listRequests(w http.ResponseWriter, r *http.Request) {
+	requests, err := s.Service.Requests(r.URL.Query().Get("status"))
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	response := requestsResponse{Requests: []requestView{}}
+	for _, request := range requests {
+		response.Requests = append(response.Requests, newRequestView(request))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) getRequest(w http.ResponseWriter, r *http.Request) {
+	request, err := s.Service.Request(r.PathValue("id"))
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newRequestView(request))
+}
+
+func (s *Server) approveRequest(w http.ResponseWriter, r *http.Request) {
+	var decision decisionRequest
+	if err := decodeBody(r, &decision); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	request, created, revision, err := s.Service.ApproveRequest(r.PathValue("id"), decision.Comment, actorOf(r))
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	response := approvalResponse{Request: newRequestView(request), Revision: revision}
+	for _, entry := range created {
+		response.Rules = append(response.Rules, newRuleView(entry))
+	}
+	setRevision(w, revision)
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) denyRequest(w http.ResponseWriter, r *http.Request) {
+	var decision decisionRequest
+	if err := decodeBody(r, &decision); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	request, err := s.Service.DenyRequest(r.PathValue("id"), decision.Comment, actorOf(r))
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newRequestView(request))
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/service"
+	"aliyun-security-group-mgr/internal/state"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRequestsApi(t *testing.T) {
+	dir := t.TempDir()
+	rulesPath := filepath.Join(dir, "rules.conf")
+	if err := os.WriteFile(rulesPath, []byte("accept ingress tcp 443 from 0.0.0.0/0 until never # web\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	usersPath := filepath.Join(dir, "users.yaml")
+	users := `users:
+  - {name: bob, tokens: [bob-token], scopes: [read, request-temporary]}
+  - {name: carol, tokens: [carol-token], scopes: [read, approve]}
+`
+	if err := os.WriteFile(usersPath, []byte(users), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := conf.NewConfig()
+	config.Reloader.WatchPath = &rulesPath
+	config.Api.Users = &usersPath
+	config.Approval.Ports = []string{"mysql"}
+	svc := &service.Service{Config: config, State: state.NewStore(filepath.Join(dir, "state"), 0)}
+	server, err := NewServer(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method string, target string, body string, token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	response := do(http.MethodPost, "/api/v1/rules", `{"rule": "accept ingress mysql from 198.51.100.7", "ttl": "2h"}`, "bob-token")
+	var pending pendingResponse
+	json.NewDecoder(response.Body).Decode(&pending)
+	if response.Code != http.StatusAccepted || pending.Request.Status != state.RequestPending || pending.Request.Ttl != "2h0m0s" {
+		t.Fatalf("POST /api/v1/rules of mysql = %d %+v; want a pending request", response.Code, pending)
+	}
+	id := pending.Request.Id
+
+	response = do(http.MethodGet, "/api/v1/requests?status=pending", "", "bob-token")
+	var list requestsResponse
+	json.NewDecoder(response.Body).Decode(&list)
+	if response.Code != http.StatusOK || len(list.Requests) != 1 || list.Requests[0].Id != id {
+		t.Errorf("GET /api/v1/requests = %d %+v; want the pending request", response.Code, list)
+	}
+	if response := do(http.MethodPost, "/api/v1/requests/"+id+"/approve", "", "bob-token"); response.Code != http.StatusForbidden {
+		t.Errorf("approve without the approve scope = %d; want 403", response.Code)
+	}
+	if response := do(http.MethodPost, "/api/v1/requests/nope/approve", "", "carol-token"); response.Code != http.StatusNotFound {
+		t.Errorf("approve of an unknown request = %d; want 404", response.Code)
+	}
+
+	response = do(http.MethodPost, "/api/v1/requests/"+id+"/approve", `{"comment": "ok"}`, "carol-token")
+	var approval approvalResponse
+	json.NewDecoder(response.Body).Decode(&approval)
+	if response.Code != http.StatusOK || approval.Request.Status != state.RequestApproved || len(approval.Rules) != 1 ||
+		approval.Rules[0].Owner != "bob" || approval.Request.ExpireAt == nil {
+		t.Errorf("approve = %d %+v; want the rule of bob written", response.Code, approval)
+	}
+	if response := do(http.MethodPost, "/api/v1/requests/"+id+"/deny", "", "carol-token"); response.Code != http.StatusConflict {
+		t.Errorf("deny of an approved request = %d; want 409", response.Code)
+	}
+	if response := do(http.MethodGet, "/api/v1/requests/"+id, "", "bob-token"); response.Code != http.StatusOK {
+		t.Errorf("GET /api/v1/requests/%s = %d; want 200", id, response.Code)
+	}
+}
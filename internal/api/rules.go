@@ -0,0 +1,191 @@
+package api
+
+import (
+	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/service"
+
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ruleView is a rule as the API shows it
+type ruleView struct {
+	Id          string     `json:"id"`
+	Rule        string     `json:"rule"`
+	Policy      string     `json:"policy"`
+	Direction   string     `json:"direction"`
+	Protocol    string     `json:"protocol"`
+	PortRange   string     `json:"port_range"`
+	CidrIp      string     `json:"cidr_ip"`
+	Priority    string     `json:"priority"`
+	Description string     `json:"description,omitempty"`
+	ExpireAt    *time.Time `json:"expire_at,omitempty"`
+	Owner       string     `json:"owner,omitempty"`
+	File        string     `json:"file"`
+	Line        int        `json:"line"`
+}
+
+func newRuleView(entry reloader.Entry) ruleView {
+	view := ruleView{
+		Id:          service.RuleId(entry),
+		Rule:        reloader.EncodeEntry(entry),
+		Policy:      strings.ToLower(entry.SecurityGroup.Policy),
+		Direction:   entry.SecurityGroup.Direction,
+		Protocol:    strings.ToLower(entry.SecurityGroup.IpProtocol),
+		PortRange:   entry.SecurityGroup.PortRange,
+		CidrIp:      entry.SecurityGroup.CidrIp,
+		Priority:    entry.SecurityGroup.Priority,
+		Description: entry.SecurityGroup.Description,
+		Owner:       entry.Owner,
+		File:        entry.Source.File,
+		Line:        entry.Source.Line,
+	}
+	if !entry.ExpireAt.IsZero() {
+		view.ExpireAt = &entry.ExpireAt
+	}
+	return view
+}
+
+type rulesResponse struct {
+	Revision string     `json:"revision"`
+	Rules    []ruleView `json:"rules"`
+}
+
+type createRuleRequest struct {
+	// Rule is a rule line, which may use the aliases of the watched file
+	Rule string `json:"rule"`
+	// Ttl is how long the rule lasts, e.g. "4h"
+	Ttl string `json:"ttl"`
+}
+
+type renewRuleRequest struct {
+	// Duration extends the rule, e.g. "4h"; empty for its original duration
+	Duration string `json:"duration"`
+}
+
+// setRevision sets the ETag of a response to the revision of the rules files
+func setRevision(w http.ResponseWriter, revision string) {
+	w.Header().Set("ETag", `"`+revision+`"`)
+}
+
+// ifMatch returns the revision a change is based on, from the If-Match
+// header; empty when the header is missing or "*"
+func ifMatch(r *http.Request) string {
+	value := strings.TrimSpace(r.Header.Get("If-Match"))
+	if value == "*" {
+		return ""
+	}
+	return strings.Trim(strings.TrimPrefix(value, "W/"), `"`)
+}
+
+// decodeBody decodes a JSON request body; an empty body leaves v as is
+func decodeBody(r *http.Request, v any) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) listRules(w http.ResponseWriter, r *http.Request) {
+	ruleset, err := s.Service.LoadRules()
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	response := rulesResponse{Revision: ruleset.Revision, Rules: []ruleView{}}
+	for _, entry := range ruleset.Entries {
+		response.Rules = append(response.Rules, newRuleView(entry))
+	}
+	setRevision(w, ruleset.Revision)
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) getRule(w http.ResponseWriter, r *http.Request) {
+	entry, revision, err := s.Service.FindRule(r.PathValue("id"))
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	setRevision(w, revision)
+	writeJSON(w, http.StatusOK, newRuleView(*entry))
+}
+
+func (s *Server) createRule(w http.ResponseWriter, r *http.Request) {
+	var request createRuleRequest
+	if err := decodeBody(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ttl, err := time.ParseDuration(request.Ttl)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	created, revision, pending, err := s.Service.CreateRule(request.Rule, ttl, ifMatch(r), actorOf(r), limitsOf(r))
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	if pending != nil {
+		writePending(w, pending)
+		return
+	}
+	response := rulesResponse{Revision: revision}
+	for _, entry := range created {
+		response.Rules = append(response.Rules, newRuleView(entry))
+	}
+	setRevision(w, revision)
+	writeJSON(w, http.StatusCreated, response)
+}
+
+func (s *Server) deleteRule(w http.ResponseWriter, r *http.Request) {
+	revision, err := s.Service.DeleteRule(r.PathValue("id"), ifMatch(r), actorOf(r), limitsOf(r))
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	setRevision(w, revision)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) renewRule(w http.ResponseWriter, r *http.Request) {
+	var request renewRuleRequest
+	if err := decodeBody(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var duration time.Duration
+	if request.Duration != "" {
+		var err error
+		if duration, err = time.ParseDuration(request.Duration); err != nil || duration <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid duration: "+request.Duration))
+			return
+		}
+	}
+	entry, revision, err := s.Service.RenewRule(r.PathValue("id"), duration, ifMatch(r), actorOf(r), limitsOf(r))
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	setRevision(w, revision)
+	writeJSON(w, http.StatusOK, newRuleView(*entry))
+}
+
+func (s *Server) triggerSync(w http.ResponseWriter, r *http.Request) {
+	s.Service.TriggerSync()
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "sync requested"})
+}
+
+func (s *Server) lastSync(w http.ResponseWriter, r *http.Request) {
+	record, err := s.Service.LastSync()
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, record)
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/service"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRulesApi(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.conf")
+	if err := os.WriteFile(path, []byte("accept ingress tcp 443 from 0.0.0.0/0 until never # web\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := conf.NewConfig()
+	token := "token"
+	config.Reloader.WatchPath = &path
+	config.Api.Token = &token
+	server, err := NewServer(&service.Service{Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method string, target string, body string, headers ...string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer token")
+		for i := 0; i+1 < len(headers); i += 2 {
+			request.Header.Set(headers[i], headers[i+1])
+		}
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	if response := do(http.MethodGet, "/api/v1/rules", "", "Authorization", "Bearer wrong"); response.Code != http.StatusUnauthorized {
+		t.Errorf("GET /api/v1/rules with a wrong token = %d; want 401", response.Code)
+	}
+
+	response := do(http.MethodGet, "/api/v1/rules", "")
+	var list rulesResponse
+	json.NewDecoder(response.Body).Decode(&list)
+	etag := response.Header().Get("ETag")
+	if response.Code != http.StatusOK || len(list.Rules) != 1 || etag != `"`+list.Revision+`"` {
+		t.Fatalf("GET /api/v1/rules = %d %+v, ETag %s; want the https rule and its revision", response.Code, list, etag)
+	}
+
+	create := `{"rule": "accept ingress ssh from 198.51.100.7", "ttl": "4h"}`
+	response = do(http.MethodPost, "/api/v1/rules", create, "If-Match", etag)
+	var created rulesResponse
+	json.NewDecoder(response.Body).Decode(&created)
+	if response.Code != http.StatusCreated || len(created.Rules) != 1 || created.Rules[0].Owner == "" || created.Rules[0].ExpireAt == nil {
+		t.Fatalf("POST /api/v1/rules = %d %+v; want the temporary ssh rule", response.Code, created)
+	}
+	id := created.Rules[0].Id
+
+	// changes based on an older revision are refused
+	if response := do(http.MethodPost, "/api/v1/rules", create, "If-Match", etag); response.Code != http.StatusPreconditionFailed {
+		t.Errorf("POST /api/v1/rules with a stale If-Match = %d; want 412", response.Code)
+	}
+	if response := do(http.MethodPost, "/api/v1/rules", create); response.Code != http.StatusConflict {
+		t.Errorf("POST /api/v1/rules of an existing rule = %d; want 409", response.Code)
+	}
+	if response := do(http.MethodPost, "/api/v1/rules", `{"rule": "accept ingress ssh from 10.0.0.0/8"}`); response.Code != http.StatusBadRequest {
+		t.Errorf("POST /api/v1/rules without a ttl = %d; want 400", response.Code)
+	}
+
+	if response := do(http.MethodGet, "/api/v1/rules/"+id, ""); response.Code != http.StatusOK || response.Header().Get("ETag") != `"`+created.Revision+`"` {
+		t.Errorf("GET /api/v1/rules/%s = %d; want 200 with the new revision", id, response.Code)
+	}
+	if response := do(http.MethodPost, "/api/v1/rules/"+id+"/renew", `{"duration": "1h"}`); response.Code != http.StatusOK {
+		t.Errorf("POST /api/v1/rules/%s/renew = %d %s; want 200", id, response.Code, response.Body)
+	}
+	if response := do(http.MethodDelete, "/api/v1/rules/"+id, ""); response.Code != http.StatusNoContent {
+		t.Errorf("DELETE /api/v1/rules/%s = %d %s; want 204", id, response.Code, response.Body)
+	}
+	if response := do(http.MethodGet, "/api/v1/rules/"+id, ""); response.Code != http.StatusNotFound {
+		t.Errorf("GET /api/v1/rules/%s after DELETE = %d; want 404", id, response.Code)
+	}
+
+	if response := do(http.MethodPost, "/api/v1/sync", ""); response.Code != http.StatusAccepted {
+		t.Errorf("POST /api/v1/sync = %d; want 202", response.Code)
+	}
+	if response := do(http.MethodGet, "/api/v1/syncs/last", ""); response.Code != http.StatusNotFound {
+		t.Errorf("GET /api/v1/syncs/last without state = %d; want 404", response.Code)
+	}
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"aliyun-security-group-mgr/internal/logging"
+	"aliyun-security-group-mgr/internal/oidc"
+	"aliyun-security-group-mgr/internal/renewal"
+	"aliyun-security-group-mgr/internal/service"
+
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+var logger = logging.Component("api")
+
+// Server is the HTTP API of a worker. The REST API under /api/v1 needs a
+// user with the scope of each route; renewal links carry their own signed
+// token.
+type Server struct {
+	Service *service.Service
+
+	mux            *http.ServeMux
+	trustedProxies []netip.Prefix
+	users          []*user
+	roles          []*role
+	verifier       *oidc.Verifier
+	userClaim      string
+	replays        replayCache
+}
+
+func NewServer(svc *service.Service) (*Server, error) {
+	trustedProxies, err := parseTrustedProxies(svc.Config.Api.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{Service: svc, mux: http.NewServeMux(), trustedProxies: trustedProxies}
+	if err := s.loadAuth(svc.Config.Api); err != nil {
+		return nil, err
+	}
+	s.mux.HandleFunc("GET /renew", s.renewPage)
+	s.mux.HandleFunc("POST /renew", s.renewForm)
+	s.mux.HandleFunc("POST /api/v1/renew", s.renew)
+
+	s.mux.HandleFunc("GET /api/v1/rules", s.authenticated(ScopeRead, s.listRules))
+	s.mux.HandleFunc("POST /api/v1/rules", s.authenticated(ScopeRequestTemporary, s.createRule))
+	s.mux.HandleFunc("GET /api/v1/rules/{id}", s.authenticated(ScopeRead, s.getRule))
+	s.mux.HandleFunc("DELETE /api/v1/rules/{id}", s.authenticated(ScopeRequestTemporary, s.deleteRule))
+	s.mux.HandleFunc("POST /api/v1/rules/{id}/renew", s.authenticated(ScopeRequestTemporary, s.renewRule))
+	s.mux.HandleFunc("POST /api/v1/sync", s.authenticated(ScopeAdmin, s.triggerSync))
+	s.mux.HandleFunc("GET /api/v1/syncs/last", s.authenticated(ScopeRead, s.lastSync))
+	s.mux.HandleFunc("POST /api/v1/allow-me", s.authenticated(ScopeRequestTemporary, s.allowMe))
+	s.mux.HandleFunc("GET /api/v1/requests", s.authenticated(ScopeRead, s.listRequests))
+	s.mux.HandleFunc("GET /api/v1/requests/{id}", s.authenticated(ScopeRead, s.getRequest))
+	s.mux.HandleFunc("POST /api/v1/requests/{id}/approve", s.authenticated(ScopeApprove, s.approveRequest))
+	s.mux.HandleFunc("POST /api/v1/requests/{id}/deny", s.authenticated(ScopeApprove, s.denyRequest))
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves the API on addr until it fails
+func (s *Server) ListenAndServe(addr string) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	logger.Info("api listening", "addr", addr)
+	return server.ListenAndServe()
+}
+
+// errorStatus returns the status answering a failed request
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, renewal.ErrInvalidToken), errors.Is(err, service.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, service.ErrLimitExceeded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, service.ErrRenewalDisabled), errors.Is(err, service.ErrRuleNotFound), errors.Is(err, service.ErrNoSync),
+		errors.Is(err, service.ErrRequestNotFound), errors.Is(err, service.ErrNoRequests):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrRenewalExpired):
+		return http.StatusGone
+	case errors.Is(err, service.ErrRuleChanged), errors.Is(err, service.ErrRuleExists), errors.Is(err, service.ErrRequestDecided):
+		return http.StatusConflict
+	case errors.Is(err, service.ErrRevisionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, service.ErrInvalidRule), errors.Is(err, service.ErrNotEditable):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeJSON answers with v encoded as JSON
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers with an error message as JSON
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,216 @@
+package audit
+
+import (
+	"aliyun-security-group-mgr/internal/ecs"
+
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Actions on a rule
+const (
+	ActionAdd    = "add"
+	ActionModify = "modify"
+	ActionRevoke = "revoke"
+	// ActionRequest, ActionApprove and ActionDeny are the steps of an
+	// access request, recorded before any rule is written
+	ActionRequest = "request"
+	ActionApprove = "approve"
+	ActionDeny    = "deny"
+)
+
+// Triggers of a change
+const (
+	// TriggerFileChange is a sync after the rules files changed
+	TriggerFileChange = "file change"
+	// TriggerExpiry is the removal of an expired rule
+	TriggerExpiry = "expiry"
+	// TriggerDrift is the remediation of drift
+	TriggerDrift = "drift"
+	// TriggerCli is a command run by a user, such as sgmgr rollback
+	TriggerCli = "cli"
+	// TriggerApproval is a decision on an access request made through the API
+	TriggerApproval = "approval"
+	// TriggerRollback is the restore of the live rules from before a sync,
+	// after it failed or on demand
+	TriggerRollback = "rollback"
+)
+
+// Record is a change of one rule, as attempted; Error is set if it failed
+type Record struct {
+	Time            time.Time `json:"time"`
+	SecurityGroupId string    `json:"security_group_id"`
+	Action          string    `json:"action"`
+	// Before is the rule changed, for modify and revoke
+	Before *ecs.SecurityGroupRule `json:"before,omitempty"`
+	// After is the rule added or the modified one, for add and modify
+	After   *ecs.SecurityGroupRule `json:"after,omitempty"`
+	Trigger string                 `json:"trigger"`
+	Actor   string                 `json:"actor"`
+	// Owner is who asked for the rule, for rules added through the API
+	Owner string `json:"owner,omitempty"`
+	// Revision of the rules files changed to
+	Revision  string `json:"revision,omitempty"`
+	SyncId    string `json:"sync_id"`
+	RequestId string `json:"request_id,omitempty"`
+	// AccessRequest is the access request a record of its steps is about
+	AccessRequest string `json:"access_request,omitempty"`
+	// Comment of the approver, for approve and deny
+	Comment string `json:"comment,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	// PrevHash and Hash chain the records when chaining is enabled; Hash
+	// is computed over the record with PrevHash set and Hash empty
+	PrevHash string `json:"prev_hash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// Log is an append-only file of records, one JSON object per line
+type Log struct {
+	path  string
+	chain bool
+
+	mu sync.Mutex
+}
+
+func NewLog(path string, chain bool) *Log {
+	return &Log{
+		path:  path,
+		chain: chain,
+	}
+}
+
+// Append writes a record at the end of the log. With chaining, the hash
+// of the last record is read from the file on each append, so that the
+// worker and the CLI can share a log; the file is locked meanwhile so
+// that both do not chain to the same record.
+func (l *Log) Append(record *Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := lockFile(file); err != nil {
+		return fmt.Errorf("failed to lock %s: %w", l.path, err)
+	}
+	// closing the file releases the lock
+
+	if l.chain {
+		last, err := lastLine(file)
+		if err != nil {
+			return err
+		}
+		record.PrevHash = ""
+		if len(last) > 0 {
+			var previous Record
+			if err := json.Unmarshal(last, &previous); err != nil {
+				return fmt.Errorf("invalid last record of %s: %w", l.path, err)
+			}
+			record.PrevHash = previous.Hash
+		}
+		if record.Hash, err = hashRecord(record); err != nil {
+			return err
+		}
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// hashRecord returns the hash of a record, ignoring its Hash
+func hashRecord(record *Record) (string, error) {
+	unhashed := *record
+	unhashed.Hash = ""
+	data, err := json.Marshal(unhashed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// lastLine returns the last line of a file without its newline, or nil
+// for an empty file; records are far smaller than the block read
+func lastLine(file *os.File) ([]byte, error) {
+	const block = 64 * 1024
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size() - block
+	if offset < 0 {
+		offset = 0
+	}
+	data := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(data, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return nil, nil
+	}
+	start := bytes.LastIndexByte(data, '\n')
+	if start < 0 && offset > 0 {
+		return nil, fmt.Errorf("last record of %s is longer than %d bytes", file.Name(), block)
+	}
+	return data[start+1:], nil
+}
+
+// Verify checks that every record of a log is chained to the one before
+// it, and returns the number of records
+func Verify(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	count := 0
+	prevHash := ""
+	for scanner.Scan() {
+		count++
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return count, fmt.Errorf("line %d: invalid record: %w", count, err)
+		}
+		if record.Hash == "" {
+			return count, fmt.Errorf("line %d: record is not chained", count)
+		}
+		if record.PrevHash != prevHash {
+			return count, fmt.Errorf("line %d: previous hash %s does not match %s, a record was removed or inserted", count, record.PrevHash, prevHash)
+		}
+		hash, err := hashRecord(&record)
+		if err != nil {
+			return count, err
+		}
+		if record.Hash != hash {
+			return count, fmt.Errorf("line %d: hash does not match the record, it was modified", count)
+		}
+		prevHash = record.Hash
+	}
+	return count, scanner.Err()
+}
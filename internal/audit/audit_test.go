@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"aliyun-security-group-mgr/internal/ecs"
+
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rule := ecs.SecurityGroupRule{Id: "sgr-1", CidrIp: "10.0.0.0/8", PortRange: "22/22", IpProtocol: "TCP"}
+
+	// records are appended through separate logs, as the worker and the CLI do
+	for i, action := range []string{ActionAdd, ActionModify, ActionRevoke} {
+		record := &Record{
+			Time:      start.Add(time.Duration(i) * time.Second),
+			Action:    action,
+			Before:    &rule,
+			Trigger:   TriggerFileChange,
+			Actor:     "test",
+			SyncId:    "sync",
+			RequestId: "request",
+		}
+		if err := NewLog(path, true).Append(record); err != nil {
+			t.Fatalf("Append returned error: %v", err)
+		}
+	}
+	if count, err := Verify(path); err != nil || count != 3 {
+		t.Fatalf("Verify = %d, %v; want 3 records", count, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"modified", bytes.Replace(data, []byte(`"modify"`), []byte(`"add"`), 1), "line 2: hash does not match"},
+		{"removed", append(append([]byte{}, lines[0]...), lines[2]...), "line 2: previous hash"},
+		{"unchained", append(append([]byte{}, data...), []byte(`{"action":"add"}`+"\n")...), "line 4: record is not chained"},
+	}
+	for _, test := range tests {
+		tampered := filepath.Join(t.TempDir(), "audit.jsonl")
+		if err := os.WriteFile(tampered, test.data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Verify(tampered); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Verify of a %s log = %v; want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestLogConcurrentAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	// separate logs lock the file against each other, as processes do
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log := NewLog(path, true)
+			for j := 0; j < 25; j++ {
+				if err := log.Append(&Record{Action: ActionAdd, Trigger: TriggerCli, Actor: "test"}); err != nil {
+					t.Errorf("Append returned error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count, err := Verify(path); err != nil || count != 100 {
+		t.Errorf("Verify = %d, %v; want 100 chained records", count, err)
+	}
+}
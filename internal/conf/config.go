@@ -2,6 +2,7 @@ package conf
 
 import (
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
@@ -20,7 +21,40 @@ type GlobalConfiguration struct {
 	// Security Group Info
 	SecurityGroup *SecurityGroup `split_words:"true"`
 
-	// Debug
+	// Guardrails checked before each sync
+	Guard *Guard
+
+	// Maximum rule lifetimes per service
+	Ttl *Ttl
+
+	// Sync behaviour
+	Sync *Sync
+
+	// Where snapshots taken before each sync are kept
+	State *State
+
+	// Periodic checks of the live rules against the rules files
+	Drift *Drift
+
+	// Log of every rule change
+	Audit *Audit
+
+	// Webhooks and email notified of failures, drift and expiring rules
+	Notify *Notify
+
+	// Links renewing expiring rules, sent with their reminders
+	Renewal *Renewal
+
+	// HTTP API of the worker
+	Api *Api
+
+	// Services only opened through the API once approved
+	Approval *Approval
+
+	// Log output
+	Log *Log
+
+	// Debug logs at debug level, including the API requests and responses
 	Debug *bool `json:"debug,omitempty" split_words:"true"`
 }
 
@@ -45,6 +79,147 @@ type SecurityGroup struct {
 	Id *string `json:"id,omitempty"`
 }
 
+type Guard struct {
+	Enabled *bool `json:"enabled,omitempty" default:"false"`
+	// "block" refuses the whole sync on any violation, "skip" leaves out the offending rules
+	Mode *string `json:"mode,omitempty" default:"block"`
+
+	// Services that must not be open to 0.0.0.0/0 or ::/0, e.g. "ssh,rdp,tcp/3306"
+	AdminPorts []string `json:"admin_ports,omitempty" split_words:"true"`
+	// Admin ports opened to a prefix shorter than this count as open to the world
+	AdminPrefixLength     *int `json:"admin_prefix_length,omitempty" split_words:"true" default:"8"`
+	AdminPrefixLengthIpv6 *int `json:"admin_prefix_length_ipv6,omitempty" split_words:"true" default:"16"`
+	// Shortest prefix length allowed for ingress accept rules, 0 to disable
+	MinPrefixLength     *int `json:"min_prefix_length,omitempty" split_words:"true" default:"0"`
+	MinPrefixLengthIpv6 *int `json:"min_prefix_length_ipv6,omitempty" split_words:"true" default:"0"`
+	// Ingress accept rules with a prefix shorter than this must expire within BroadMaxTtl
+	BroadPrefixLength     *int           `json:"broad_prefix_length,omitempty" split_words:"true" default:"0"`
+	BroadPrefixLengthIpv6 *int           `json:"broad_prefix_length_ipv6,omitempty" split_words:"true" default:"0"`
+	BroadMaxTtl           *time.Duration `json:"broad_max_ttl,omitempty" split_words:"true" default:"24h"`
+	RequireDescription    *bool          `json:"require_description,omitempty" split_words:"true" default:"false"`
+	// Accept rules must expire within this many days, 0 to disable
+	MaxExpiryDays *int `json:"max_expiry_days,omitempty" split_words:"true" default:"0"`
+}
+
+type Ttl struct {
+	// Maximum lifetime of ingress accept rules per service, e.g. "ssh:24h,mysql:168h,tcp/8000/8100:72h".
+	// Matching rules must have an expiry within it; other services are unlimited.
+	Max map[string]time.Duration `json:"max,omitempty"`
+	// Lifetime of the rules imported from ECS when the watch file is created,
+	// 0 to import them without expiry
+	ImportDefault *time.Duration `json:"import_default,omitempty" split_words:"true" default:"0"`
+}
+
+type Sync struct {
+	// Merge adjacent and contained cidrs of otherwise identical rules before syncing
+	Aggregate *bool `json:"aggregate,omitempty" default:"false"`
+	// Rules allowed in the security group, ingress and egress together
+	Quota *int `json:"quota,omitempty" default:"200"`
+	// Quota Center action code of the rule quota; when set the quota is fetched before each sync
+	QuotaCode *string `json:"quota_code,omitempty" split_words:"true"`
+}
+
+type State struct {
+	// Directory of the worker state, empty to keep none
+	Dir *string `json:"dir,omitempty" default:"state"`
+	// Number of snapshots kept, 0 to keep all
+	Keep *int `json:"keep,omitempty" default:"100"`
+}
+
+type Drift struct {
+	// Time between drift checks, 0 to disable
+	Interval *time.Duration `json:"interval,omitempty" default:"10m"`
+	// What a drift check does about each kind of difference: "report" only
+	// logs it, "remediate" also brings the live rules back to the rules files
+	Unmanaged *string `json:"unmanaged,omitempty" default:"report"`
+	Modified  *string `json:"modified,omitempty" default:"report"`
+	Missing   *string `json:"missing,omitempty" default:"report"`
+}
+
+type Log struct {
+	// "debug", "info", "warn" or "error"
+	Level *string `json:"level,omitempty" default:"info"`
+	// "text" or "json"
+	Format *string `json:"format,omitempty" default:"text"`
+}
+
+type Notify struct {
+	// Webhook urls, each optionally prefixed with its payload format:
+	// "generic:" (the default), "dingtalk:", "feishu:" or "slack:"
+	Webhooks []string `json:"webhooks,omitempty"`
+	// Events notified, all by default: sync_failed, drift, guardrail_violation, expiring, access_request
+	Events []string `json:"events,omitempty"`
+	// File of Go text/template templates named after the events, "default" and "title"
+	Templates *string `json:"templates,omitempty"`
+	// Retries of a failed post, with a doubling delay from 1s
+	Retries *int           `json:"retries,omitempty" default:"3"`
+	Timeout *time.Duration `json:"timeout,omitempty" default:"10s"`
+	// Rules expiring within each of these times are reminded, once per lead
+	// time, e.g. "72h,24h,1h"
+	ExpiryLead []time.Duration `json:"expiry_lead,omitempty" split_words:"true" default:"24h"`
+	// Time between checks for expiring rules
+	ExpiryInterval *time.Duration `json:"expiry_interval,omitempty" split_words:"true" default:"1h"`
+
+	// SMTP server events are also emailed through, host:port, empty to send no email
+	SmtpAddr     *string  `json:"smtp_addr,omitempty" split_words:"true"`
+	SmtpUsername *string  `json:"smtp_username,omitempty" split_words:"true"`
+	SmtpPassword *string  `json:"smtp_password,omitempty" split_words:"true"`
+	SmtpFrom     *string  `json:"smtp_from,omitempty" split_words:"true"`
+	SmtpTo       []string `json:"smtp_to,omitempty" split_words:"true"`
+}
+
+type Renewal struct {
+	// Key signing the renewal links of reminders, empty to send none
+	Secret *string `json:"secret,omitempty"`
+	// How long after a rule expired its renewal link still works
+	Grace *time.Duration `json:"grace,omitempty" default:"24h"`
+	// What a renewal extends a rule by when its original duration is unknown
+	DefaultDuration *time.Duration `json:"default_duration,omitempty" split_words:"true" default:"24h"`
+}
+
+type Api struct {
+	// Address the HTTP API listens on, e.g. ":8080", empty to disable it
+	Listen *string `json:"listen,omitempty"`
+	// Url the API is reached at, used in the links sent, e.g. "https://sgmgr.example.com"
+	BaseUrl *string `json:"base_url,omitempty" split_words:"true"`
+	// Bearer token of the REST API with every scope, for the user "api"
+	Token *string `json:"token,omitempty"`
+	// File of the users of the REST API, with their tokens, HMAC secrets, scopes and limits
+	Users *string `json:"users,omitempty"`
+	// Largest difference allowed between the time of an HMAC-signed request and the worker's
+	HmacSkew *time.Duration `json:"hmac_skew,omitempty" split_words:"true" default:"5m"`
+	// Key set JWTs are verified with, a file or an http(s) URL, empty to accept no JWT
+	Jwks *string `json:"jwks,omitempty"`
+	// How often the key set is read again
+	JwksRefresh *time.Duration `json:"jwks_refresh,omitempty" split_words:"true" default:"1h"`
+	// Issuer JWTs must be issued by
+	JwtIssuer *string `json:"jwt_issuer,omitempty" split_words:"true"`
+	// Audience JWTs must be issued for
+	JwtAudience *string `json:"jwt_audience,omitempty" split_words:"true"`
+	// Claim holding the name of the user of a JWT, the owner of their rules
+	JwtUserClaim *string `json:"jwt_user_claim,omitempty" split_words:"true" default:"email"`
+	// Leeway allowed for the clock of the issuer when checking the validity of a JWT
+	JwtLeeway *time.Duration `json:"jwt_leeway,omitempty" split_words:"true" default:"1m"`
+	// Proxies trusted to tell the address of the client, e.g. "10.0.0.0/8,127.0.0.1/32"
+	TrustedProxies []string `json:"trusted_proxies,omitempty" split_words:"true"`
+	// Header trusted proxies put the client's address in, "X-Forwarded-For" or one holding a single address such as "X-Real-IP"
+	ClientIpHeader *string `json:"client_ip_header,omitempty" split_words:"true" default:"X-Forwarded-For"`
+	// Longest time allow-me opens a service for
+	AllowMaxTtl *time.Duration `json:"allow_max_ttl,omitempty" split_words:"true" default:"12h"`
+}
+
+type Approval struct {
+	// Services that need an approver to be opened by users with limits, e.g. "mysql,postgres,rdp"
+	Ports []string `json:"ports,omitempty"`
+}
+
+type Audit struct {
+	// File the audit log is appended to, empty to keep none
+	Path *string `json:"path,omitempty" default:"state/audit.jsonl"`
+	// Chain each record to the one before it with a hash, checked by sgmgr audit verify
+	Chain *bool `json:"chain,omitempty" default:"true"`
+}
+
 var (
 	DefaultPrefix = "ALIYUN_SGMGR"
 )
@@ -55,6 +230,17 @@ func NewConfig() *GlobalConfiguration {
 		Reloader:      &Reloader{},
 		ECS:           &ECS{},
 		SecurityGroup: &SecurityGroup{},
+		Guard:         &Guard{},
+		Ttl:           &Ttl{},
+		Sync:          &Sync{},
+		State:         &State{},
+		Drift:         &Drift{},
+		Audit:         &Audit{},
+		Log:           &Log{},
+		Notify:        &Notify{},
+		Renewal:       &Renewal{},
+		Api:           &Api{},
+		Approval:      &Approval{},
 	}
 }
 
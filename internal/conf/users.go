@@ -0,0 +1,65 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ApiUsers is the users file of the REST API
+type ApiUsers struct {
+	Users []ApiUser `yaml:"users"`
+	// Roles given to the users signing in with a JWT, by its claims
+	Roles []ApiRole `yaml:"roles"`
+}
+
+// ApiGrant is what a user or a role may do through the REST API
+type ApiGrant struct {
+	// Scopes: read, request-temporary, admin
+	Scopes []string `yaml:"scopes"`
+	// Services that may be opened, e.g. "ssh" or "tcp/8000/8100", any when empty
+	Ports []string `yaml:"ports"`
+	// Cidrs services may be opened to, any when empty
+	Cidrs []string `yaml:"cidrs"`
+	// Longest a rule may last, unlimited when 0
+	MaxTtl time.Duration `yaml:"max_ttl"`
+	// How many unexpired temporary rules each user may own at once, unlimited when 0
+	MaxRules int `yaml:"max_rules"`
+}
+
+// ApiUser is a user of the REST API, as written in the users file
+type ApiUser struct {
+	// Name is the owner of the rules the user creates
+	Name string `yaml:"name"`
+	// Bearer tokens of the user
+	Tokens []string `yaml:"tokens"`
+	// Secret the user signs requests with, see the README for the scheme
+	Secret string `yaml:"secret"`
+
+	ApiGrant `yaml:",inline"`
+}
+
+// ApiRole is given to the users whose JWT has the claims of the role
+type ApiRole struct {
+	Name string `yaml:"name"`
+	// Claims the JWT must have, each with one of the values listed; a claim
+	// holding a list matches when any of its values does
+	Claims map[string][]string `yaml:"claims"`
+
+	ApiGrant `yaml:",inline"`
+}
+
+// LoadApiUsers reads the users file of the REST API, in YAML or JSON
+func LoadApiUsers(path string) (*ApiUsers, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var users ApiUsers
+	if err := yaml.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("invalid users file %s: %w", path, err)
+	}
+	return &users, nil
+}
@@ -1,7 +1,10 @@
 package ecs
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 
 	openapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
 	ecs "github.com/alibabacloud-go/ecs-20140526/v7/client"
@@ -10,25 +13,51 @@ import (
 	credential "github.com/aliyun/credentials-go/credentials"
 
 	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/logging"
+	"aliyun-security-group-mgr/internal/utils"
 )
 
+// Backend is the security group API rules are synced with; Clerk
+// implements it against Aliyun, and Fake in memory for tests
+type Backend interface {
+	DescribeSecurityGroupAttribute() ([]SecurityGroupRule, error)
+	// AddSecurityGroupRule, ModifySecurityGroupRule and
+	// RemoveSecurityGroupRule return the RequestId of the API call, also
+	// when it fails if the API returned one
+	AddSecurityGroupRule(rule SecurityGroupRule) (string, error)
+	ModifySecurityGroupRule(ruleId string, newRule SecurityGroupRule) (string, error)
+	RemoveSecurityGroupRule(rule SecurityGroupRule) (string, error)
+	GetRuleQuota(quotaActionCode string) (int, error)
+}
+
 type Clerk struct {
 	ecsClient *ecs.Client
 	config    *conf.GlobalConfiguration
+
+	// openapiConfig is kept for clients of other products, see quota.go
+	openapiConfig *openapi.Config
 }
 
 func NewClerk(globalConfig *conf.GlobalConfiguration) (*Clerk, error) {
-	client, err := createClient(globalConfig)
+	config, err := createConfig(globalConfig)
+	if err != nil {
+		return nil, err
+	}
+	// Endpoint 请参考 https://api.aliyun.com/product/Ecs
+	config.Endpoint = tea.String(*globalConfig.ECS.Endpoint)
+
+	client, err := ecs.NewClient(config)
 	if err != nil {
 		return nil, err
 	}
 	return &Clerk{
-		ecsClient: client,
-		config:    globalConfig,
+		ecsClient:     client,
+		config:        globalConfig,
+		openapiConfig: config,
 	}, nil
 }
 
-func createClient(globalConfig *conf.GlobalConfiguration) (*ecs.Client, error) {
+func createConfig(globalConfig *conf.GlobalConfiguration) (*openapi.Config, error) {
 	credentialConfig := &credential.Config{
 		Type:            tea.String(*globalConfig.Credential.Type),
 		AccessKeyId:     tea.String(*globalConfig.Credential.AccessKeyId),
@@ -39,13 +68,9 @@ func createClient(globalConfig *conf.GlobalConfiguration) (*ecs.Client, error) {
 		return nil, err
 	}
 
-	config := &openapi.Config{
+	return &openapi.Config{
 		Credential: credential,
-	}
-	// Endpoint 请参考 https://api.aliyun.com/product/Ecs
-	config.Endpoint = tea.String(*globalConfig.ECS.Endpoint)
-
-	return ecs.NewClient(config)
+	}, nil
 }
 
 func (e *Clerk) DescribeSecurityGroupAttribute() ([]SecurityGroupRule, error) {
@@ -55,6 +80,7 @@ func (e *Clerk) DescribeSecurityGroupAttribute() ([]SecurityGroupRule, error) {
 	}
 	runtime := &util.RuntimeOptions{}
 	response, err := e.ecsClient.DescribeSecurityGroupAttributeWithOptions(describeSecurityGroupAttributeRequest, runtime)
+	e.logCall("DescribeSecurityGroupAttribute", describeSecurityGroupAttributeRequest, response, err)
 	if err != nil {
 		return nil, err
 	}
@@ -78,71 +104,82 @@ func (e *Clerk) GetIpRules(cidrIp string) ([]SecurityGroupRule, error) {
 	return filteredRules, nil
 }
 
-func (e *Clerk) AddSecurityGroupRule(rule SecurityGroupRule) error {
+func (e *Clerk) AddSecurityGroupRule(rule SecurityGroupRule) (string, error) {
 	switch rule.Direction {
 	case DirectionIngress:
 		return e.addIngressSecurityGroupRule(rule)
 	case DirectionEgress:
 		return e.addEgressSecurityGroupRule(rule)
 	default:
-		return fmt.Errorf("unsupported direction: %s for rule: %v", rule.Direction, rule)
+		return "", fmt.Errorf("unsupported direction: %s for rule: %v", rule.Direction, rule)
 	}
 }
 
-func (e *Clerk) addIngressSecurityGroupRule(rule SecurityGroupRule) error {
+func (e *Clerk) addIngressSecurityGroupRule(rule SecurityGroupRule) (string, error) {
 	authorizeSecurityGroupRequest := &ecs.AuthorizeSecurityGroupRequest{
 		RegionId:        e.config.ECS.RegionId,
 		SecurityGroupId: e.config.SecurityGroup.Id,
 
-		IpProtocol:   &rule.IpProtocol,
-		PortRange:    &rule.PortRange,
-		SourceCidrIp: &rule.CidrIp,
-		Description:  &rule.Description,
-		Priority:     tea.String("1"),
-		Policy:       &rule.Policy,
+		IpProtocol:  &rule.IpProtocol,
+		PortRange:   &rule.PortRange,
+		Description: &rule.Description,
+		Priority:    &rule.Priority,
+		Policy:      &rule.Policy,
+	}
+	// IPv6 cidrs have their own parameter
+	if utils.IsIpv6Cidr(rule.CidrIp) {
+		authorizeSecurityGroupRequest.Ipv6SourceCidrIp = &rule.CidrIp
+	} else {
+		authorizeSecurityGroupRequest.SourceCidrIp = &rule.CidrIp
 	}
 
 	runtime := &util.RuntimeOptions{}
-	_, err := e.ecsClient.AuthorizeSecurityGroupWithOptions(authorizeSecurityGroupRequest, runtime)
+	response, err := e.ecsClient.AuthorizeSecurityGroupWithOptions(authorizeSecurityGroupRequest, runtime)
+	e.logCall("AuthorizeSecurityGroup", authorizeSecurityGroupRequest, response, err)
 	if err != nil {
-		return err
+		return requestIdOf(err), err
 	}
-	return nil
+	return tea.StringValue(response.Body.RequestId), nil
 }
 
-func (e *Clerk) addEgressSecurityGroupRule(rule SecurityGroupRule) error {
+func (e *Clerk) addEgressSecurityGroupRule(rule SecurityGroupRule) (string, error) {
 	authorizeSecurityGroupEgressRequest := &ecs.AuthorizeSecurityGroupEgressRequest{
 		RegionId:        e.config.ECS.RegionId,
 		SecurityGroupId: e.config.SecurityGroup.Id,
 
 		IpProtocol:  &rule.IpProtocol,
 		PortRange:   &rule.PortRange,
-		DestCidrIp:  &rule.CidrIp,
 		Description: &rule.Description,
-		Priority:    tea.String("1"),
+		Priority:    &rule.Priority,
 		Policy:      &rule.Policy,
 	}
+	if utils.IsIpv6Cidr(rule.CidrIp) {
+		authorizeSecurityGroupEgressRequest.Ipv6DestCidrIp = &rule.CidrIp
+	} else {
+		authorizeSecurityGroupEgressRequest.DestCidrIp = &rule.CidrIp
+	}
 
 	runtime := &util.RuntimeOptions{}
-	_, err := e.ecsClient.AuthorizeSecurityGroupEgressWithOptions(authorizeSecurityGroupEgressRequest, runtime)
+	response, err := e.ecsClient.AuthorizeSecurityGroupEgressWithOptions(authorizeSecurityGroupEgressRequest, runtime)
+	e.logCall("AuthorizeSecurityGroupEgress", authorizeSecurityGroupEgressRequest, response, err)
 	if err != nil {
-		return err
+		return requestIdOf(err), err
 	}
-	return nil
+	return tea.StringValue(response.Body.RequestId), nil
 }
 
-func (e *Clerk) RemoveSecurityGroupRule(rule SecurityGroupRule) error {
+func (e *Clerk) RemoveSecurityGroupRule(rule SecurityGroupRule) (string, error) {
 	switch rule.Direction {
 	case DirectionIngress:
 		return e.removeIngressSecurityGroupRule(rule)
 	case DirectionEgress:
 		return e.removeEgressSecurityGroupRule(rule)
 	default:
-		return fmt.Errorf("unsupported direction: %s for rule: %v", rule.Direction, rule)
+		return "", fmt.Errorf("unsupported direction: %s for rule: %v", rule.Direction, rule)
 	}
 }
 
-func (e *Clerk) removeIngressSecurityGroupRule(rule SecurityGroupRule) error {
+func (e *Clerk) removeIngressSecurityGroupRule(rule SecurityGroupRule) (string, error) {
 	revokeSecurityGroupRequest := &ecs.RevokeSecurityGroupRequest{
 		RegionId:        e.config.ECS.RegionId,
 		SecurityGroupId: e.config.SecurityGroup.Id,
@@ -150,14 +187,15 @@ func (e *Clerk) removeIngressSecurityGroupRule(rule SecurityGroupRule) error {
 		SecurityGroupRuleId: []*string{tea.String(rule.Id)},
 	}
 	runtime := &util.RuntimeOptions{}
-	_, err := e.ecsClient.RevokeSecurityGroupWithOptions(revokeSecurityGroupRequest, runtime)
+	response, err := e.ecsClient.RevokeSecurityGroupWithOptions(revokeSecurityGroupRequest, runtime)
+	e.logCall("RevokeSecurityGroup", revokeSecurityGroupRequest, response, err)
 	if err != nil {
-		return err
+		return requestIdOf(err), err
 	}
-	return nil
+	return tea.StringValue(response.Body.RequestId), nil
 }
 
-func (e *Clerk) removeEgressSecurityGroupRule(rule SecurityGroupRule) error {
+func (e *Clerk) removeEgressSecurityGroupRule(rule SecurityGroupRule) (string, error) {
 	revokeSecurityGroupEgressRequest := &ecs.RevokeSecurityGroupEgressRequest{
 		RegionId:        e.config.ECS.RegionId,
 		SecurityGroupId: e.config.SecurityGroup.Id,
@@ -166,25 +204,26 @@ func (e *Clerk) removeEgressSecurityGroupRule(rule SecurityGroupRule) error {
 	}
 
 	runtime := &util.RuntimeOptions{}
-	_, err := e.ecsClient.RevokeSecurityGroupEgressWithOptions(revokeSecurityGroupEgressRequest, runtime)
+	response, err := e.ecsClient.RevokeSecurityGroupEgressWithOptions(revokeSecurityGroupEgressRequest, runtime)
+	e.logCall("RevokeSecurityGroupEgress", revokeSecurityGroupEgressRequest, response, err)
 	if err != nil {
-		return err
+		return requestIdOf(err), err
 	}
-	return nil
+	return tea.StringValue(response.Body.RequestId), nil
 }
 
-func (e *Clerk) ModifySecurityGroupRule(ruleId string, newRule SecurityGroupRule) error {
+func (e *Clerk) ModifySecurityGroupRule(ruleId string, newRule SecurityGroupRule) (string, error) {
 	switch newRule.Direction {
 	case DirectionIngress:
 		return e.modifyIngressSecurityRule(ruleId, newRule)
 	case DirectionEgress:
 		return e.modifyEgressSecurityRule(ruleId, newRule)
 	default:
-		return fmt.Errorf("unsupported direction: %s for rule: %v", newRule.Direction, newRule)
+		return "", fmt.Errorf("unsupported direction: %s for rule: %v", newRule.Direction, newRule)
 	}
 }
 
-func (e *Clerk) modifyIngressSecurityRule(ruleId string, newRule SecurityGroupRule) error {
+func (e *Clerk) modifyIngressSecurityRule(ruleId string, newRule SecurityGroupRule) (string, error) {
 	modifySecurityGroupRuleRequest := &ecs.ModifySecurityGroupRuleRequest{
 		RegionId:        e.config.ECS.RegionId,
 		SecurityGroupId: e.config.SecurityGroup.Id,
@@ -198,15 +237,15 @@ func (e *Clerk) modifyIngressSecurityRule(ruleId string, newRule SecurityGroupRu
 	}
 
 	runtime := &util.RuntimeOptions{}
-	_, err := e.ecsClient.ModifySecurityGroupRuleWithOptions(modifySecurityGroupRuleRequest, runtime)
+	response, err := e.ecsClient.ModifySecurityGroupRuleWithOptions(modifySecurityGroupRuleRequest, runtime)
+	e.logCall("ModifySecurityGroupRule", modifySecurityGroupRuleRequest, response, err)
 	if err != nil {
-		return err
+		return requestIdOf(err), err
 	}
-
-	return nil
+	return tea.StringValue(response.Body.RequestId), nil
 }
 
-func (e *Clerk) modifyEgressSecurityRule(ruleId string, newRule SecurityGroupRule) error {
+func (e *Clerk) modifyEgressSecurityRule(ruleId string, newRule SecurityGroupRule) (string, error) {
 	modifySecurityGroupEgressRuleRequest := &ecs.ModifySecurityGroupEgressRuleRequest{
 		RegionId:        e.config.ECS.RegionId,
 		SecurityGroupId: e.config.SecurityGroup.Id,
@@ -220,10 +259,35 @@ func (e *Clerk) modifyEgressSecurityRule(ruleId string, newRule SecurityGroupRul
 	}
 
 	runtime := &util.RuntimeOptions{}
-	_, err := e.ecsClient.ModifySecurityGroupEgressRuleWithOptions(modifySecurityGroupEgressRuleRequest, runtime)
+	response, err := e.ecsClient.ModifySecurityGroupEgressRuleWithOptions(modifySecurityGroupEgressRuleRequest, runtime)
+	e.logCall("ModifySecurityGroupEgressRule", modifySecurityGroupEgressRuleRequest, response, err)
 	if err != nil {
-		return err
+		return requestIdOf(err), err
+	}
+	return tea.StringValue(response.Body.RequestId), nil
+}
+
+// requestIdOf returns the RequestId of a failed API call, or "" when the
+// call failed before the API answered
+func requestIdOf(err error) string {
+	var apiErr interface{ GetRequestId() *string }
+	if errors.As(err, &apiErr) {
+		return tea.StringValue(apiErr.GetRequestId())
 	}
+	return ""
+}
+
+var logger = logging.Component("ecs")
 
-	return nil
+// logCall logs an API call in debug mode, with credentials redacted
+func (e *Clerk) logCall(action string, request any, response any, err error) {
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	args := []any{"action", action, logging.KeySecurityGroup, tea.StringValue(e.config.SecurityGroup.Id),
+		"request", logging.Redact(request), "response", logging.Redact(response)}
+	if err != nil {
+		args = append(args, logging.KeyError, err)
+	}
+	logger.Debug("api call", args...)
 }
@@ -0,0 +1,104 @@
+package ecs
+
+import (
+	"fmt"
+)
+
+// Fake is an in-memory Backend for tests
+type Fake struct {
+	Rules []SecurityGroupRule
+	Quota int
+
+	// Snapshots holds the rules after each change, to check states
+	// reached in the middle of a sync
+	Snapshots [][]SecurityGroupRule
+	// Fail, when set, fails the operation ("add", "modify" or "remove")
+	// on a rule when it returns an error
+	Fail func(op string, rule SecurityGroupRule) error
+
+	nextId        int
+	nextRequestId int
+}
+
+var _ Backend = (*Fake)(nil)
+var _ Backend = (*Clerk)(nil)
+
+func (f *Fake) DescribeSecurityGroupAttribute() ([]SecurityGroupRule, error) {
+	return append([]SecurityGroupRule{}, f.Rules...), nil
+}
+
+func (f *Fake) AddSecurityGroupRule(rule SecurityGroupRule) (string, error) {
+	requestId := f.requestId()
+	if err := f.fail("add", rule); err != nil {
+		return requestId, err
+	}
+	if len(f.Rules) >= f.Quota && f.Quota > 0 {
+		return requestId, fmt.Errorf("rule quota of %d exceeded", f.Quota)
+	}
+	f.nextId++
+	rule.Id = fmt.Sprintf("sgr-fake-%d", f.nextId)
+	f.Rules = append(f.Rules, rule)
+	f.snapshot()
+	return requestId, nil
+}
+
+func (f *Fake) ModifySecurityGroupRule(ruleId string, newRule SecurityGroupRule) (string, error) {
+	requestId := f.requestId()
+	if err := f.fail("modify", newRule); err != nil {
+		return requestId, err
+	}
+	i, err := f.find(ruleId)
+	if err != nil {
+		return requestId, err
+	}
+	// the cidr and direction of a rule cannot be modified
+	newRule.Id = ruleId
+	newRule.CidrIp = f.Rules[i].CidrIp
+	newRule.Direction = f.Rules[i].Direction
+	f.Rules[i] = newRule
+	f.snapshot()
+	return requestId, nil
+}
+
+func (f *Fake) RemoveSecurityGroupRule(rule SecurityGroupRule) (string, error) {
+	requestId := f.requestId()
+	if err := f.fail("remove", rule); err != nil {
+		return requestId, err
+	}
+	i, err := f.find(rule.Id)
+	if err != nil {
+		return requestId, err
+	}
+	f.Rules = append(f.Rules[:i], f.Rules[i+1:]...)
+	f.snapshot()
+	return requestId, nil
+}
+
+func (f *Fake) GetRuleQuota(quotaActionCode string) (int, error) {
+	return f.Quota, nil
+}
+
+func (f *Fake) fail(op string, rule SecurityGroupRule) error {
+	if f.Fail == nil {
+		return nil
+	}
+	return f.Fail(op, rule)
+}
+
+func (f *Fake) find(ruleId string) (int, error) {
+	for i, rule := range f.Rules {
+		if rule.Id == ruleId {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("rule not found: %s", ruleId)
+}
+
+func (f *Fake) requestId() string {
+	f.nextRequestId++
+	return fmt.Sprintf("FAKE-REQUEST-%d", f.nextRequestId)
+}
+
+func (f *Fake) snapshot() {
+	f.Snapshots = append(f.Snapshots, append([]SecurityGroupRule{}, f.Rules...))
+}
@@ -0,0 +1,59 @@
+package ecs
+
+import (
+	"fmt"
+	"strconv"
+
+	openapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
+	openapiutil "github.com/alibabacloud-go/darabonba-openapi/v2/utils"
+	util "github.com/alibabacloud-go/tea-utils/v2/service"
+	"github.com/alibabacloud-go/tea/tea"
+)
+
+// quotasEndpoint is the endpoint of the Quota Center
+const quotasEndpoint = "quotas.aliyuncs.com"
+
+// GetRuleQuota fetches the rule quota of security groups from the Quota
+// Center, given the quota action code of the ECS product. See
+// https://help.aliyun.com/document_detail/440558.html
+func (e *Clerk) GetRuleQuota(quotaActionCode string) (int, error) {
+	config := *e.openapiConfig
+	config.Endpoint = tea.String(quotasEndpoint)
+	client, err := openapi.NewClient(&config)
+	if err != nil {
+		return 0, err
+	}
+
+	params := &openapiutil.Params{
+		Action:      tea.String("GetProductQuota"),
+		Version:     tea.String("2020-05-10"),
+		Protocol:    tea.String("HTTPS"),
+		Pathname:    tea.String("/"),
+		Method:      tea.String("POST"),
+		AuthType:    tea.String("AK"),
+		Style:       tea.String("RPC"),
+		ReqBodyType: tea.String("json"),
+		BodyType:    tea.String("json"),
+	}
+	request := &openapiutil.OpenApiRequest{
+		Query: map[string]*string{
+			"ProductCode":     tea.String("ecs"),
+			"QuotaActionCode": tea.String(quotaActionCode),
+		},
+	}
+	runtime := &util.RuntimeOptions{}
+	response, err := client.CallApi(params, request, runtime)
+	e.logCall("GetProductQuota", request, response, err)
+	if err != nil {
+		return 0, err
+	}
+
+	body, _ := response["body"].(map[string]interface{})
+	quota, _ := body["Quota"].(map[string]interface{})
+	// the number may be decoded as float64 or json.Number
+	total, err := strconv.ParseFloat(fmt.Sprint(quota["TotalQuota"]), 64)
+	if err != nil {
+		return 0, fmt.Errorf("no quota in response for %s", quotaActionCode)
+	}
+	return int(total), nil
+}
@@ -2,6 +2,9 @@ package ecs
 
 import (
 	ecs "github.com/alibabacloud-go/ecs-20140526/v7/client"
+	"github.com/alibabacloud-go/tea/tea"
+
+	"aliyun-security-group-mgr/internal/utils"
 )
 
 type InnerDescribeSecurityGroupAttributeResponse ecs.DescribeSecurityGroupAttributeResponse
@@ -36,13 +39,30 @@ func buildSecurityGroupRules(response ecs.DescribeSecurityGroupAttributeResponse
 	}
 
 	for _, perm := range response.Body.Permissions.Permission {
+		// egress rules keep their cidr in DestCidrIp, IPv6 rules in the
+		// Ipv6 fields
+		cidrIp := tea.StringValue(perm.SourceCidrIp)
+		if cidrIp == "" {
+			cidrIp = tea.StringValue(perm.Ipv6SourceCidrIp)
+		}
+		if tea.StringValue(perm.Direction) == DirectionEgress {
+			cidrIp = tea.StringValue(perm.DestCidrIp)
+			if cidrIp == "" {
+				cidrIp = tea.StringValue(perm.Ipv6DestCidrIp)
+			}
+		}
+		// compare cidrs in the same form as the rules file
+		if normalized, err := utils.NormalizeCidr(cidrIp); err == nil {
+			cidrIp = normalized
+		}
+
 		rule := SecurityGroupRule{
 			Id:          *perm.SecurityGroupRuleId,
 			Policy:      *perm.Policy,
 			Priority:    *perm.Priority,
 			Description: *perm.Description,
 
-			CidrIp:     *perm.SourceCidrIp,
+			CidrIp:     cidrIp,
 			PortRange:  *perm.PortRange,
 			IpProtocol: *perm.IpProtocol,
 			Direction:  *perm.Direction,
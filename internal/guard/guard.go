@@ -0,0 +1,175 @@
+package guard
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/ecs"
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	ModeBlock = "block"
+	ModeSkip  = "skip"
+)
+
+// Violation is a rule breaking a guardrail
+type Violation struct {
+	Entry   reloader.Entry
+	Policy  string
+	Message string
+}
+
+func (v Violation) String() string {
+	location := v.Entry.Source.String()
+	if location == "" {
+		location = reloader.EncodeEntry(v.Entry)
+	}
+	return fmt.Sprintf("%s: %s [%s]", location, v.Message, v.Policy)
+}
+
+// Guard checks expected entries against the configured guardrails before
+// they are synced
+type Guard struct {
+	config     *conf.Guard
+	adminPorts []reloader.ServicePort
+
+	now func() time.Time
+}
+
+func NewGuard(config *conf.Guard) (*Guard, error) {
+	switch mode := valueOr(config.Mode, ModeBlock); mode {
+	case ModeBlock, ModeSkip:
+	default:
+		return nil, fmt.Errorf("invalid guard mode: %s", mode)
+	}
+
+	g := &Guard{
+		config: config,
+		now:    time.Now,
+	}
+	for _, spec := range config.AdminPorts {
+		servicePorts, err := reloader.ParseServiceSpec(strings.TrimSpace(spec))
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin port %s: %w", spec, err)
+		}
+		g.adminPorts = append(g.adminPorts, servicePorts...)
+	}
+	return g, nil
+}
+
+// Blocking reports whether any violation blocks the whole sync
+func (g *Guard) Blocking() bool {
+	return valueOr(g.config.Mode, ModeBlock) == ModeBlock
+}
+
+// Check returns the violations of every entry
+func (g *Guard) Check(entries []reloader.Entry) []Violation {
+	var violations []Violation
+	for _, entry := range entries {
+		violations = append(violations, g.checkEntry(entry)...)
+	}
+	return violations
+}
+
+// Filter returns the entries without violations, and the violations
+func (g *Guard) Filter(entries []reloader.Entry) ([]reloader.Entry, []Violation) {
+	var allowed []reloader.Entry
+	var violations []Violation
+	for _, entry := range entries {
+		entryViolations := g.checkEntry(entry)
+		if len(entryViolations) == 0 {
+			allowed = append(allowed, entry)
+		}
+		violations = append(violations, entryViolations...)
+	}
+	return allowed, violations
+}
+
+func (g *Guard) checkEntry(entry reloader.Entry) []Violation {
+	// expired rules are removed by the sync, which must not be blocked
+	now := g.now()
+	if entry.IsExpired(now) {
+		return nil
+	}
+
+	var violations []Violation
+	violate := func(policy string, format string, args ...interface{}) {
+		violations = append(violations, Violation{
+			Entry:   entry,
+			Policy:  policy,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	rule := entry.SecurityGroup
+	if valueOr(g.config.RequireDescription, false) && strings.TrimSpace(rule.Description) == "" {
+		violate("require-description", "rule has no description")
+	}
+
+	// the remaining guardrails only restrict what is opened
+	if rule.Policy != ecs.PolicyAccept {
+		return violations
+	}
+
+	// the cidr guardrails restrict who may connect in, not where the
+	// instances may connect to
+	if rule.Direction == ecs.DirectionIngress {
+		prefix, err := netip.ParsePrefix(rule.CidrIp)
+		if err != nil {
+			violate("invalid-cidr", "invalid cidr %s", rule.CidrIp)
+			return violations
+		}
+
+		adminPrefixLength := valueOr(g.config.AdminPrefixLength, 8)
+		minPrefixLength := valueOr(g.config.MinPrefixLength, 0)
+		broadPrefixLength := valueOr(g.config.BroadPrefixLength, 0)
+		if prefix.Addr().Is6() {
+			adminPrefixLength = valueOr(g.config.AdminPrefixLengthIpv6, 16)
+			minPrefixLength = valueOr(g.config.MinPrefixLengthIpv6, 0)
+			broadPrefixLength = valueOr(g.config.BroadPrefixLengthIpv6, 0)
+		}
+
+		// a prefix length threshold rather than /0, which splitting the
+		// world into 0.0.0.0/1,128.0.0.0/1 would get around
+		if prefix.Bits() == 0 || prefix.Bits() < adminPrefixLength {
+			for _, servicePort := range g.adminPorts {
+				if servicePort.Overlaps(rule.IpProtocol, rule.PortRange) {
+					violate("world-open-admin-port", "%s %s is open to %s", strings.ToLower(servicePort.IpProtocol), servicePort.PortRange, rule.CidrIp)
+					break
+				}
+			}
+		}
+
+		if prefix.Bits() < minPrefixLength {
+			violate("min-prefix-length", "prefix length of %s is shorter than /%d", rule.CidrIp, minPrefixLength)
+		}
+
+		if prefix.Bits() < broadPrefixLength {
+			maxTtl := valueOr(g.config.BroadMaxTtl, 24*time.Hour)
+			if entry.ExpireAt.IsZero() || entry.ExpireAt.Sub(now) > maxTtl {
+				violate("broad-cidr-ttl", "broad cidr %s must expire within %s", rule.CidrIp, maxTtl)
+			}
+		}
+	}
+
+	if days := valueOr(g.config.MaxExpiryDays, 0); days > 0 {
+		if entry.ExpireAt.IsZero() {
+			violate("max-expiry", "rule must expire within %d days", days)
+		} else if entry.ExpireAt.After(now.AddDate(0, 0, days)) {
+			violate("max-expiry", "rule expires at %s, more than %d days ahead", entry.ExpireAt.Format(time.RFC3339), days)
+		}
+	}
+
+	return violations
+}
+
+func valueOr[T any](value *T, fallback T) T {
+	if value == nil {
+		return fallback
+	}
+	return *value
+}
@@ -0,0 +1,110 @@
+package guard
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"testing"
+	"time"
+)
+
+func intPtr(v int) *int                          { return &v }
+func boolPtr(v bool) *bool                       { return &v }
+func stringPtr(v string) *string                 { return &v }
+func durationPtr(v time.Duration) *time.Duration { return &v }
+
+var now = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestGuardCheck(t *testing.T) {
+	config := &conf.Guard{
+		Mode:                stringPtr(ModeSkip),
+		AdminPorts:          []string{"ssh", "rdp", "tcp/3306"},
+		MinPrefixLength:     intPtr(8),
+		MinPrefixLengthIpv6: intPtr(32),
+		BroadPrefixLength:   intPtr(16),
+		BroadMaxTtl:         durationPtr(24 * time.Hour),
+		RequireDescription:  boolPtr(true),
+		MaxExpiryDays:       intPtr(30),
+	}
+	g, err := NewGuard(config)
+	if err != nil {
+		t.Fatalf("NewGuard returned error: %v", err)
+	}
+	g.now = func() time.Time { return now }
+
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"accept ingress ssh from 203.0.113.0/24 until 2026-01-10T00:00:00Z # ok", nil},
+		{"drop ingress all from 0.0.0.0/0 until never # deny everything", nil},
+		{"accept ingress ssh from 203.0.113.0/24 until 2026-01-10T00:00:00Z", []string{"require-description"}},
+		{"accept ingress tcp 1/65535 from 0.0.0.0/0 until 2026-01-01T12:00:00Z # all", []string{"world-open-admin-port", "min-prefix-length"}},
+		{"accept ingress https from 10.0.0.0/8 until 2026-01-03T00:00:00Z # broad", []string{"broad-cidr-ttl"}},
+		{"accept ingress https from 10.1.0.0/16 until 2026-03-01T00:00:00Z # late", []string{"max-expiry"}},
+		{"accept ingress https from 10.1.0.0/16 until never # forever", []string{"max-expiry"}},
+		{"accept ingress https from 2001:db8::/16 until 2026-01-01T12:00:00Z # v6", []string{"min-prefix-length"}},
+		{"accept ingress ssh from 0.0.0.0/1 until 2026-01-01T12:00:00Z # half", []string{"world-open-admin-port", "min-prefix-length"}},
+		{"accept ingress ssh from 2000::/3 until 2026-01-01T12:00:00Z # v6 internet", []string{"world-open-admin-port", "min-prefix-length"}},
+		{"accept ingress ssh from 10.0.0.0/8 until 2026-01-01T12:00:00Z # private", nil},
+		{"accept egress all to 0.0.0.0/0 until 2026-01-10T00:00:00Z # outbound", nil},
+		{"accept egress ssh to 0.0.0.0/1 until 2026-01-10T00:00:00Z # outbound", nil},
+		{"accept egress all to 0.0.0.0/0 until never # forever", []string{"max-expiry"}},
+		{"accept ingress ssh from 0.0.0.0/0 until 2025-12-31T00:00:00Z", nil},
+	}
+
+	for _, test := range tests {
+		entry, err := reloader.DecodeEntry(test.line)
+		if err != nil {
+			t.Fatalf("DecodeEntry(%q) returned error: %v", test.line, err)
+		}
+
+		violations := g.Check([]reloader.Entry{*entry})
+		if len(violations) != len(test.want) {
+			t.Errorf("Check(%q) = %v; want %v", test.line, violations, test.want)
+			continue
+		}
+		for i, violation := range violations {
+			if violation.Policy != test.want[i] {
+				t.Errorf("Check(%q) violation %d = %s; want %s", test.line, i, violation.Policy, test.want[i])
+			}
+		}
+	}
+}
+
+func TestGuardFilter(t *testing.T) {
+	g, err := NewGuard(&conf.Guard{RequireDescription: boolPtr(true), Mode: stringPtr(ModeSkip)})
+	if err != nil {
+		t.Fatalf("NewGuard returned error: %v", err)
+	}
+
+	var entries []reloader.Entry
+	for _, line := range []string{
+		"accept ingress ssh from 10.0.0.0/8 until never # described",
+		"accept ingress https from 10.0.0.0/8 until never",
+	} {
+		entry, err := reloader.DecodeEntry(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, *entry)
+	}
+
+	allowed, violations := g.Filter(entries)
+	if len(allowed) != 1 || allowed[0].SecurityGroup.Description != "described" {
+		t.Errorf("Filter allowed %v; want only the described rule", allowed)
+	}
+	if len(violations) != 1 {
+		t.Errorf("Filter returned %d violations; want 1", len(violations))
+	}
+	if g.Blocking() {
+		t.Errorf("Blocking() = true in skip mode")
+	}
+
+	if _, err := NewGuard(&conf.Guard{Mode: stringPtr("warn")}); err == nil {
+		t.Errorf("NewGuard should reject an unknown mode")
+	}
+	if _, err := NewGuard(&conf.Guard{AdminPorts: []string{"telnet"}}); err == nil {
+		t.Errorf("NewGuard should reject an unknown admin port")
+	}
+}
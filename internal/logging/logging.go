@@ -0,0 +1,142 @@
+package logging
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Keys of the fields shared by the components
+const (
+	KeyComponent     = "component"
+	KeySecurityGroup = "security_group_id"
+	// KeyRule is the cidr, protocol, port range and direction of a rule
+	KeyRule   = "rule"
+	KeySyncId = "sync_id"
+	KeyError  = "error"
+)
+
+// Setup makes the configured handler the default of log/slog; debug mode
+// lowers the level to debug
+func Setup(config *conf.GlobalConfiguration, w io.Writer) error {
+	level := slog.LevelInfo
+	if config.Log.Level != nil {
+		if err := level.UnmarshalText([]byte(*config.Log.Level)); err != nil {
+			return fmt.Errorf("invalid log level: %s", *config.Log.Level)
+		}
+	}
+	if config.Debug != nil && *config.Debug {
+		level = slog.LevelDebug
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	format := FormatText
+	if config.Log.Format != nil {
+		format = *config.Log.Format
+	}
+	switch format {
+	case FormatText:
+		slog.SetDefault(slog.New(slog.NewTextHandler(w, options)))
+	case FormatJSON:
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, options)))
+	default:
+		return fmt.Errorf("invalid log format: %s", format)
+	}
+	return nil
+}
+
+// Component returns the logger of a component. It logs through the
+// default handler at the time of each record, so package loggers can be
+// created before Setup runs.
+func Component(name string) *slog.Logger {
+	return slog.New(&defaultHandler{}).With(KeyComponent, name)
+}
+
+// defaultHandler hands records to the current default handler, with the
+// attributes and groups added to it
+type defaultHandler struct {
+	wrap []func(slog.Handler) slog.Handler
+}
+
+func (h *defaultHandler) handler() slog.Handler {
+	handler := slog.Default().Handler()
+	for _, wrap := range h.wrap {
+		handler = wrap(handler)
+	}
+	return handler
+}
+
+func (h *defaultHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return slog.Default().Handler().Enabled(ctx, level)
+}
+
+func (h *defaultHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler().Handle(ctx, record)
+}
+
+func (h *defaultHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *defaultHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+func (h *defaultHandler) with(wrap func(slog.Handler) slog.Handler) slog.Handler {
+	return &defaultHandler{wrap: append(append([]func(slog.Handler) slog.Handler{}, h.wrap...), wrap)}
+}
+
+// sensitiveKeys are parts of the keys whose values Redact hides
+var sensitiveKeys = []string{"secret", "token", "password", "signature", "accesskey", "access_key"}
+
+// Redact returns v as logged in debug mode: its JSON form, with the
+// values of credential keys at any depth replaced
+func Redact(v any) any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%+v", v)
+	}
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return string(data)
+	}
+	return redactValue(value)
+}
+
+func redactValue(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, v := range value {
+			if isSensitive(key) && v != nil {
+				value[key] = "REDACTED"
+			} else {
+				value[key] = redactValue(v)
+			}
+		}
+	case []any:
+		for i, v := range value {
+			value[i] = redactValue(v)
+		}
+	}
+	return value
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func stringPtr(v string) *string { return &v }
+func boolPtr(v bool) *bool       { return &v }
+
+func TestSetup(t *testing.T) {
+	defaultLogger := slog.Default()
+	defer slog.SetDefault(defaultLogger)
+
+	// created before Setup, as package loggers are
+	logger := Component("test").With(KeySyncId, "sync")
+
+	var buf bytes.Buffer
+	config := conf.NewConfig()
+	config.Log.Level = stringPtr("warn")
+	config.Log.Format = stringPtr(FormatJSON)
+	if err := Setup(config, &buf); err != nil {
+		t.Fatalf("Setup returned error: %v", err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", KeyRule, "10.0.0.0/8|TCP|22/22|ingress")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("invalid json log %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "shown" || record[KeyComponent] != "test" || record[KeySyncId] != "sync" || record[KeyRule] == nil {
+		t.Errorf("logged %v; want the warning with the component, sync and rule", record)
+	}
+
+	// debug mode overrides the level
+	buf.Reset()
+	config.Debug = boolPtr(true)
+	config.Log.Format = stringPtr(FormatText)
+	if err := Setup(config, &buf); err != nil {
+		t.Fatalf("Setup returned error: %v", err)
+	}
+	logger.Debug("details")
+	if !strings.Contains(buf.String(), "msg=details component=test") {
+		t.Errorf("logged %q; want the debug record in text", buf.String())
+	}
+
+	config.Log.Format = stringPtr("xml")
+	if err := Setup(config, &buf); err == nil {
+		t.Errorf("Setup should reject an unknown format")
+	}
+	config.Log.Format, config.Log.Level = nil, stringPtr("verbose")
+	if err := Setup(config, &buf); err == nil {
+		t.Errorf("Setup should reject an unknown level")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	config := conf.NewConfig()
+	config.Credential.AccessKeyId = stringPtr("LTAI-id")
+	config.Credential.AccessKeySecret = stringPtr("secret")
+	config.SecurityGroup.Id = stringPtr("sg-1")
+
+	data, err := json.Marshal(Redact(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "LTAI-id") || strings.Contains(string(data), `"secret"`) {
+		t.Errorf("Redact left credentials in %s", data)
+	}
+	if !strings.Contains(string(data), "sg-1") {
+		t.Errorf("Redact removed the security group from %s", data)
+	}
+
+	request := map[string]any{"Query": map[string]any{"Signature": "abc", "SecurityToken": "tok", "RegionId": "cn-hangzhou"}}
+	data, _ = json.Marshal(Redact(request))
+	if strings.Contains(string(data), "abc") || strings.Contains(string(data), "tok") || !strings.Contains(string(data), "cn-hangzhou") {
+		t.Errorf("Redact(%v) = %s", request, data)
+	}
+}
@@ -0,0 +1,61 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Mailer emails events through an SMTP server, using STARTTLS when the
+// server offers it
+type Mailer struct {
+	Addr string
+	From string
+	To   []string
+
+	auth smtp.Auth
+}
+
+// NewMailer returns a mailer of the SMTP server at addr, authenticating
+// with PLAIN when a username is given
+func NewMailer(addr string, username string, password string, from string, to []string) (*Mailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid smtp address %s: %w", addr, err)
+	}
+	if from == "" || len(to) == 0 {
+		return nil, fmt.Errorf("smtp needs a sender and recipients")
+	}
+	m := &Mailer{Addr: addr, From: from}
+	for _, recipient := range to {
+		m.To = append(m.To, strings.TrimSpace(recipient))
+	}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m, nil
+}
+
+// Redacted names the mailer in logs and errors
+func (m *Mailer) Redacted() string {
+	return "smtp:" + m.Addr
+}
+
+// Post emails an event, its title as the subject
+func (m *Mailer) Post(event Event, title string, text string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", title))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+	msg.WriteString("\r\n")
+	return smtp.SendMail(m.Addr, m.auth, m.From, m.To, msg.Bytes())
+}
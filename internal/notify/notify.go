@@ -0,0 +1,228 @@
+package notify
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/logging"
+
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Kinds of events notified
+const (
+	EventSyncFailed = "sync_failed"
+	EventDrift      = "drift"
+	EventGuardrail  = "guardrail_violation"
+	EventExpiring   = "expiring"
+	// EventAccessRequest is an access request waiting for an approver
+	EventAccessRequest = "access_request"
+)
+
+var eventKinds = []string{EventSyncFailed, EventDrift, EventGuardrail, EventExpiring, EventAccessRequest}
+
+// queueSize is the number of events waiting to be delivered; more are
+// dropped, so that a slow webhook never holds up a sync
+const queueSize = 64
+
+var logger = logging.Component("notify")
+
+// Event is something the worker notifies about
+type Event struct {
+	Kind            string    `json:"kind"`
+	Time            time.Time `json:"time"`
+	SecurityGroupId string    `json:"security_group_id"`
+	SyncId          string    `json:"sync_id,omitempty"`
+	// Summary is one line on what happened
+	Summary string `json:"summary"`
+	// Items are the rules concerned, one line each
+	Items []string `json:"items,omitempty"`
+}
+
+// defaultTemplates renders an event when the templates file does not
+// define a template named after its kind, or "default"
+const defaultTemplates = `{{define "title"}}[sgmgr] {{.SecurityGroupId}}: {{.Summary}}{{end}}` +
+	`{{define "default"}}{{.Summary}}{{range .Items}}
+- {{.}}{{end}}{{end}}`
+
+// channel delivers rendered events, a webhook or the mailer
+type channel interface {
+	Post(event Event, title string, text string) error
+	Redacted() string
+}
+
+// Notifier posts events to webhooks and emails them
+type Notifier struct {
+	channels  []channel
+	events    map[string]bool
+	templates *template.Template
+	retries   int
+	backoff   time.Duration
+
+	queue chan Event
+}
+
+func NewNotifier(config *conf.Notify) (*Notifier, error) {
+	n := &Notifier{
+		events:  make(map[string]bool),
+		retries: 3,
+		backoff: time.Second,
+		queue:   make(chan Event, queueSize),
+	}
+	if config.Retries != nil {
+		n.retries = *config.Retries
+	}
+	timeout := 10 * time.Second
+	if config.Timeout != nil {
+		timeout = *config.Timeout
+	}
+
+	for _, spec := range config.Webhooks {
+		webhook, err := ParseWebhook(strings.TrimSpace(spec), timeout)
+		if err != nil {
+			return nil, err
+		}
+		n.channels = append(n.channels, webhook)
+	}
+	if config.SmtpAddr != nil && *config.SmtpAddr != "" {
+		mailer, err := NewMailer(*config.SmtpAddr, value(config.SmtpUsername), value(config.SmtpPassword), value(config.SmtpFrom), config.SmtpTo)
+		if err != nil {
+			return nil, err
+		}
+		n.channels = append(n.channels, mailer)
+	}
+
+	events := config.Events
+	if len(events) == 0 {
+		events = eventKinds
+	}
+	for _, kind := range events {
+		kind = strings.TrimSpace(kind)
+		if !isEventKind(kind) {
+			return nil, fmt.Errorf("unknown notification event: %s, expected one of %s", kind, strings.Join(eventKinds, ", "))
+		}
+		n.events[kind] = true
+	}
+
+	templates := template.Must(template.New("notify").Parse(defaultTemplates))
+	if config.Templates != nil && *config.Templates != "" {
+		data, err := os.ReadFile(*config.Templates)
+		if err != nil {
+			return nil, err
+		}
+		if templates, err = templates.Parse(string(data)); err != nil {
+			return nil, fmt.Errorf("invalid notification templates %s: %w", *config.Templates, err)
+		}
+	}
+	n.templates = templates
+	return n, nil
+}
+
+func value(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func isEventKind(kind string) bool {
+	for _, eventKind := range eventKinds {
+		if kind == eventKind {
+			return true
+		}
+	}
+	return false
+}
+
+// Enabled reports whether events of a kind are notified
+func (n *Notifier) Enabled(kind string) bool {
+	return n != nil && n.events[kind]
+}
+
+// Send queues an event for Run to deliver, if its kind is notified
+func (n *Notifier) Send(event Event) {
+	if !n.Enabled(event.Kind) {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	select {
+	case n.queue <- event:
+	default:
+		logger.Error("notification queue is full, dropping event", "kind", event.Kind, logging.KeySyncId, event.SyncId)
+	}
+}
+
+// SendNow delivers an event at once, if its kind is notified, for callers
+// not running Run such as the CLI
+func (n *Notifier) SendNow(event Event) {
+	if !n.Enabled(event.Kind) {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	n.deliver(event)
+}
+
+// Run delivers the events queued by Send
+func (n *Notifier) Run() {
+	for event := range n.queue {
+		n.deliver(event)
+	}
+}
+
+func (n *Notifier) deliver(event Event) {
+	if err := n.Notify(event); err != nil {
+		logger.Error("failed to deliver notification", "kind", event.Kind, logging.KeySyncId, event.SyncId, logging.KeyError, err)
+	}
+}
+
+// Notify renders an event and posts it to every webhook and the mailer,
+// retrying failed posts with a doubling delay
+func (n *Notifier) Notify(event Event) error {
+	title, text, err := n.render(event)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, channel := range n.channels {
+		backoff := n.backoff
+		for attempt := 0; ; attempt++ {
+			err = channel.Post(event, title, text)
+			if err == nil || attempt >= n.retries {
+				break
+			}
+			logger.Warn("notification failed, retrying", "channel", channel.Redacted(), "attempt", attempt+1, logging.KeyError, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", channel.Redacted(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// render returns the title and the text of an event, from the template
+// named after its kind or the default one
+func (n *Notifier) render(event Event) (string, string, error) {
+	name := event.Kind
+	if n.templates.Lookup(name) == nil {
+		name = "default"
+	}
+	var title, text bytes.Buffer
+	if err := n.templates.ExecuteTemplate(&title, "title", event); err != nil {
+		return "", "", err
+	}
+	if err := n.templates.ExecuteTemplate(&text, name, event); err != nil {
+		return "", "", err
+	}
+	return title.String(), text.String(), nil
+}
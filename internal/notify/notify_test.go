@@ -0,0 +1,234 @@
+package notify
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func intPtr(v int) *int          { return &v }
+func stringPtr(v string) *string { return &v }
+
+// receiver records the bodies posted to it, failing the first posts
+type receiver struct {
+	bodies   []map[string]any
+	failures int
+	// answer is the body of successful posts
+	answer string
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.failures > 0 {
+		r.failures--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	data, _ := io.ReadAll(req.Body)
+	var body map[string]any
+	json.Unmarshal(data, &body)
+	r.bodies = append(r.bodies, body)
+	io.WriteString(w, r.answer)
+}
+
+func TestNotify(t *testing.T) {
+	generic := &receiver{failures: 2}
+	dingtalk := &receiver{answer: `{"errcode":0,"errmsg":"ok"}`}
+	feishu := &receiver{answer: `{"code":0}`}
+	slack := &receiver{answer: "ok"}
+	var urls []string
+	for _, r := range []*receiver{generic, dingtalk, feishu, slack} {
+		server := httptest.NewServer(r)
+		defer server.Close()
+		urls = append(urls, server.URL)
+	}
+
+	n, err := NewNotifier(&conf.Notify{
+		Webhooks: []string{urls[0] + "/hook?token=secret", "dingtalk:" + urls[1], "feishu:" + urls[2], "slack:" + urls[3]},
+		Retries:  intPtr(2),
+	})
+	if err != nil {
+		t.Fatalf("NewNotifier returned error: %v", err)
+	}
+	n.backoff = time.Millisecond
+
+	event := Event{
+		Kind:            EventExpiring,
+		SecurityGroupId: "sg-1",
+		Summary:         "1 rules expire within 24h0m0s",
+		Items:           []string{"accept ingress tcp 22/22 (ssh) from 10.0.0.0/8 priority 1 until 2026-01-01T00:00:00Z"},
+	}
+	if err := n.Notify(event); err != nil {
+		t.Fatalf("Notify returned error: %v", err)
+	}
+
+	if len(generic.bodies) != 1 || generic.bodies[0]["kind"] != EventExpiring || generic.bodies[0]["security_group_id"] != "sg-1" {
+		t.Errorf("generic webhook got %v after 2 retries; want the event", generic.bodies)
+	}
+	wantText := "1 rules expire within 24h0m0s\n- accept ingress tcp 22/22"
+	if len(generic.bodies) == 1 && !strings.HasPrefix(generic.bodies[0]["text"].(string), wantText) {
+		t.Errorf("generic text = %q; want %q", generic.bodies[0]["text"], wantText)
+	}
+	if len(dingtalk.bodies) != 1 || dingtalk.bodies[0]["msgtype"] != "markdown" {
+		t.Errorf("dingtalk webhook got %v; want a markdown message", dingtalk.bodies)
+	}
+	if len(feishu.bodies) != 1 || feishu.bodies[0]["msg_type"] != "text" {
+		t.Errorf("feishu webhook got %v; want a text message", feishu.bodies)
+	}
+	if len(slack.bodies) != 1 || !strings.Contains(slack.bodies[0]["text"].(string), "[sgmgr] sg-1") {
+		t.Errorf("slack webhook got %v; want the title in the text", slack.bodies)
+	}
+
+	// failures answered with 200 and an error code are retried, then reported
+	dingtalk.answer = `{"errcode":310000,"errmsg":"keywords not in content"}`
+	err = n.Notify(event)
+	if err == nil || !strings.Contains(err.Error(), "errcode 310000") {
+		t.Errorf("Notify = %v; want the dingtalk error", err)
+	}
+	if len(dingtalk.bodies) != 4 {
+		t.Errorf("dingtalk webhook got %d posts; want 1 and 3 attempts", len(dingtalk.bodies))
+	}
+
+	// urls are logged and reported without their query
+	generic.failures = 3
+	err = n.Notify(event)
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("Notify = %v; want an error without the token", err)
+	}
+}
+
+func TestNotifierTemplates(t *testing.T) {
+	received := &receiver{}
+	server := httptest.NewServer(received)
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "templates.tmpl")
+	templates := `{{define "title"}}安全组 {{.SecurityGroupId}}{{end}}` +
+		`{{define "sync_failed"}}同步 {{.SyncId}} 失败：{{.Summary}}{{end}}`
+	if err := os.WriteFile(path, []byte(templates), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewNotifier(&conf.Notify{
+		Webhooks:  []string{"slack:" + server.URL},
+		Events:    []string{EventSyncFailed},
+		Templates: stringPtr(path),
+	})
+	if err != nil {
+		t.Fatalf("NewNotifier returned error: %v", err)
+	}
+
+	if n.Enabled(EventDrift) || !n.Enabled(EventSyncFailed) {
+		t.Errorf("Enabled does not follow the configured events")
+	}
+	if err := n.Notify(Event{Kind: EventSyncFailed, SecurityGroupId: "sg-1", SyncId: "s1", Summary: "sync failed: timeout"}); err != nil {
+		t.Fatalf("Notify returned error: %v", err)
+	}
+	if len(received.bodies) != 1 || received.bodies[0]["text"] != "*安全组 sg-1*\n同步 s1 失败：sync failed: timeout" {
+		t.Errorf("webhook got %v; want the templated message", received.bodies)
+	}
+
+	for _, config := range []*conf.Notify{
+		{Webhooks: []string{"ftp://example.com"}},
+		{Webhooks: []string{"dingtalk:"}},
+		{Webhooks: []string{server.URL}, Events: []string{"sync"}},
+	} {
+		if _, err := NewNotifier(config); err == nil {
+			t.Errorf("NewNotifier(%+v) should fail", config)
+		}
+	}
+}
+
+// smtpServer accepts one connection and records the message sent
+func smtpServer(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			switch verb, _, _ := strings.Cut(line, " "); strings.ToUpper(verb) {
+			case "EHLO", "HELO":
+				text.PrintfLine("250 localhost")
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				data, _ := text.ReadDotBytes()
+				messages <- string(data)
+				text.PrintfLine("250 ok")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("250 ok")
+			}
+		}
+	}()
+	return listener.Addr().String(), messages
+}
+
+func TestNotifierMail(t *testing.T) {
+	addr, messages := smtpServer(t)
+	n, err := NewNotifier(&conf.Notify{
+		SmtpAddr: stringPtr(addr),
+		SmtpFrom: stringPtr("sgmgr@example.com"),
+		SmtpTo:   []string{"ops@example.com", " dev@example.com"},
+	})
+	if err != nil {
+		t.Fatalf("NewNotifier returned error: %v", err)
+	}
+	if err := n.Notify(Event{Kind: EventExpiring, SecurityGroupId: "sg-1", Summary: "1 rules expire within 1h0m0s", Items: []string{"rule"}}); err != nil {
+		t.Fatalf("Notify returned error: %v", err)
+	}
+
+	message := <-messages
+	for _, want := range []string{"To: ops@example.com, dev@example.com\n", "Subject: [sgmgr] sg-1: 1 rules expire within 1h0m0s\n", "\n1 rules expire within 1h0m0s\n- rule\n"} {
+		if !strings.Contains(message, want) {
+			t.Errorf("message %q does not contain %q", message, want)
+		}
+	}
+
+	if _, err := NewNotifier(&conf.Notify{SmtpAddr: stringPtr(addr)}); err == nil {
+		t.Errorf("NewNotifier without sender and recipients should fail")
+	}
+}
+
+func TestRedactWebhooks(t *testing.T) {
+	specs := []string{
+		"dingtalk:https://oapi.dingtalk.com/robot/send?access_token=secret",
+		"slack:https://hooks.slack.com/services/T000/B000/secret",
+		" https://example.com",
+		"feishu:not a url",
+	}
+	want := []string{
+		"dingtalk:https://oapi.dingtalk.com/REDACTED",
+		"slack:https://hooks.slack.com/REDACTED",
+		"generic:https://example.com",
+		"feishu:REDACTED",
+	}
+	got := RedactWebhooks(specs)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("RedactWebhooks() = %q; want %q", got, want)
+	}
+}
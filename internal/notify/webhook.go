@@ -0,0 +1,144 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Payload formats of webhooks
+const (
+	FormatGeneric  = "generic"
+	FormatDingTalk = "dingtalk"
+	FormatFeishu   = "feishu"
+	FormatSlack    = "slack"
+)
+
+// Webhook is a url events are posted to, in the payload format it expects
+type Webhook struct {
+	Format string
+	URL    string
+
+	client *http.Client
+}
+
+// ParseWebhook parses a webhook url optionally prefixed with its format,
+// e.g. "dingtalk:https://oapi.dingtalk.com/robot/send?access_token=...";
+// a url without a prefix gets generic JSON
+func ParseWebhook(spec string, timeout time.Duration) (*Webhook, error) {
+	webhook := splitWebhook(spec)
+	webhook.client = &http.Client{Timeout: timeout}
+
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook url: %s", webhook.Redacted())
+	}
+	return webhook, nil
+}
+
+// RedactWebhooks returns webhook specs as logged, for the configuration
+// logged at startup
+func RedactWebhooks(specs []string) []string {
+	redacted := make([]string, len(specs))
+	for i, spec := range specs {
+		redacted[i] = splitWebhook(strings.TrimSpace(spec)).Redacted()
+	}
+	return redacted
+}
+
+// splitWebhook splits the format prefix of a webhook spec from its url
+func splitWebhook(spec string) *Webhook {
+	webhook := &Webhook{Format: FormatGeneric, URL: spec}
+	if format, rest, found := strings.Cut(spec, ":"); found {
+		switch format {
+		case FormatGeneric, FormatDingTalk, FormatFeishu, FormatSlack:
+			webhook.Format, webhook.URL = format, rest
+		}
+	}
+	return webhook
+}
+
+// Redacted returns the url up to its host: the query holds the token of
+// DingTalk robots, the path that of Slack and Feishu webhooks
+func (w *Webhook) Redacted() string {
+	u, err := url.Parse(w.URL)
+	if err != nil || u.Host == "" {
+		return w.Format + ":REDACTED"
+	}
+	redacted := u.Scheme + "://" + u.Host
+	if u.Path != "" || u.RawQuery != "" {
+		redacted += "/REDACTED"
+	}
+	return w.Format + ":" + redacted
+}
+
+// payload returns the body of a post in the format of the webhook
+func (w *Webhook) payload(event Event, title string, text string) ([]byte, error) {
+	switch w.Format {
+	case FormatDingTalk:
+		return json.Marshal(map[string]any{
+			"msgtype":  "markdown",
+			"markdown": map[string]string{"title": title, "text": "### " + title + "\n\n" + text},
+		})
+	case FormatFeishu:
+		return json.Marshal(map[string]any{
+			"msg_type": "text",
+			"content":  map[string]string{"text": title + "\n" + text},
+		})
+	case FormatSlack:
+		return json.Marshal(map[string]string{"text": "*" + title + "*\n" + text})
+	default:
+		return json.Marshal(struct {
+			Event
+			Title string `json:"title"`
+			Text  string `json:"text"`
+		}{event, title, text})
+	}
+}
+
+// Post sends an event. DingTalk and Feishu answer failures with 200 and an
+// error code in the body, which is checked too.
+func (w *Webhook) Post(event Event, title string, text string) error {
+	body, err := w.payload(event, title, text)
+	if err != nil {
+		return err
+	}
+	response, err := w.client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// the error quotes the url, query included
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("post failed: %w", err)
+	}
+	defer response.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("status %d: %s", response.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	var result struct {
+		ErrCode *int   `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+		Code    *int   `json:"code"`
+		Msg     string `json:"msg"`
+	}
+	switch w.Format {
+	case FormatDingTalk:
+		if json.Unmarshal(data, &result) == nil && result.ErrCode != nil && *result.ErrCode != 0 {
+			return fmt.Errorf("errcode %d: %s", *result.ErrCode, result.ErrMsg)
+		}
+	case FormatFeishu:
+		if json.Unmarshal(data, &result) == nil && result.Code != nil && *result.Code != 0 {
+			return fmt.Errorf("code %d: %s", *result.Code, result.Msg)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package oidc
+
+import (
+	"aliyun-security-group-mgr/internal/logging"
+
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = logging.Component("oidc")
+
+const (
+	// minRefetch is how soon keys are fetched again for an unknown key id
+	minRefetch = time.Minute
+	// maxJwksSize is the largest key set read
+	maxJwksSize = 1 << 20
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// jwk is a key of a key set, as in RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJwks returns the signing keys of a key set by key id. Keys of other
+// types or uses are skipped.
+func ParseJwks(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid jwks: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		var publicKey crypto.PublicKey
+		var err error
+		switch key.Kty {
+		case "RSA":
+			publicKey, err = parseRsaKey(key)
+		case "EC":
+			publicKey, err = parseEcKey(key)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk %q: %w", key.Kid, err)
+		}
+		keys[key.Kid] = publicKey
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys in jwks")
+	}
+	return keys, nil
+}
+
+func parseRsaKey(key jwk) (*rsa.PublicKey, error) {
+	n, err := decodeInt(key.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeInt(key.E)
+	if err != nil {
+		return nil, err
+	}
+	if n.BitLen() < 2048 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, errors.New("unsupported rsa key")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func parseEcKey(key jwk) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch key.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve: %s", key.Crv)
+	}
+	x, err := decodeInt(key.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeInt(key.Y)
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("point not on curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid base64url integer")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// KeySet is the key set of an identity provider, read from a file or
+// fetched from an http(s) URL, and read again every refresh interval or
+// when a token is signed by a key not known yet, so that rotated keys are
+// picked up
+type KeySet struct {
+	Source  string
+	Refresh time.Duration
+	Client  *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func NewKeySet(source string, refresh time.Duration) *KeySet {
+	return &KeySet{Source: source, Refresh: refresh, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Key returns the key of an id; an empty id picks the only key of the set
+func (k *KeySet) Key(kid string) (crypto.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	stale := k.keys == nil || (k.Refresh > 0 && time.Since(k.fetchedAt) > k.Refresh)
+	if _, known := k.lookup(kid); !known && time.Since(k.fetchedAt) > minRefetch {
+		stale = true
+	}
+	if stale {
+		if err := k.load(); err != nil {
+			if k.keys == nil {
+				return nil, err
+			}
+			// keep the keys known until the source is back
+			logger.Error("failed to refresh the jwks", "source", k.Source, logging.KeyError, err)
+		}
+	}
+	if key, ok := k.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+}
+
+func (k *KeySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+func (k *KeySet) load() error {
+	k.fetchedAt = time.Now()
+	data, err := k.read()
+	if err != nil {
+		return err
+	}
+	keys, err := ParseJwks(data)
+	if err != nil {
+		return err
+	}
+	k.keys = keys
+	return nil
+}
+
+func (k *KeySet) read() ([]byte, error) {
+	if !strings.HasPrefix(k.Source, "https://") && !strings.HasPrefix(k.Source, "http://") {
+		return os.ReadFile(k.Source)
+	}
+	response, err := k.Client.Get(k.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", k.Source, response.Status)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, maxJwksSize))
+}
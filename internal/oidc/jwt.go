@@ -0,0 +1,198 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var ErrInvalidToken = errors.New("invalid jwt")
+
+// algorithms are the signing algorithms accepted, by their JWA name
+var algorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// Claims are the claims of a verified JWT
+type Claims map[string]any
+
+// String returns a claim holding a string, or ""
+func (c Claims) String(name string) string {
+	value, _ := c[name].(string)
+	return value
+}
+
+// Values returns the values of a claim holding a string or a list of
+// strings; other values are skipped
+func (c Claims) Values(name string) []string {
+	switch value := c[name].(type) {
+	case string:
+		return []string{value}
+	case []any:
+		var values []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Verifier verifies the JWTs issued for the worker: signed by a key of the
+// key set, by the issuer, for the audience and not expired
+type Verifier struct {
+	Keys     *KeySet
+	Issuer   string
+	Audience string
+	// Leeway allowed for the clocks of the issuer and the worker
+	Leeway time.Duration
+}
+
+// Verify returns the claims of a valid token
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodePart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+	hash, ok := algorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, header.Alg)
+	}
+	key, err := v.Keys.Key(header.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrInvalidToken, err)
+	}
+	if err := verifySignature(header.Alg, hash, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	var claims Claims
+	if err := decodePart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrInvalidToken, err)
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return claims, nil
+}
+
+func decodePart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature checks the signature of an algorithm with a key of the
+// matching type; ECDSA signatures are r and s of the size of the curve
+func verifySignature(alg string, hash crypto.Hash, key crypto.PublicKey, signed []byte, signature []byte) error {
+	digester := hash.New()
+	digester.Write(signed)
+	digest := digester.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		}
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || curveHash(key) != hash || len(signature) != 2*size {
+			break
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("key does not match algorithm %s", alg)
+}
+
+// curveHash returns the hash ES algorithms use with the curve of a key
+func curveHash(key *ecdsa.PublicKey) crypto.Hash {
+	switch key.Curve.Params().BitSize {
+	case 256:
+		return crypto.SHA256
+	case 384:
+		return crypto.SHA384
+	default:
+		return crypto.SHA512
+	}
+}
+
+// checkClaims checks the issuer, the audience and the validity period of
+// a token; it must expire
+func (v *Verifier) checkClaims(claims Claims) error {
+	if v.Issuer != "" && claims.String("iss") != v.Issuer {
+		return fmt.Errorf("issuer %q", claims.String("iss"))
+	}
+	if v.Audience != "" && !contains(claims.Values("aud"), v.Audience) {
+		return fmt.Errorf("audience %q", claims.Values("aud"))
+	}
+	now := time.Now()
+	exp, ok := claims.time("exp")
+	if !ok {
+		return errors.New("no expiry")
+	}
+	if now.After(exp.Add(v.Leeway)) {
+		return errors.New("expired")
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(v.Leeway).Before(nbf) {
+		return errors.New("not valid yet")
+	}
+	return nil
+}
+
+// time returns a claim holding a NumericDate
+func (c Claims) time(name string) (time.Time, bool) {
+	value, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(value), 0), true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
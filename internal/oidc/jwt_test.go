@@ -0,0 +1,190 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signToken signs claims as a JWT with a key of the algorithm
+func signToken(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := algorithms[alg]
+	digester := hash.New()
+	digester.Write([]byte(signed))
+	digest := digester.Sum(nil)
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "PS") {
+			signature, err = rsa.SignPSS(rand.Reader, key, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest)
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// writeJwks publishes the public keys as a key set
+func writeJwks(t *testing.T, path string, keys map[string]crypto.Signer) {
+	t.Helper()
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for kid, key := range keys {
+		switch public := key.Public().(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, map[string]string{"kty": "RSA", "kid": kid, "use": "sig",
+				"n": encode(public.N.Bytes()), "e": encode(big.NewInt(int64(public.E)).Bytes())})
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			set.Keys = append(set.Keys, map[string]string{"kty": "EC", "kid": kid, "crv": public.Curve.Params().Name,
+				"x": encode(public.X.FillBytes(make([]byte, size))), "y": encode(public.Y.FillBytes(make([]byte, size)))})
+		}
+	}
+	data, _ := json.Marshal(set)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJwks(t, path, map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey})
+	verifier := &Verifier{Keys: NewKeySet(path, time.Hour), Issuer: "https://sso.example.com", Audience: "sgmgr", Leeway: time.Minute}
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{"iss": "https://sso.example.com", "aud": []string{"other", "sgmgr"}, "sub": "1", "email": "alice@example.com",
+			"groups": []string{"eng"}, "iat": now, "exp": now + 3600}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	valid := signToken(t, "RS256", "rsa", rsaKey, claims(nil))
+	header, _, _ := strings.Cut(valid, ".")
+	tampered := header + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"https://sso.example.com","aud":"sgmgr","exp":9999999999,"email":"mallory@example.com"}`)) +
+		valid[strings.LastIndex(valid, "."):]
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"exp":9999999999}`)) + "."
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"RS256", valid, true},
+		{"PS256", signToken(t, "PS256", "rsa", rsaKey, claims(nil)), true},
+		{"ES256", signToken(t, "ES256", "ec", ecKey, claims(map[string]any{"aud": "sgmgr"})), true},
+		{"expired within leeway", signToken(t, "RS256", "rsa", rsaKey, claims(map[string]any{"exp": now - 30})), true},
+		{"expired", signToken(t, "RS256", "rsa", rsaKey, claims(map[string]any{"exp": now - 3600})), false},
+		{"no expiry", signToken(t, "RS256", "rsa", rsaKey, claims(map[string]any{"exp": nil})), false},
+		{"not valid yet", signToken(t, "RS256", "rsa", rsaKey, claims(map[string]any{"nbf": now + 3600})), false},
+		{"other issuer", signToken(t, "RS256", "rsa", rsaKey, claims(map[string]any{"iss": "https://evil.example.com"})), false},
+		{"other audience", signToken(t, "RS256", "rsa", rsaKey, claims(map[string]any{"aud": "other"})), false},
+		{"unknown key", signToken(t, "ES256", "other", otherKey, claims(nil)), false},
+		{"wrong key", signToken(t, "ES256", "ec", otherKey, claims(nil)), false},
+		{"key of another type", signToken(t, "ES256", "rsa", ecKey, claims(nil)), false},
+		{"tampered", tampered, false},
+		{"alg none", none, false},
+		{"malformed", "not.a-jwt", false},
+	} {
+		_, err := verifier.Verify(tc.token)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: Verify = %v; want valid %v", tc.name, err, tc.valid)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: Verify = %v; want ErrInvalidToken", tc.name, err)
+		}
+	}
+
+	verified, err := verifier.Verify(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.String("email") != "alice@example.com" || len(verified.Values("groups")) != 1 || verified.Values("groups")[0] != "eng" {
+		t.Errorf("claims = %v; want the email and groups signed", verified)
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJwks(t, path, map[string]crypto.Signer{"old": oldKey})
+
+	served := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+		data, _ := os.ReadFile(path)
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	keys := NewKeySet(server.URL, time.Hour)
+	if _, err := keys.Key("old"); err != nil {
+		t.Fatalf("Key(old) returned error: %v", err)
+	}
+	writeJwks(t, path, map[string]crypto.Signer{"old": oldKey, "new": newKey})
+
+	// unknown keys are not fetched again right away
+	if _, err := keys.Key("new"); !errors.Is(err, ErrUnknownKey) || served != 1 {
+		t.Errorf("Key(new) right after a fetch = %v, %d fetches; want ErrUnknownKey and 1 fetch", err, served)
+	}
+	keys.fetchedAt = time.Now().Add(-2 * minRefetch)
+	if _, err := keys.Key("new"); err != nil || served != 2 {
+		t.Errorf("Key(new) = %v, %d fetches; want the rotated key after 2 fetches", err, served)
+	}
+
+	// the keys known are kept while the source fails
+	os.Remove(path)
+	keys.fetchedAt = time.Now().Add(-2 * time.Hour)
+	if _, err := keys.Key("old"); err != nil {
+		t.Errorf("Key(old) with the source failing = %v; want the key known", err)
+	}
+}
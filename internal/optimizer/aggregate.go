@@ -0,0 +1,183 @@
+package optimizer
+
+import (
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxDescriptionLength is Aliyun's limit on rule descriptions, in characters
+const maxDescriptionLength = 512
+
+// Mapping is an emitted rule and the entries it was aggregated from
+type Mapping struct {
+	Entry   reloader.Entry
+	Sources []reloader.Entry
+}
+
+// Aggregated reports whether the emitted rule differs from its source
+func (m Mapping) Aggregated() bool {
+	return len(m.Sources) > 1 || m.Entry.SecurityGroup.CidrIp != m.Sources[0].SecurityGroup.CidrIp
+}
+
+func (m Mapping) String() string {
+	sources := make([]string, len(m.Sources))
+	for i, source := range m.Sources {
+		sources[i] = source.Source.String()
+		if sources[i] == "" {
+			sources[i] = source.SecurityGroup.CidrIp
+		} else {
+			sources[i] += " " + source.SecurityGroup.CidrIp
+		}
+	}
+	return fmt.Sprintf("%s -> %s", strings.Join(sources, ", "), reloader.EncodeEntry(m.Entry))
+}
+
+// Aggregate merges the cidrs of entries sharing policy, direction,
+// protocol, port range, priority, expiry and owner into the fewest prefixes
+// covering exactly the same addresses: contained cidrs are dropped and
+// adjacent ones are joined into their supernet. Entries marked with
+// NoAggregate, or whose cidr does not parse, are kept as they are.
+//
+// The emitted entries keep the order of the first entry of each group.
+// An emitted entry built from several entries has no source, and the
+// distinct descriptions of its sources joined.
+func Aggregate(entries []reloader.Entry) []Mapping {
+	type group struct {
+		entries  []reloader.Entry
+		prefixes []netip.Prefix
+	}
+
+	var mappings []Mapping
+	var keys []string
+	groups := make(map[string]*group)
+	// position of each group among the emitted entries
+	positions := make(map[string]int)
+
+	for _, entry := range entries {
+		prefix, err := netip.ParsePrefix(entry.SecurityGroup.CidrIp)
+		if entry.NoAggregate || err != nil {
+			mappings = append(mappings, Mapping{Entry: entry, Sources: []reloader.Entry{entry}})
+			continue
+		}
+
+		rule := entry.SecurityGroup
+		key := fmt.Sprintf("%s|%s|%s|%s|%s|%d|%q|%t",
+			rule.Policy, rule.Direction, rule.IpProtocol, rule.PortRange, rule.Priority,
+			entry.ExpireAt.UnixNano(), entry.Owner, prefix.Addr().Is4())
+		g, ok := groups[key]
+		if !ok {
+			g = &group{}
+			groups[key] = g
+			keys = append(keys, key)
+			positions[key] = len(mappings)
+			// placeholder, replaced by the group's mappings below
+			mappings = append(mappings, Mapping{})
+		}
+		g.entries = append(g.entries, entry)
+		g.prefixes = append(g.prefixes, prefix.Masked())
+	}
+
+	// replace the placeholders from the last, keeping positions valid
+	for k := len(keys) - 1; k >= 0; k-- {
+		g := groups[keys[k]]
+		var merged []Mapping
+		for _, prefix := range mergePrefixes(g.prefixes) {
+			merged = append(merged, newMapping(prefix, g.entries, g.prefixes))
+		}
+		at := positions[keys[k]]
+		mappings = append(mappings[:at], append(merged, mappings[at+1:]...)...)
+	}
+	return mappings
+}
+
+// newMapping builds the entry emitted for prefix from the entries it covers
+func newMapping(prefix netip.Prefix, entries []reloader.Entry, prefixes []netip.Prefix) Mapping {
+	var sources []reloader.Entry
+	var descriptions []string
+	for i, entry := range entries {
+		if prefix.Bits() <= prefixes[i].Bits() && prefix.Contains(prefixes[i].Addr()) {
+			sources = append(sources, entry)
+			if description := entry.SecurityGroup.Description; description != "" && !contains(descriptions, description) {
+				descriptions = append(descriptions, description)
+			}
+		}
+	}
+
+	entry := sources[0]
+	entry.SecurityGroup.CidrIp = prefix.String()
+	if len(sources) > 1 {
+		entry.Source = reloader.Source{}
+		description := strings.Join(descriptions, ", ")
+		if utf8.RuneCountInString(description) > maxDescriptionLength {
+			description = string([]rune(description)[:maxDescriptionLength-3]) + "..."
+		}
+		entry.SecurityGroup.Description = description
+	}
+	return Mapping{Entry: entry, Sources: sources}
+}
+
+// mergePrefixes returns the fewest prefixes covering exactly the addresses
+// of the given prefixes of one address family
+func mergePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	merged := append([]netip.Prefix{}, prefixes...)
+	for {
+		sort.Slice(merged, func(i, j int) bool {
+			if c := merged[i].Addr().Compare(merged[j].Addr()); c != 0 {
+				return c < 0
+			}
+			return merged[i].Bits() < merged[j].Bits()
+		})
+
+		// drop prefixes contained in the one before them
+		kept := merged[:0]
+		for _, prefix := range merged {
+			if n := len(kept); n > 0 && kept[n-1].Bits() <= prefix.Bits() && kept[n-1].Contains(prefix.Addr()) {
+				continue
+			}
+			kept = append(kept, prefix)
+		}
+		merged = kept
+
+		// join sibling prefixes into their parent
+		changed := false
+		var joined []netip.Prefix
+		for i := 0; i < len(merged); i++ {
+			if i+1 < len(merged) && isSibling(merged[i], merged[i+1]) {
+				parent, _ := merged[i].Addr().Prefix(merged[i].Bits() - 1)
+				joined = append(joined, parent)
+				i++
+				changed = true
+				continue
+			}
+			joined = append(joined, merged[i])
+		}
+		merged = joined
+		if !changed {
+			return merged
+		}
+	}
+}
+
+// isSibling reports whether a and b are the two halves of one prefix
+func isSibling(a, b netip.Prefix) bool {
+	if a.Bits() != b.Bits() || a.Bits() == 0 || a == b {
+		return false
+	}
+	parentA, _ := a.Addr().Prefix(a.Bits() - 1)
+	parentB, _ := b.Addr().Prefix(b.Bits() - 1)
+	return parentA == parentB
+}
+
+func contains(list []string, item string) bool {
+	for _, existing := range list {
+		if existing == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package optimizer
+
+import (
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{
+			name: "adjacent",
+			lines: []string{
+				"accept ingress ssh from 10.0.0.0,10.0.0.1,10.0.0.2/31 until never # contractors",
+			},
+			want: []string{"accept ingress tcp 22/22 from 10.0.0.0/30 priority 1 until never # contractors"},
+		},
+		{
+			name: "contained",
+			lines: []string{
+				"accept ingress ssh from 10.0.0.0/24 until never # office",
+				"accept ingress ssh from 10.0.0.7 until never # alice",
+			},
+			want: []string{"accept ingress tcp 22/22 from 10.0.0.0/24 priority 1 until never # office, alice"},
+		},
+		{
+			name: "not adjacent",
+			lines: []string{
+				"accept ingress ssh from 10.0.0.1,10.0.0.2 until never",
+			},
+			want: []string{
+				"accept ingress tcp 22/22 from 10.0.0.1/32 priority 1 until never",
+				"accept ingress tcp 22/22 from 10.0.0.2/32 priority 1 until never",
+			},
+		},
+		{
+			name: "different ports, priorities and expiries are kept apart",
+			lines: []string{
+				"accept ingress ssh from 10.0.0.0 until never",
+				"accept ingress https from 10.0.0.1 until never",
+				"accept ingress ssh from 10.0.0.1 priority 2 until never",
+				"accept ingress ssh from 10.0.0.1 until 2030-01-01T00:00:00Z",
+			},
+			want: []string{
+				"accept ingress tcp 22/22 from 10.0.0.0/32 priority 1 until never",
+				"accept ingress tcp 443/443 from 10.0.0.1/32 priority 1 until never",
+				"accept ingress tcp 22/22 from 10.0.0.1/32 priority 2 until never",
+				"accept ingress tcp 22/22 from 10.0.0.1/32 priority 1 until 2030-01-01T00:00:00Z",
+			},
+		},
+		{
+			name: "different owners are kept apart",
+			lines: []string{
+				"accept ingress ssh from 10.0.0.0 until never owner alice",
+				"accept ingress ssh from 10.0.0.1 until never owner bob",
+			},
+			want: []string{
+				"accept ingress tcp 22/22 from 10.0.0.0/32 priority 1 until never owner alice",
+				"accept ingress tcp 22/22 from 10.0.0.1/32 priority 1 until never owner bob",
+			},
+		},
+		{
+			name: "opt out",
+			lines: []string{
+				"accept ingress ssh from 10.0.0.0 until never",
+				"accept ingress ssh from 10.0.0.1 until never aggregate no",
+			},
+			want: []string{
+				"accept ingress tcp 22/22 from 10.0.0.0/32 priority 1 until never",
+				"accept ingress tcp 22/22 from 10.0.0.1/32 priority 1 until never aggregate no",
+			},
+		},
+		{
+			name: "ipv6",
+			lines: []string{
+				"accept ingress ssh from 2001:db8::/33,2001:db8:8000::/33,0.0.0.0/1,128.0.0.0/1 until never",
+			},
+			want: []string{
+				"accept ingress tcp 22/22 from 2001:db8::/32 priority 1 until never",
+				"accept ingress tcp 22/22 from 0.0.0.0/0 priority 1 until never",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := reloader.NewParser()
+			var entries []reloader.Entry
+			for i, line := range tt.lines {
+				parsed, err := parser.ParseLine(line)
+				if err != nil {
+					t.Fatalf("ParseLine(%q) returned error: %v", line, err)
+				}
+				for _, entry := range parsed {
+					entry.Source = reloader.Source{File: "rules.conf", Line: i + 1}
+					entries = append(entries, entry)
+				}
+			}
+
+			var got []string
+			for _, mapping := range Aggregate(entries) {
+				got = append(got, reloader.EncodeEntry(mapping.Entry))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Aggregate() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestAggregateTruncatesDescriptions(t *testing.T) {
+	var entries []reloader.Entry
+	for _, cidrIp := range []string{"10.0.0.0", "10.0.0.1"} {
+		entry, err := reloader.DecodeEntry("accept ingress ssh from " + cidrIp + " until never # " + strings.Repeat("办公室"+cidrIp, 40))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, *entry)
+	}
+
+	mappings := Aggregate(entries)
+	if len(mappings) != 1 {
+		t.Fatalf("Aggregate() returned %d rules; want 1", len(mappings))
+	}
+	description := mappings[0].Entry.SecurityGroup.Description
+	if !utf8.ValidString(description) || !strings.HasSuffix(description, "...") {
+		t.Errorf("truncated description is not valid UTF-8 ending with ...: %q", description)
+	}
+	if n := utf8.RuneCountInString(description); n != maxDescriptionLength {
+		t.Errorf("truncated description has %d characters; want %d", n, maxDescriptionLength)
+	}
+}
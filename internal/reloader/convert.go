@@ -0,0 +1,75 @@
+package reloader
+
+import (
+	"aliyun-security-group-mgr/internal/utils"
+
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ConvertFile translates a single rules file to a format. Its include
+// directives are kept as written, and the files they include are left as
+// they are. The structured formats have no aliases nor comment lines, so
+// rules using aliases are written expanded and comment lines are dropped;
+// the returned warnings tell what the translation lost.
+func ConvertFile(path string, format string) ([]byte, []string, error) {
+	ruleset, err := LoadRules(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var entries []Entry
+	for _, entry := range ruleset.Entries {
+		if entry.Source.File == path {
+			entries = append(entries, entry)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var includes, warnings []string
+	if inputFormat := FileFormat(path); inputFormat != FormatLine {
+		if includes, _, err = decodeStructured(inputFormat, data); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		lines, err := readLines(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		defines, comments := 0, 0
+		for _, line := range lines {
+			if pattern, ok := includePattern(line); ok {
+				includes = append(includes, pattern)
+				continue
+			}
+			rule := utils.RemoveCommentFromLine(line)
+			switch {
+			case rule == "" && strings.TrimSpace(line) != "":
+				comments++
+			case strings.HasPrefix(strings.ToLower(rule), "define"):
+				defines++
+			}
+		}
+		if defines > 0 {
+			warnings = append(warnings, fmt.Sprintf("%d define lines are not kept: the rules using their aliases are written expanded, "+
+				"and included files using them will no longer load", defines))
+		}
+		if comments > 0 {
+			warnings = append(warnings, fmt.Sprintf("%d comment lines are dropped, rule descriptions are kept", comments))
+		}
+	}
+
+	if format != FormatLine {
+		data, err := encodeStructured(format, includes, entries)
+		return data, warnings, err
+	}
+	var buf strings.Builder
+	for _, pattern := range includes {
+		buf.WriteString("include " + pattern + "\n")
+	}
+	buf.Write(EncodeLines(entries))
+	return []byte(buf.String()), warnings, nil
+}
@@ -0,0 +1,282 @@
+package reloader
+
+import (
+	"aliyun-security-group-mgr/internal/utils"
+
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Document is a rules file kept line by line, including comments, blank
+// lines and line endings, so that targeted edits leave every other byte of
+// the file untouched. Lines are numbered from 1, as in Entry.Source.
+type Document struct {
+	Path  string
+	lines []docLine
+
+	// ruleset, when set, gives the aliases in scope at each line
+	ruleset *Ruleset
+}
+
+type docLine struct {
+	text string
+	eol  string
+}
+
+// ReadDocument reads a rules file into a Document
+func ReadDocument(path string) (*Document, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDocument(path, data), nil
+}
+
+// ParseDocument splits data into lines without interpreting them
+func ParseDocument(path string, data []byte) *Document {
+	d := &Document{Path: path}
+	for len(data) > 0 {
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			d.lines = append(d.lines, docLine{text: string(data)})
+			break
+		}
+		text, eol := string(data[:idx]), "\n"
+		if strings.HasSuffix(text, "\r") {
+			text, eol = text[:len(text)-1], "\r\n"
+		}
+		d.lines = append(d.lines, docLine{text: text, eol: eol})
+		data = data[idx+1:]
+	}
+	return d
+}
+
+// Bytes returns the content of the document
+func (d *Document) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, line := range d.lines {
+		buf.WriteString(line.text)
+		buf.WriteString(line.eol)
+	}
+	return buf.Bytes()
+}
+
+// WriteFile atomically replaces the file at d.Path with the document
+func (d *Document) WriteFile() error {
+	return utils.WriteFileAtomic(d.Path, d.Bytes(), 0644)
+}
+
+// Len returns the number of lines
+func (d *Document) Len() int {
+	return len(d.lines)
+}
+
+// Line returns the text of line n, without its line ending
+func (d *Document) Line(n int) (string, error) {
+	if n < 1 || n > len(d.lines) {
+		return "", fmt.Errorf("line %d out of range", n)
+	}
+	return d.lines[n-1].text, nil
+}
+
+// SetLine replaces the text of line n, keeping its line ending
+func (d *Document) SetLine(n int, text string) error {
+	if n < 1 || n > len(d.lines) {
+		return fmt.Errorf("line %d out of range", n)
+	}
+	d.lines[n-1].text = text
+	return nil
+}
+
+// InsertLine inserts text before line n; n = Len()+1 appends
+func (d *Document) InsertLine(n int, text string) error {
+	if n < 1 || n > len(d.lines)+1 {
+		return fmt.Errorf("line %d out of range", n)
+	}
+
+	eol := d.eol()
+	// appending after a last line without line ending
+	if n > 1 && d.lines[n-2].eol == "" {
+		d.lines[n-2].eol = eol
+	}
+
+	d.lines = append(d.lines, docLine{})
+	copy(d.lines[n:], d.lines[n-1:])
+	d.lines[n-1] = docLine{text: text, eol: eol}
+	return nil
+}
+
+// RemoveLine removes line n
+func (d *Document) RemoveLine(n int) error {
+	if n < 1 || n > len(d.lines) {
+		return fmt.Errorf("line %d out of range", n)
+	}
+	d.lines = append(d.lines[:n-1], d.lines[n:]...)
+	return nil
+}
+
+// InsertRule inserts a rule line for entry before line n
+func (d *Document) InsertRule(n int, entry Entry) error {
+	return d.InsertLine(n, EncodeEntry(entry))
+}
+
+// AppendRule appends a rule line for entry and returns its line number
+func (d *Document) AppendRule(entry Entry) (int, error) {
+	n := len(d.lines) + 1
+	return n, d.InsertRule(n, entry)
+}
+
+// SetRuleset makes Entries resolve the aliases in scope when ruleset, which
+// the document is a file of, was loaded, including those defined by the
+// files including it
+func (d *Document) SetRuleset(ruleset *Ruleset) {
+	d.ruleset = ruleset
+}
+
+// Entries parses line n, resolving aliases defined by the lines above it,
+// or in scope at it in the ruleset of the document
+func (d *Document) Entries(n int) ([]Entry, error) {
+	if n < 1 || n > len(d.lines) {
+		return nil, fmt.Errorf("line %d out of range", n)
+	}
+
+	parser := d.ruleset.parserAt(Source{File: d.Path, Line: n})
+	if parser == nil {
+		parser = NewParser()
+		for i, line := range d.lines[:n-1] {
+			if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(line.text)), "define") {
+				continue
+			}
+			if _, err := parser.ParseLine(line.text); err != nil {
+				return nil, &ParseError{Source: Source{File: d.Path, Line: i + 1}, Err: err}
+			}
+		}
+	}
+	entries, err := parser.ParseLine(d.lines[n-1].text)
+	if err != nil {
+		return nil, &ParseError{Source: Source{File: d.Path, Line: n}, Err: err}
+	}
+	for i := range entries {
+		entries[i].Source = Source{File: d.Path, Line: n}
+	}
+	return entries, nil
+}
+
+// RemoveRule removes the rule of entry from the line entry.Source points
+// at. Other rules expanded from the same line are kept on a rewritten line.
+func (d *Document) RemoveRule(entry Entry) error {
+	return d.replaceRule(entry, nil)
+}
+
+// UpdateRule replaces the rule of old, found at old.Source, by new. The
+// line is rewritten, so aliases used on it are expanded.
+func (d *Document) UpdateRule(old Entry, new Entry) error {
+	return d.replaceRule(old, &new)
+}
+
+func (d *Document) replaceRule(old Entry, new *Entry) error {
+	n := old.Source.Line
+	entries, err := d.Entries(n)
+	if err != nil {
+		return err
+	}
+
+	idx := -1
+	for i, entry := range entries {
+		if entry.EqualContent(old) && entry.ExpireAt.Equal(old.ExpireAt) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return fmt.Errorf("%s: rule not found: %s", old.Source, EncodeEntry(old))
+	}
+
+	var kept []Entry
+	kept = append(kept, entries[:idx]...)
+	if new != nil {
+		kept = append(kept, *new)
+	}
+	kept = append(kept, entries[idx+1:]...)
+
+	if err := d.RemoveLine(n); err != nil {
+		return err
+	}
+	for i, group := range GroupEntries(kept) {
+		if err := d.InsertLine(n+i, EncodeEntries(group)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetExpiry sets the until clause of the rule line n, leaving the rest of
+// the line as written
+func (d *Document) SetExpiry(n int, expireAt time.Time) error {
+	entries, err := d.Entries(n)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return &ParseError{Source: Source{File: d.Path, Line: n}, Err: fmt.Errorf("not a rule line")}
+	}
+	return d.SetLine(n, WithUntil(d.lines[n-1].text, formatUntil(expireAt)))
+}
+
+// WithUntil sets the until clause of a rule line to until, appending one
+// when the line has none, and leaves the rest of the line as written
+func WithUntil(text string, until string) string {
+	ruleEnd := len(text)
+	if idx := strings.Index(text, "#"); idx != -1 {
+		ruleEnd = idx
+	}
+
+	spans := fieldSpans(text[:ruleEnd])
+	for i := 0; i+1 < len(spans); i++ {
+		if strings.ToLower(text[spans[i][0]:spans[i][1]]) == "until" {
+			value := spans[i+1]
+			return text[:value[0]] + until + text[value[1]:]
+		}
+	}
+
+	last := 0
+	if len(spans) > 0 {
+		last = spans[len(spans)-1][1]
+	}
+	return text[:last] + " until " + until + text[last:]
+}
+
+// fieldSpans returns the start and end offsets of the whitespace separated
+// fields of s
+func fieldSpans(s string) [][2]int {
+	var spans [][2]int
+	start := -1
+	for i, r := range s {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				spans = append(spans, [2]int{start, i})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(s)})
+	}
+	return spans
+}
+
+// eol returns the line ending used by the document
+func (d *Document) eol() string {
+	for _, line := range d.lines {
+		if line.eol != "" {
+			return line.eol
+		}
+	}
+	return "\n"
+}
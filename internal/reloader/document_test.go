@@ -0,0 +1,176 @@
+package reloader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testDocument = "# Office access\r\n" +
+	"define cidr office 203.0.113.0/24\r\n" +
+	"\r\n" +
+	"accept ingress ssh  from @office   until 2024-12-31T23:59:59Z # SSH\r\n" +
+	"accept ingress tcp 80,443 from 10.0.0.0/8 until never # Web\r\n" +
+	"## end"
+
+func TestDocumentRoundTrip(t *testing.T) {
+	d := ParseDocument("rules.conf", []byte(testDocument))
+	if string(d.Bytes()) != testDocument {
+		t.Errorf("Bytes() = %q; want %q", d.Bytes(), testDocument)
+	}
+	if d.Len() != 6 {
+		t.Errorf("Len() = %d; want 6", d.Len())
+	}
+}
+
+func TestDocumentEdits(t *testing.T) {
+	d := ParseDocument("rules.conf", []byte(testDocument))
+
+	entries, err := d.Entries(5)
+	if err != nil {
+		t.Fatalf("Entries(5) returned error: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Entries(5) returned %d entries; want 2", len(entries))
+	}
+
+	if err := d.RemoveRule(entries[0]); err != nil {
+		t.Fatalf("RemoveRule returned error: %v", err)
+	}
+	if err := d.SetExpiry(4, time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("SetExpiry returned error: %v", err)
+	}
+	if _, err := d.AppendRule(entries[0]); err != nil {
+		t.Fatalf("AppendRule returned error: %v", err)
+	}
+
+	want := "# Office access\r\n" +
+		"define cidr office 203.0.113.0/24\r\n" +
+		"\r\n" +
+		"accept ingress ssh  from @office   until 2025-06-30T00:00:00Z # SSH\r\n" +
+		"accept ingress tcp 443/443 from 10.0.0.0/8 priority 1 until never # Web\r\n" +
+		"## end\r\n" +
+		"accept ingress tcp 80/80 from 10.0.0.0/8 priority 1 until never # Web\r\n"
+	if got := string(d.Bytes()); got != want {
+		t.Errorf("after edits Bytes() = %q; want %q", got, want)
+	}
+
+	ssh, err := d.Entries(4)
+	if err != nil {
+		t.Fatalf("Entries(4) returned error: %v", err)
+	}
+	updated := ssh[0]
+	updated.SecurityGroup.Priority = "5"
+	if err := d.UpdateRule(ssh[0], updated); err != nil {
+		t.Fatalf("UpdateRule returned error: %v", err)
+	}
+	if got, err := d.Line(4); err != nil || got != "accept ingress tcp 22/22 from 203.0.113.0/24 priority 5 until 2025-06-30T00:00:00Z # SSH" {
+		t.Errorf("after UpdateRule Line(4) = %q, %v", got, err)
+	}
+	for _, n := range []int{0, d.Len() + 1} {
+		if _, err := d.Line(n); err == nil {
+			t.Errorf("Line(%d) of a %d line document should fail", n, d.Len())
+		}
+	}
+
+	if err := d.RemoveRule(entries[0]); err == nil {
+		t.Errorf("RemoveRule of a rule no longer at its line should fail")
+	}
+}
+
+func TestDocumentWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.conf")
+	if err := os.WriteFile(path, []byte(testDocument), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := ReadDocument(path)
+	if err != nil {
+		t.Fatalf("ReadDocument returned error: %v", err)
+	}
+	if err := d.InsertLine(3, "# inserted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteFile(); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(d.Bytes()) {
+		t.Errorf("file content = %q; want %q", data, d.Bytes())
+	}
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Mode().Perm() != 0600 {
+		t.Errorf("file mode = %v; want 0600", fileInfo.Mode().Perm())
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".*.tmp*")); len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestDocumentSetExpiryOfNonRules(t *testing.T) {
+	d := ParseDocument("rules.conf", []byte(testDocument))
+	expireAt := time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC)
+	for _, n := range []int{1, 2, 3, 6} {
+		if err := d.SetExpiry(n, expireAt); err == nil {
+			t.Errorf("SetExpiry(%d) of %q should fail", n, d.lines[n-1].text)
+		}
+	}
+	if got := string(d.Bytes()); got != testDocument {
+		t.Errorf("after failed SetExpiry Bytes() = %q", got)
+	}
+
+	invalid := ParseDocument("rules.conf", []byte("define cidr office 10.0.0.0/33\naccept ingress ssh from 10.0.0.0/8 until never\n"))
+	if _, err := invalid.Entries(2); err == nil {
+		t.Errorf("Entries below an invalid define should fail")
+	}
+}
+
+func TestDocumentIncludedAliases(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.conf")
+	teamPath := filepath.Join(dir, "teams", "web.conf")
+	writeFile(t, path, "define cidr office 203.0.113.0/24\n"+
+		"include teams/*.conf\n"+
+		"accept ingress web from 10.0.0.0/8 until never\n")
+	writeFile(t, teamPath, "define service web tcp 80,443\n"+
+		"accept ingress ssh from @office until 2024-12-31T23:59:59Z\n")
+
+	ruleset, err := LoadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	team, err := ReadDocument(teamPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := team.Entries(2); err == nil {
+		t.Errorf("Entries of an included file without its ruleset should not know the aliases of the including file")
+	}
+	team.SetRuleset(ruleset)
+	if err := team.SetExpiry(2, time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Errorf("SetExpiry of a rule using an alias of the including file returned error: %v", err)
+	}
+
+	root, err := ReadDocument(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.SetRuleset(ruleset)
+	if entries, err := root.Entries(3); err != nil || len(entries) != 2 {
+		t.Errorf("Entries of a rule using an alias of an included file = %v, %v; want 2 rules", entries, err)
+	}
+	if err := root.InsertLine(4, "accept ingress web from @office until never"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := root.Entries(4); err != nil || len(entries) != 2 {
+		t.Errorf("Entries of an appended rule = %v, %v; want 2 rules", entries, err)
+	}
+}
@@ -4,9 +4,7 @@ import (
 	"aliyun-security-group-mgr/internal/ecs"
 	"aliyun-security-group-mgr/internal/utils"
 
-	"bufio"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 	"unicode"
@@ -15,6 +13,15 @@ import (
 type Entry struct {
 	SecurityGroup ecs.SecurityGroupRule
 	ExpireAt      time.Time
+
+	// Source is where the entry was defined, empty for live rules
+	Source Source
+
+	// NoAggregate keeps the entry out of cidr aggregation
+	NoAggregate bool
+
+	// Owner names who asked for the rule, for rules added through the API
+	Owner string
 }
 
 func (e *Entry) EqualContent(other Entry) bool {
@@ -28,95 +35,97 @@ func (e *Entry) EqualContent(other Entry) bool {
 		e.SecurityGroup.Description == other.SecurityGroup.Description
 }
 
-func ReadEntriesFromFile(path string) ([]Entry, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	var lines []string
+// IsExpired reports whether the entry has expired at now. Entries without
+// an expiry never expire.
+func (e *Entry) IsExpired(now time.Time) bool {
+	return !e.ExpireAt.IsZero() && e.ExpireAt.Before(now)
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+// String describes the entry for logs and CLI output, naming well-known
+// services and prefixed by the entry's source, if any
+func (e Entry) String() string {
+	ipProtocol := strings.ToLower(e.SecurityGroup.IpProtocol)
+	service := ipProtocol + " " + e.SecurityGroup.PortRange
+	if name := ServiceName(ipProtocol, e.SecurityGroup.PortRange); name != "" && name != "all" {
+		service += " (" + name + ")"
 	}
 
-	var entries []Entry
-	for _, line := range lines {
-		entry, err := DecodeEntry(line)
-		if err != nil {
-			if strings.Contains(err.Error(), "empty line") {
-				continue
-			}
-			return nil, err
-		}
-		entries = append(entries, *entry)
+	directionWord := "from"
+	if e.SecurityGroup.Direction == ecs.DirectionEgress {
+		directionWord = "to"
 	}
 
-	return entries, nil
-}
-
-func DecodeEntry(line string) (*Entry, error) {
-	comment := utils.ExtractCommentFromLine(line)
-	line = utils.RemoveCommentFromLine(line)
-	if strings.TrimSpace(line) == "" {
-		return nil, fmt.Errorf("empty line")
+	str := fmt.Sprintf("%s %s %s %s %s priority %s",
+		strings.ToLower(e.SecurityGroup.Policy),
+		e.SecurityGroup.Direction,
+		service,
+		directionWord,
+		e.SecurityGroup.CidrIp,
+		e.SecurityGroup.Priority,
+	)
+	if !e.ExpireAt.IsZero() {
+		str += " until " + e.ExpireAt.Format(time.RFC3339)
 	}
-
-	parts := strings.Fields(line)
-	if len(parts) != 10 {
-		return nil, fmt.Errorf("invalid entry line: %s", line)
+	if e.Owner != "" {
+		str += " owner " + e.Owner
+	}
+	if e.SecurityGroup.Description != "" {
+		str += " # " + e.SecurityGroup.Description
 	}
+	if e.Source.File != "" {
+		str = e.Source.String() + ": " + str
+	}
+	return str
+}
 
-	policy := strings.Title(parts[0])
-	direction := parts[1]
-	ipProtocol := strings.ToUpper(parts[2])
-	portRange := parts[3]
-	cidrIp := parts[5]
-	priority := parts[7]
-	expireAtStr := parts[9]
+// ReadEntriesFromFile reads the entries of a rules file and its includes
+func ReadEntriesFromFile(path string) ([]Entry, error) {
+	ruleset, err := LoadRules(path)
+	if err != nil {
+		return nil, err
+	}
+	return ruleset.Entries, nil
+}
 
-	expireAt, err := time.Parse(time.RFC3339, expireAtStr)
+// DecodeEntry decodes a line describing exactly one rule
+func DecodeEntry(line string) (*Entry, error) {
+	entries, err := DecodeEntries(line)
 	if err != nil {
-		return nil, fmt.Errorf("invalid expire at format: %s", expireAtStr)
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, fmt.Errorf("entry line expands to %d rules: %s", len(entries), line)
 	}
+	return &entries[0], nil
+}
 
-	entry := &Entry{
-		SecurityGroup: ecs.SecurityGroupRule{
-			Policy:      policy,
-			Direction:   direction,
-			IpProtocol:  ipProtocol,
-			PortRange:   portRange,
-			CidrIp:      cidrIp,
-			Priority:    priority,
-			Description: comment,
-		},
-		ExpireAt: expireAt,
+// DecodeEntries decodes a line into one entry per port range and cidr,
+// both of which may be comma-separated lists, service names or aliases
+func DecodeEntries(line string) ([]Entry, error) {
+	if utils.RemoveCommentFromLine(line) == "" {
+		return nil, fmt.Errorf("empty line")
 	}
+	return NewParser().ParseLine(line)
+}
 
-	return entry, nil
+func EncodeEntry(entry Entry) string {
+	return encodeLine(entry, []string{entry.SecurityGroup.PortRange}, []string{entry.SecurityGroup.CidrIp})
 }
 
-func WriteEntriesToFile(path string, entries []Entry) error {
-	file, err := os.Create(path)
-	if err != nil {
-		return err
+// EncodeEntries encodes a group built by GroupEntries into a single line
+func EncodeEntries(entries []Entry) string {
+	if len(entries) == 0 {
+		return ""
 	}
-	defer file.Close()
-
-	writer := bufio.NewWriter(file)
+	var portRanges, cidrIps []string
 	for _, entry := range entries {
-		line := EncodeEntry(entry)
-		_, err := writer.WriteString(line + "\n")
-		if err != nil {
-			return err
-		}
+		portRanges = appendUnique(portRanges, entry.SecurityGroup.PortRange)
+		cidrIps = appendUnique(cidrIps, entry.SecurityGroup.CidrIp)
 	}
-	return writer.Flush()
+	return encodeLine(entries[0], portRanges, cidrIps)
 }
 
-func EncodeEntry(entry Entry) string {
+func encodeLine(entry Entry, portRanges []string, cidrIps []string) string {
 	var policy string
 	{
 		runes := []rune(string(entry.SecurityGroup.Policy))
@@ -125,18 +134,17 @@ func EncodeEntry(entry Entry) string {
 	}
 	var direction string = entry.SecurityGroup.Direction
 	var ipProtocol string = strings.ToLower(entry.SecurityGroup.IpProtocol)
-	var portRange string = entry.SecurityGroup.PortRange
+	var portRange string = strings.Join(portRanges, ",")
 	var directionWord string
 	if entry.SecurityGroup.Direction == "ingress" {
 		directionWord = "from"
 	} else {
 		directionWord = "to"
 	}
-	var cidrIp string = entry.SecurityGroup.CidrIp
+	var cidrIp string = strings.Join(cidrIps, ",")
 	var priority string = entry.SecurityGroup.Priority
-	var expireAt string = entry.ExpireAt.Format(time.RFC3339)
 
-	str := fmt.Sprintf("%s %s %s %s %s %s priority %s until %s",
+	str := fmt.Sprintf("%s %s %s %s %s %s priority %s",
 		policy,
 		direction,
 		ipProtocol,
@@ -144,8 +152,14 @@ func EncodeEntry(entry Entry) string {
 		directionWord,
 		cidrIp,
 		priority,
-		expireAt,
 	)
+	str += " until " + formatUntil(entry.ExpireAt)
+	if entry.NoAggregate {
+		str += " aggregate no"
+	}
+	if entry.Owner != "" {
+		str += " owner " + entry.Owner
+	}
 
 	str = strings.TrimSpace(str)
 	if entry.SecurityGroup.Description != "" {
@@ -154,3 +168,81 @@ func EncodeEntry(entry Entry) string {
 
 	return str
 }
+
+// formatUntil returns the until value of an expiry
+func formatUntil(expireAt time.Time) string {
+	if expireAt.IsZero() {
+		return UntilNever
+	}
+	return expireAt.Format(time.RFC3339)
+}
+
+// GroupEntries groups entries that can share a single line: same policy,
+// direction, protocol, priority, expiry and description, where every cidr
+// of the group carries the same set of port ranges. The order of first
+// appearance is preserved.
+func GroupEntries(entries []Entry) [][]Entry {
+	type bucket struct {
+		cidrIps []string
+		ports   map[string][]Entry
+	}
+
+	var headKeys []string
+	buckets := make(map[string]*bucket)
+	for _, entry := range entries {
+		headKey := fmt.Sprintf("%s|%s|%s|%s|%d|%t|%s|%s",
+			entry.SecurityGroup.Policy,
+			entry.SecurityGroup.Direction,
+			entry.SecurityGroup.IpProtocol,
+			entry.SecurityGroup.Priority,
+			entry.ExpireAt.UnixNano(),
+			entry.NoAggregate,
+			entry.Owner,
+			entry.SecurityGroup.Description,
+		)
+		b, ok := buckets[headKey]
+		if !ok {
+			b = &bucket{ports: make(map[string][]Entry)}
+			buckets[headKey] = b
+			headKeys = append(headKeys, headKey)
+		}
+		cidrIp := entry.SecurityGroup.CidrIp
+		if _, ok := b.ports[cidrIp]; !ok {
+			b.cidrIps = append(b.cidrIps, cidrIp)
+		}
+		b.ports[cidrIp] = append(b.ports[cidrIp], entry)
+	}
+
+	var groups [][]Entry
+	for _, headKey := range headKeys {
+		b := buckets[headKey]
+
+		// cidrs with identical port sets share a line
+		var portKeys []string
+		byPorts := make(map[string][]Entry)
+		for _, cidrIp := range b.cidrIps {
+			var ports []string
+			for _, entry := range b.ports[cidrIp] {
+				ports = append(ports, entry.SecurityGroup.PortRange)
+			}
+			portKey := strings.Join(ports, ",")
+			if _, ok := byPorts[portKey]; !ok {
+				portKeys = append(portKeys, portKey)
+			}
+			byPorts[portKey] = append(byPorts[portKey], b.ports[cidrIp]...)
+		}
+		for _, portKey := range portKeys {
+			groups = append(groups, byPorts[portKey])
+		}
+	}
+	return groups
+}
+
+func appendUnique(list []string, item string) []string {
+	for _, existing := range list {
+		if existing == item {
+			return list
+		}
+	}
+	return append(list, item)
+}
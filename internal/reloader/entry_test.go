@@ -27,7 +27,7 @@ var testGroup = []struct {
 		},
 	},
 	{
-		line: "drop egress udp 53/53 to 0.0.0.0/0 priority 200 until 2024-12-31T23:59:59+08:00",
+		line: "drop egress udp 53/53 to 0.0.0.0/0 priority 20 until 2024-12-31T23:59:59+08:00",
 		entry: Entry{
 			SecurityGroup: ecs.SecurityGroupRule{
 				Policy:      ecs.PolicyDrop,
@@ -35,22 +35,22 @@ var testGroup = []struct {
 				IpProtocol:  "UDP",
 				PortRange:   "53/53",
 				CidrIp:      "0.0.0.0/0",
-				Priority:    "200",
+				Priority:    "20",
 				Description: "",
 			},
 			ExpireAt: time.Date(2024, 12, 31, 23, 59, 59, 0, time.Local),
 		},
 	},
 	{
-		line: "accept ingress tcp 80/80 from 1.2.3.4/10 priority 300 until 2024-12-31T23:59:59+08:00 # TEST access",
+		line: "accept ingress tcp 80/80 from 1.0.0.0/10 priority 30 until 2024-12-31T23:59:59+08:00 # TEST access",
 		entry: Entry{
 			SecurityGroup: ecs.SecurityGroupRule{
 				Policy:      ecs.PolicyAccept,
 				Direction:   "ingress",
 				IpProtocol:  "TCP",
 				PortRange:   "80/80",
-				CidrIp:      "1.2.3.4/10",
-				Priority:    "300",
+				CidrIp:      "1.0.0.0/10",
+				Priority:    "30",
 				Description: "TEST access",
 			},
 			ExpireAt: time.Date(2024, 12, 31, 23, 59, 59, 0, time.Local),
@@ -87,3 +87,180 @@ func TestEncodeEntry(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodeEntryNormalizesCidr(t *testing.T) {
+	tests := []struct {
+		cidrIp string
+		want   string
+	}{
+		{"1.2.3.4/10", "1.0.0.0/10"},
+		{"192.168.1.7", "192.168.1.7/32"},
+		{"2001:DB8::1/32", "2001:db8::/32"},
+		{"2001:db8::1", "2001:db8::1/128"},
+	}
+
+	for _, test := range tests {
+		line := "accept ingress tcp 80/80 from " + test.cidrIp + " until never"
+		entry, err := DecodeEntry(line)
+		if err != nil {
+			t.Errorf("DecodeEntry(%q) returned error: %v", line, err)
+			continue
+		}
+		if entry.SecurityGroup.CidrIp != test.want {
+			t.Errorf("DecodeEntry(%q) cidr = %s; want %s", line, entry.SecurityGroup.CidrIp, test.want)
+		}
+	}
+}
+
+func TestDecodeEntries(t *testing.T) {
+	line := "accept ingress tcp 80,443,8000/8100 from 10.0.0.0/8,192.168.1.0/24 priority 1 until 2024-12-31T23:59:59+08:00 # Web"
+	entries, err := DecodeEntries(line)
+	if err != nil {
+		t.Fatalf("DecodeEntries(%q) returned error: %v", line, err)
+	}
+
+	want := []struct{ cidrIp, portRange string }{
+		{"10.0.0.0/8", "80/80"},
+		{"10.0.0.0/8", "443/443"},
+		{"10.0.0.0/8", "8000/8100"},
+		{"192.168.1.0/24", "80/80"},
+		{"192.168.1.0/24", "443/443"},
+		{"192.168.1.0/24", "8000/8100"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("DecodeEntries(%q) returned %d entries; want %d", line, len(entries), len(want))
+	}
+	for i, w := range want {
+		if entries[i].SecurityGroup.CidrIp != w.cidrIp || entries[i].SecurityGroup.PortRange != w.portRange {
+			t.Errorf("entry %d = %s %s; want %s %s", i, entries[i].SecurityGroup.CidrIp, entries[i].SecurityGroup.PortRange, w.cidrIp, w.portRange)
+		}
+	}
+
+	if _, err := DecodeEntry(line); err == nil {
+		t.Errorf("DecodeEntry(%q) should reject a multi-rule line", line)
+	}
+
+	groups := GroupEntries(entries)
+	if len(groups) != 1 {
+		t.Fatalf("GroupEntries returned %d groups; want 1", len(groups))
+	}
+	if encoded := EncodeEntries(groups[0]); encoded != "accept ingress tcp 80/80,443/443,8000/8100 from 10.0.0.0/8,192.168.1.0/24 priority 1 until 2024-12-31T23:59:59+08:00 # Web" {
+		t.Errorf("EncodeEntries = %q", encoded)
+	}
+}
+
+func TestGroupEntries(t *testing.T) {
+	expireAt := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	rule := func(cidrIp, portRange, priority string) Entry {
+		return Entry{
+			SecurityGroup: ecs.SecurityGroupRule{
+				Policy:     ecs.PolicyAccept,
+				Direction:  "ingress",
+				IpProtocol: "TCP",
+				PortRange:  portRange,
+				CidrIp:     cidrIp,
+				Priority:   priority,
+			},
+			ExpireAt: expireAt,
+		}
+	}
+
+	entries := []Entry{
+		rule("1.1.1.1/32", "22/22", "1"),
+		rule("2.2.2.2/32", "22/22", "1"),
+		rule("1.1.1.1/32", "80/80", "1"),
+		rule("2.2.2.2/32", "80/80", "1"),
+		rule("3.3.3.3/32", "22/22", "1"),
+		rule("3.3.3.3/32", "22/22", "2"),
+	}
+	want := []string{
+		"accept ingress tcp 22/22,80/80 from 1.1.1.1/32,2.2.2.2/32 priority 1 until 2100-01-01T00:00:00Z",
+		"accept ingress tcp 22/22 from 3.3.3.3/32 priority 1 until 2100-01-01T00:00:00Z",
+		"accept ingress tcp 22/22 from 3.3.3.3/32 priority 2 until 2100-01-01T00:00:00Z",
+	}
+
+	groups := GroupEntries(entries)
+	if len(groups) != len(want) {
+		t.Fatalf("GroupEntries returned %d groups; want %d", len(groups), len(want))
+	}
+	for i, group := range groups {
+		if line := EncodeEntries(group); line != want[i] {
+			t.Errorf("group %d = %q; want %q", i, line, want[i])
+		}
+	}
+}
+
+func TestParserAliases(t *testing.T) {
+	lines := []string{
+		"define service web tcp 80,https",
+		"define cidr office 203.0.113.0/24,198.51.100.7",
+		"accept ingress ssh from @office until never # SSH from office",
+		"accept ingress tcp/https from 0.0.0.0/0 priority 10 until never",
+		"accept ingress web from @office,10.0.0.0/8 until never",
+		"accept ingress dns from 10.0.0.0/8 until never",
+		"accept ingress all from 10.0.0.0/8 until never",
+		"accept ingress tcp all from 10.0.0.0/8 until never",
+	}
+	want := []string{
+		"accept ingress tcp 22/22 (ssh) from 203.0.113.0/24 priority 1 # SSH from office",
+		"accept ingress tcp 22/22 (ssh) from 198.51.100.7/32 priority 1 # SSH from office",
+		"accept ingress tcp 443/443 (https) from 0.0.0.0/0 priority 10",
+		"accept ingress tcp 80/80 (http) from 203.0.113.0/24 priority 1",
+		"accept ingress tcp 443/443 (https) from 203.0.113.0/24 priority 1",
+		"accept ingress tcp 80/80 (http) from 198.51.100.7/32 priority 1",
+		"accept ingress tcp 443/443 (https) from 198.51.100.7/32 priority 1",
+		"accept ingress tcp 80/80 (http) from 10.0.0.0/8 priority 1",
+		"accept ingress tcp 443/443 (https) from 10.0.0.0/8 priority 1",
+		"accept ingress udp 53/53 from 10.0.0.0/8 priority 1",
+		"accept ingress tcp 53/53 from 10.0.0.0/8 priority 1",
+		"accept ingress all -1/-1 from 10.0.0.0/8 priority 1",
+		"accept ingress tcp 1/65535 from 10.0.0.0/8 priority 1",
+	}
+
+	parser := NewParser()
+	var got []string
+	for _, line := range lines {
+		entries, err := parser.ParseLine(line)
+		if err != nil {
+			t.Fatalf("ParseLine(%q) returned error: %v", line, err)
+		}
+		for _, entry := range entries {
+			got = append(got, entry.String())
+		}
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries; want %d: %q", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entry %d = %q; want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParserErrors(t *testing.T) {
+	lines := []string{
+		"allow ingress tcp 22 from 0.0.0.0/0",
+		"accept inbound tcp 22 from 0.0.0.0/0",
+		"accept ingress tcp 22 to 0.0.0.0/0 until never",
+		"accept ingress tcp from 0.0.0.0/0 until never",
+		"accept ingress tcp 0/22 from 0.0.0.0/0 until never",
+		"accept ingress udp/ssh from 0.0.0.0/0 until never",
+		"accept ingress ftp from 0.0.0.0/0 until never",
+		"accept ingress ssh from @office until never",
+		"accept ingress ssh from 10.0.0.0/33 until never",
+		"accept ingress ssh from 10.0.0.0/8 until never priority",
+		"accept ingress ssh from 10.0.0.0/8 priority 0 until never",
+		"accept ingress ssh from 10.0.0.0/8 priority 101 until never",
+		"accept ingress ssh from 10.0.0.0/8",
+		"accept ingress ssh from 10.0.0.0/8 until tomorrow",
+		"define service tcp tcp 22",
+	}
+
+	for _, line := range lines {
+		if _, err := NewParser().ParseLine(line); err == nil {
+			t.Errorf("ParseLine(%q) should return an error", line)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package reloader
+
+import (
+	"aliyun-security-group-mgr/internal/utils"
+
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FormatOptions controls Format
+type FormatOptions struct {
+	// Sort orders the rules of each block of consecutive rule lines by
+	// direction, priority, policy, service and cidrs
+	Sort bool
+	// Ruleset, when it read the file, resolves the aliases in scope at each
+	// line as it was loaded, including those of the files including it
+	Ruleset *Ruleset
+}
+
+// Format canonicalizes a rules file: keywords, policies and protocols are
+// lowercased, cidrs are masked to their network address, consecutive rule
+// lines are aligned in columns and runs of blank lines are collapsed.
+// Comments, aliases and service names are kept as written. Lines that do
+// not parse are reported with their position and Format returns no output.
+func Format(path string, data []byte, options FormatOptions) ([]byte, error) {
+	d := ParseDocument(path, data)
+	parser := NewParser()
+	loadedPath, loaded := options.Ruleset.loadedPath(path)
+
+	var errs []error
+	var out []string
+	var block []*formattedRule
+	flush := func() {
+		if options.Sort {
+			sortRules(block)
+		}
+		out = append(out, alignRules(block)...)
+		block = nil
+	}
+
+	for n := 1; n <= d.Len(); n++ {
+		line := strings.TrimRightFunc(d.lines[n-1].text, isSpace)
+		source := Source{File: path, Line: n}
+
+		// keep aliases resolvable for the lines below
+		lineParser := parser
+		if loaded {
+			lineParser = options.Ruleset.parserAt(Source{File: loadedPath, Line: n})
+		}
+		if _, err := lineParser.ParseLine(line); err != nil {
+			if _, ok := includePattern(line); !ok {
+				errs = append(errs, &ParseError{Source: source, Err: err})
+				continue
+			}
+		}
+
+		rule, text, err := formatLine(line)
+		if err != nil {
+			errs = append(errs, &ParseError{Source: source, Err: err})
+			continue
+		}
+		if rule != nil {
+			block = append(block, rule)
+			continue
+		}
+
+		flush()
+		if text == "" && (len(out) == 0 || out[len(out)-1] == "") {
+			continue
+		}
+		out = append(out, text)
+	}
+	flush()
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	for len(out) > 0 && out[len(out)-1] == "" {
+		out = out[:len(out)-1]
+	}
+	if len(out) == 0 {
+		return []byte{}, nil
+	}
+	return []byte(strings.Join(out, "\n") + "\n"), nil
+}
+
+// formattedRule holds the canonical columns of a rule line
+type formattedRule struct {
+	columns []string
+	comment string
+
+	// sort keys
+	direction string
+	priority  int
+	policy    string
+}
+
+// formatLine canonicalizes a line. Rule lines are returned as a
+// formattedRule to be aligned with their neighbours; any other line is
+// returned as text.
+func formatLine(line string) (*formattedRule, string, error) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" {
+		return nil, "", nil
+	}
+	if strings.HasPrefix(trimmed, "#") {
+		return nil, trimmed, nil
+	}
+
+	comment := utils.ExtractCommentFromLine(line)
+	parts := strings.Fields(utils.RemoveCommentFromLine(line))
+	withComment := func(text string) string {
+		if comment != "" {
+			text += " # " + comment
+		}
+		return text
+	}
+
+	switch strings.ToLower(parts[0]) {
+	case "include":
+		return nil, withComment("include " + parts[1]), nil
+	case "define":
+		kind := strings.ToLower(parts[1])
+		value := parts[3:]
+		if kind == "service" {
+			value = formatService(value)
+		} else {
+			cidrs, err := formatCidrs(value[0])
+			if err != nil {
+				return nil, "", err
+			}
+			value = []string{cidrs}
+		}
+		return nil, withComment(strings.Join(append([]string{"define", kind, parts[2]}, value...), " ")), nil
+	}
+
+	fields, err := splitRuleFields(parts)
+	if err != nil {
+		return nil, "", err
+	}
+	cidrs, err := formatCidrs(fields.cidrs)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rule := &formattedRule{
+		comment:   comment,
+		direction: strings.ToLower(fields.direction),
+		policy:    strings.ToLower(fields.policy),
+		priority:  1,
+	}
+	var options []string
+	for _, option := range fields.options {
+		key, value := strings.ToLower(option[0]), option[1]
+		if key == "priority" {
+			rule.priority, _ = strconv.Atoi(value)
+			value = strconv.Itoa(rule.priority)
+		}
+		options = append(options, key+" "+value)
+	}
+	rule.columns = []string{
+		rule.policy,
+		rule.direction,
+		strings.Join(formatService(fields.service), " "),
+		strings.ToLower(fields.word),
+		cidrs,
+		strings.Join(options, " "),
+	}
+	return rule, "", nil
+}
+
+// formatService lowercases protocols, service names and "all"; user
+// defined service names are kept as written
+func formatService(tokens []string) []string {
+	formatted := make([]string, len(tokens))
+	for i, token := range tokens {
+		items := strings.Split(token, ",")
+		for j, item := range items {
+			if ipProtocol, rest, found := strings.Cut(item, "/"); found && IsProtocol(ipProtocol) {
+				item = strings.ToLower(ipProtocol) + "/" + formatServiceName(rest)
+			} else {
+				item = formatServiceName(item)
+			}
+			items[j] = item
+		}
+		formatted[i] = strings.Join(items, ",")
+	}
+	return formatted
+}
+
+func formatServiceName(name string) string {
+	lower := strings.ToLower(name)
+	if _, ok := builtinServices[lower]; ok || IsProtocol(lower) || lower == "all" {
+		return lower
+	}
+	return name
+}
+
+// formatCidrs masks cidrs to their network address, keeping aliases and
+// plain addresses
+func formatCidrs(list string) (string, error) {
+	items, err := splitList(list)
+	if err != nil {
+		return "", fmt.Errorf("invalid cidr list: %s", list)
+	}
+	for i, item := range items {
+		if strings.HasPrefix(item, "@") {
+			continue
+		}
+		if addr, err := netip.ParseAddr(item); err == nil {
+			items[i] = addr.String()
+			continue
+		}
+		if items[i], err = utils.NormalizeCidr(item); err != nil {
+			return "", fmt.Errorf("invalid cidr: %s", item)
+		}
+	}
+	return strings.Join(items, ","), nil
+}
+
+func sortRules(rules []*formattedRule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		if a.direction != b.direction {
+			return a.direction == "ingress"
+		}
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+		if a.policy != b.policy {
+			return a.policy == "drop"
+		}
+		for k := 2; k < len(a.columns); k++ {
+			if a.columns[k] != b.columns[k] {
+				return a.columns[k] < b.columns[k]
+			}
+		}
+		return false
+	})
+}
+
+// alignRules pads the columns of consecutive rule lines to equal width;
+// comments are aligned too
+func alignRules(rules []*formattedRule) []string {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	widths := make([]int, len(rules[0].columns))
+	hasComment := false
+	for _, rule := range rules {
+		for i, column := range rule.columns {
+			widths[i] = max(widths[i], len(column))
+		}
+		hasComment = hasComment || rule.comment != ""
+	}
+
+	lines := make([]string, len(rules))
+	for i, rule := range rules {
+		var b strings.Builder
+		for j, column := range rule.columns {
+			last := j == len(rule.columns)-1
+			if last && column == "" && rule.comment == "" {
+				break
+			}
+			if j > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(column)
+			if !last || (hasComment && rule.comment != "") {
+				b.WriteString(strings.Repeat(" ", widths[j]-len(column)))
+			}
+		}
+		if rule.comment != "" {
+			b.WriteString(" # " + rule.comment)
+		}
+		lines[i] = strings.TrimRightFunc(b.String(), isSpace)
+	}
+	return lines
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\r'
+}
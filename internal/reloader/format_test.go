@@ -0,0 +1,118 @@
+package reloader
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	input := "# Office\r\n" +
+		"define cidr office 203.0.113.7/24,198.51.100.7\r\n" +
+		"ACCEPT Ingress TCP 22/22 FROM 1.2.3.4/10 PRIORITY 100 UNTIL 2024-12-31T23:59:59+08:00 # SSH   \r\n" +
+		"\r\n" +
+		"\r\n" +
+		"accept ingress SSH from 10.0.0.0/8 priority 5 until never\r\n" +
+		"drop ingress tcp/HTTPS from @office until never # block\r\n" +
+		"include teams/*.conf"
+
+	tests := []struct {
+		options FormatOptions
+		want    string
+	}{
+		{
+			options: FormatOptions{},
+			want: "# Office\n" +
+				"define cidr office 203.0.113.0/24,198.51.100.7\n" +
+				"accept ingress tcp 22/22 from 1.0.0.0/10 priority 100 until 2024-12-31T23:59:59+08:00 # SSH\n" +
+				"\n" +
+				"accept ingress ssh       from 10.0.0.0/8 priority 5 until never\n" +
+				"drop   ingress tcp/https from @office    until never            # block\n" +
+				"include teams/*.conf\n",
+		},
+		{
+			options: FormatOptions{Sort: true},
+			want: "# Office\n" +
+				"define cidr office 203.0.113.0/24,198.51.100.7\n" +
+				"accept ingress tcp 22/22 from 1.0.0.0/10 priority 100 until 2024-12-31T23:59:59+08:00 # SSH\n" +
+				"\n" +
+				"drop   ingress tcp/https from @office    until never            # block\n" +
+				"accept ingress ssh       from 10.0.0.0/8 priority 5 until never\n" +
+				"include teams/*.conf\n",
+		},
+	}
+
+	for _, test := range tests {
+		got, err := Format("rules.conf", []byte(input), test.options)
+		if err != nil {
+			t.Fatalf("Format returned error: %v", err)
+		}
+		if string(got) != test.want {
+			t.Errorf("Format(%+v) = %q; want %q", test.options, got, test.want)
+		}
+
+		again, err := Format("rules.conf", got, test.options)
+		if err != nil || string(again) != string(got) {
+			t.Errorf("Format is not idempotent: %q", again)
+		}
+	}
+}
+
+func TestFormatSort(t *testing.T) {
+	input := "accept egress all to 0.0.0.0/0 until never\n" +
+		"accept ingress ssh from 10.0.0.0/8 priority 5 until never\n" +
+		"accept ingress ssh from 10.0.0.0/8 priority 2 until never\n" +
+		"drop ingress ssh from 10.0.0.0/8 priority 2 until never\n"
+	want := "drop   ingress ssh from 10.0.0.0/8 priority 2 until never\n" +
+		"accept ingress ssh from 10.0.0.0/8 priority 2 until never\n" +
+		"accept ingress ssh from 10.0.0.0/8 priority 5 until never\n" +
+		"accept egress  all to   0.0.0.0/0  until never\n"
+
+	got, err := Format("rules.conf", []byte(input), FormatOptions{Sort: true})
+	if err != nil {
+		t.Fatalf("Format returned error: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("Format = %q; want %q", got, want)
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	input := "accept ingress ssh from 10.0.0.0/8 until never\n" +
+		"accept ingress ftp from 10.0.0.0/8 until never\n" +
+		"accept ingress ssh from @nowhere until never\n"
+
+	_, err := Format("rules.conf", []byte(input), FormatOptions{})
+	if err == nil {
+		t.Fatalf("Format should fail on invalid lines")
+	}
+	for _, want := range []string{"rules.conf:2:", "rules.conf:3:"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Format error %q should mention %s", err, want)
+		}
+	}
+}
+
+func TestFormatIncludedAliases(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.conf")
+	teamPath := filepath.Join(dir, "teams", "web.conf")
+	writeFile(t, path, "define cidr office 203.0.113.0/24\ninclude teams/*.conf\n")
+	team := "define service web tcp 80,443\naccept ingress web from @office until never\n"
+	writeFile(t, teamPath, team)
+
+	if _, err := Format(teamPath, []byte(team), FormatOptions{}); err == nil {
+		t.Errorf("Format of an included file without its ruleset should not know the aliases of the including file")
+	}
+	ruleset, err := LoadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	formatted, err := Format(teamPath, []byte(team), FormatOptions{Ruleset: ruleset})
+	if err != nil {
+		t.Fatalf("Format of an included file using an alias of the including file returned error: %v", err)
+	}
+	if string(formatted) != team {
+		t.Errorf("Format() = %q; want %q", formatted, team)
+	}
+}
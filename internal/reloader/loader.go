@@ -0,0 +1,329 @@
+package reloader
+
+import (
+	"aliyun-security-group-mgr/internal/utils"
+
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Source is the file and line an entry was defined at
+type Source struct {
+	File string
+	Line int
+}
+
+func (s Source) String() string {
+	if s.File == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", s.File, s.Line)
+}
+
+// ParseError is an error at a specific line of a rules file
+type ParseError struct {
+	Source Source
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Source, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Ruleset is the result of loading a rules file together with the files it
+// includes
+type Ruleset struct {
+	Entries []Entry
+
+	// Files maps every file read to its modification time when read
+	Files map[string]time.Time
+	// Globs holds the include patterns, relative to the working directory
+	Globs []string
+	// Revision is a hash of the contents of the files read, in order
+	Revision string
+
+	// defines lists the aliases defined while loading, in order, and
+	// scopes how many of them each line of the line format files sees
+	defines []aliasDefine
+	scopes  map[string][]int
+}
+
+// parserAt returns a parser knowing the aliases in scope at a line of a
+// file of the ruleset: those the file defines above it and those defined
+// by the files including it or included above it. It returns nil for a
+// file the ruleset did not read.
+func (r *Ruleset) parserAt(source Source) *Parser {
+	if r == nil {
+		return nil
+	}
+	scope, ok := r.scopes[source.File]
+	if !ok || source.Line < 1 {
+		return nil
+	}
+	count := scope[len(scope)-1]
+	if source.Line <= len(scope) {
+		count = scope[source.Line-1]
+	}
+	return newParserWith(r.defines[:count])
+}
+
+// Loaded reports whether the ruleset read the file at path
+func (r *Ruleset) Loaded(path string) bool {
+	_, ok := r.loadedPath(path)
+	return ok
+}
+
+// loadedPath returns the name the file at path was read under, which may
+// be spelled differently
+func (r *Ruleset) loadedPath(path string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	if _, ok := r.scopes[path]; ok {
+		return path, true
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	for loaded := range r.scopes {
+		if abs, err := filepath.Abs(loaded); err == nil && abs == absPath {
+			return loaded, true
+		}
+	}
+	return "", false
+}
+
+// LoadRules reads a rules file, following include directives:
+//
+//	include teams/*.conf
+//
+// Patterns are relative to the including file. A file included more than
+// once is only read the first time; including a file from itself, directly
+// or not, is an error.
+//
+// Loading goes on after an invalid line, so the returned error joins every
+// *ParseError found, and the returned ruleset still lists the files read.
+func LoadRules(path string) (*Ruleset, error) {
+	return LoadRulesWithOptions(path, LoadOptions{})
+}
+
+// LoadOptions controls LoadRulesWithOptions
+type LoadOptions struct {
+	// TTLPolicy, when set, makes rules outliving their port class invalid
+	TTLPolicy *TTLPolicy
+}
+
+// LoadRulesWithOptions is LoadRules with policies enforced while parsing
+func LoadRulesWithOptions(path string, options LoadOptions) (*Ruleset, error) {
+	parser := NewParser()
+	parser.SetTTLPolicy(options.TTLPolicy)
+
+	l := &loader{
+		parser: parser,
+		loaded: make(map[string]bool),
+		ruleset: &Ruleset{
+			Files:  make(map[string]time.Time),
+			scopes: make(map[string][]int),
+		},
+		hash: sha256.New(),
+	}
+	if err := l.loadFile(path); err != nil {
+		l.errs = append(l.errs, err)
+	}
+	l.ruleset.Revision = hex.EncodeToString(l.hash.Sum(nil))[:12]
+	l.ruleset.defines = parser.defines
+	return l.ruleset, errors.Join(l.errs...)
+}
+
+type loader struct {
+	parser  *Parser
+	stack   []string
+	loaded  map[string]bool
+	ruleset *Ruleset
+	errs    []error
+	hash    hash.Hash
+}
+
+// loadFile returns errors about the file itself, such as a missing file;
+// errors within the file are collected in l.errs
+func (l *loader) loadFile(path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for i, including := range l.stack {
+		if including == absPath {
+			cycle := append(append([]string{}, l.stack[i:]...), absPath)
+			return fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	if l.loaded[absPath] {
+		return nil
+	}
+	l.loaded[absPath] = true
+
+	l.stack = append(l.stack, absPath)
+	defer func() {
+		l.stack = l.stack[:len(l.stack)-1]
+	}()
+
+	// missing files are recorded too, so that creating them is noticed
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		l.ruleset.Files[path] = time.Time{}
+		return err
+	}
+	l.ruleset.Files[path] = fileInfo.ModTime()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(l.hash, "%s\x00%d\x00", path, len(data))
+	l.hash.Write(data)
+
+	if format := FileFormat(path); format != FormatLine {
+		return l.loadStructuredFile(path, format, data)
+	}
+
+	lines, err := readLines(data)
+	if err != nil {
+		return err
+	}
+
+	// the aliases each line sees, and the lines appended after the last
+	scope := make([]int, 0, len(lines)+1)
+	defer func() {
+		l.ruleset.scopes[path] = append(scope, len(l.parser.defines))
+	}()
+	for i, line := range lines {
+		source := Source{File: path, Line: i + 1}
+		scope = append(scope, len(l.parser.defines))
+
+		if pattern, ok := includePattern(line); ok {
+			if err := l.include(path, pattern); err != nil {
+				l.errs = append(l.errs, &ParseError{Source: source, Err: err})
+			}
+			continue
+		}
+
+		entries, err := l.parser.ParseLine(line)
+		if err != nil {
+			l.errs = append(l.errs, &ParseError{Source: source, Err: err})
+			continue
+		}
+		for _, entry := range entries {
+			entry.Source = source
+			l.ruleset.Entries = append(l.ruleset.Entries, entry)
+		}
+	}
+	return nil
+}
+
+func (l *loader) include(path string, pattern string) error {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(path), pattern)
+	}
+	l.ruleset.Globs = append(l.ruleset.Globs, pattern)
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid include pattern %s: %w", pattern, err)
+	}
+	if len(matches) == 0 && !hasGlobMeta(pattern) {
+		// not a pattern: report the missing file
+		matches = []string{pattern}
+	}
+
+	var errs []error
+	for _, match := range matches {
+		if err := l.loadFile(match); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l *loader) loadStructuredFile(path string, format string, data []byte) error {
+	includes, rules, err := decodeStructured(format, data)
+	if err != nil {
+		l.errs = append(l.errs, &ParseError{Source: Source{File: path, Line: 1}, Err: err})
+		return nil
+	}
+
+	for _, pattern := range includes {
+		if err := l.include(path, pattern); err != nil {
+			l.errs = append(l.errs, &ParseError{Source: Source{File: path, Line: 1}, Err: err})
+		}
+	}
+
+	for _, rule := range rules {
+		source := Source{File: path, Line: rule.line}
+		entries, err := l.parser.parseStructured(rule.StructuredRule)
+		if err != nil {
+			l.errs = append(l.errs, &ParseError{Source: source, Err: err})
+			continue
+		}
+		for _, entry := range entries {
+			entry.Source = source
+			l.ruleset.Entries = append(l.ruleset.Entries, entry)
+		}
+	}
+	return nil
+}
+
+// includePattern returns the pattern of an include directive
+func includePattern(line string) (string, bool) {
+	parts := strings.Fields(utils.RemoveCommentFromLine(line))
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "include" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+func readLines(data []byte) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// Changed reports whether any file of the ruleset was modified or removed,
+// or an include pattern now matches a file that was not read
+func (r *Ruleset) Changed() bool {
+	for file, modTime := range r.Files {
+		fileInfo, err := os.Stat(file)
+		if err != nil || !fileInfo.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	for _, pattern := range r.Globs {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			if _, ok := r.Files[match]; !ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package reloader
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadRulesInclude(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.conf")
+	writeFile(t, main, "define cidr office 203.0.113.0/24\ninclude teams/*.conf\naccept ingress ssh from @office until never\n")
+	writeFile(t, filepath.Join(dir, "teams", "a.conf"), "# team a\naccept ingress https from @office until never\n")
+	writeFile(t, filepath.Join(dir, "teams", "b.conf"), "include a.conf\naccept ingress http from @office until never\n")
+
+	ruleset, err := LoadRules(main)
+	if err != nil {
+		t.Fatalf("LoadRules returned error: %v", err)
+	}
+
+	want := []Source{
+		{File: filepath.Join(dir, "teams", "a.conf"), Line: 2},
+		{File: filepath.Join(dir, "teams", "b.conf"), Line: 2},
+		{File: main, Line: 3},
+	}
+	if len(ruleset.Entries) != len(want) {
+		t.Fatalf("LoadRules returned %d entries; want %d", len(ruleset.Entries), len(want))
+	}
+	for i, source := range want {
+		if ruleset.Entries[i].Source != source {
+			t.Errorf("entry %d source = %s; want %s", i, ruleset.Entries[i].Source, source)
+		}
+	}
+	if len(ruleset.Files) != 3 {
+		t.Errorf("LoadRules read %d files; want 3", len(ruleset.Files))
+	}
+
+	if ruleset.Changed() {
+		t.Errorf("Changed() = true right after loading")
+	}
+	writeFile(t, filepath.Join(dir, "teams", "c.conf"), "accept ingress rdp from @office until never\n")
+	if !ruleset.Changed() {
+		t.Errorf("Changed() = false after a new file matches an include pattern")
+	}
+}
+
+func TestLoadRulesChangedOnEdit(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.conf")
+	team := filepath.Join(dir, "team.conf")
+	writeFile(t, main, "include team.conf\n")
+	writeFile(t, team, "accept ingress ssh from 10.0.0.0/8 until never\n")
+
+	ruleset, err := LoadRules(main)
+	if err != nil {
+		t.Fatalf("LoadRules returned error: %v", err)
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(team, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !ruleset.Changed() {
+		t.Errorf("Changed() = false after an included file was modified")
+	}
+}
+
+func TestLoadRulesErrors(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.conf")
+	other := filepath.Join(dir, "other.conf")
+
+	writeFile(t, main, "include other.conf\n")
+	writeFile(t, other, "\ninclude main.conf\n")
+	_, err := LoadRules(main)
+	if err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("LoadRules with a cycle returned %v", err)
+	}
+	if err != nil && !strings.HasPrefix(err.Error(), other+":2:") {
+		t.Errorf("cycle error %q should point at %s:2", err, other)
+	}
+
+	writeFile(t, other, "accept ingress ssh from nowhere until never\n")
+	_, err = LoadRules(main)
+	if err == nil || !strings.HasPrefix(err.Error(), other+":1:") {
+		t.Errorf("LoadRules with a bad included line returned %v", err)
+	}
+
+	writeFile(t, main, "include missing.conf\n")
+	ruleset, err := LoadRules(main)
+	if err == nil {
+		t.Fatalf("LoadRules with a missing include should return an error")
+	}
+	writeFile(t, filepath.Join(dir, "missing.conf"), "")
+	if !ruleset.Changed() {
+		t.Errorf("Changed() = false after a missing include was created")
+	}
+}
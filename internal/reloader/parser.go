@@ -0,0 +1,405 @@
+package reloader
+
+import (
+	"aliyun-security-group-mgr/internal/ecs"
+	"aliyun-security-group-mgr/internal/utils"
+
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPriority is used for rules without a priority clause
+const DefaultPriority = "1"
+
+// MinPriority and MaxPriority bound the priorities Aliyun accepts
+const (
+	MinPriority = 1
+	MaxPriority = 100
+)
+
+// UntilNever is the until value of rules that do not expire
+const UntilNever = "never"
+
+// Parser decodes rules lines, remembering the aliases defined by earlier
+// lines of the same file:
+//
+//	define service web tcp 80,443
+//	define cidr office 203.0.113.0/24,198.51.100.7
+//	accept ingress web from @office until 2100-01-01T00:00:00Z
+//	accept egress all to 0.0.0.0/0 until never
+type Parser struct {
+	services map[string][]ServicePort
+	cidrs    map[string][]string
+	// defines lists the aliases in the order they were defined
+	defines []aliasDefine
+
+	// ttlPolicy, when set, rejects rules outliving their port class
+	ttlPolicy *TTLPolicy
+}
+
+func NewParser() *Parser {
+	return &Parser{
+		services: make(map[string][]ServicePort),
+		cidrs:    make(map[string][]string),
+	}
+}
+
+// aliasDefine is a service or cidr alias
+type aliasDefine struct {
+	kind     string
+	name     string
+	services []ServicePort
+	cidrs    []string
+}
+
+// newParserWith returns a parser knowing the given aliases
+func newParserWith(defines []aliasDefine) *Parser {
+	p := NewParser()
+	for _, define := range defines {
+		if define.kind == "service" {
+			p.services[define.name] = define.services
+		} else {
+			p.cidrs[define.name] = define.cidrs
+		}
+	}
+	p.defines = append(p.defines, defines...)
+	return p
+}
+
+// SetTTLPolicy makes the parser reject accept rules that do not expire
+// within the maximum lifetime of their port class
+func (p *Parser) SetTTLPolicy(policy *TTLPolicy) {
+	p.ttlPolicy = policy
+}
+
+// ParseLine decodes a line into entries. Blank lines, comments and
+// directives produce no entries.
+func (p *Parser) ParseLine(line string) ([]Entry, error) {
+	comment := utils.ExtractCommentFromLine(line)
+	line = utils.RemoveCommentFromLine(line)
+	if line == "" {
+		return nil, nil
+	}
+
+	parts := strings.Fields(line)
+	if strings.ToLower(parts[0]) == "define" {
+		return nil, p.parseDefine(parts[1:])
+	}
+	return p.parseRule(parts, comment)
+}
+
+func (p *Parser) parseDefine(parts []string) error {
+	if len(parts) < 3 {
+		return fmt.Errorf("invalid define: expected 'define service|cidr <name> <value>'")
+	}
+
+	kind, name, value := strings.ToLower(parts[0]), parts[1], parts[2:]
+	switch kind {
+	case "service":
+		if IsProtocol(name) || strings.ToLower(name) == "all" {
+			return fmt.Errorf("service name %s is reserved", name)
+		}
+		if _, exists := p.services[name]; exists {
+			return fmt.Errorf("service %s already defined", name)
+		}
+		servicePorts, err := p.resolveService(value)
+		if err != nil {
+			return err
+		}
+		p.services[name] = servicePorts
+		p.defines = append(p.defines, aliasDefine{kind: kind, name: name, services: servicePorts})
+	case "cidr":
+		if _, exists := p.cidrs[name]; exists {
+			return fmt.Errorf("cidr alias %s already defined", name)
+		}
+		if len(value) != 1 {
+			return fmt.Errorf("invalid cidr alias %s: expected a comma-separated list", name)
+		}
+		cidrIps, err := p.resolveCidrs(value[0])
+		if err != nil {
+			return err
+		}
+		p.cidrs[name] = cidrIps
+		p.defines = append(p.defines, aliasDefine{kind: kind, name: name, cidrs: cidrIps})
+	default:
+		return fmt.Errorf("unknown define kind: %s", kind)
+	}
+	return nil
+}
+
+// ruleFields are the fields of a rule line, as written
+type ruleFields struct {
+	policy    string
+	direction string
+	service   []string
+	word      string
+	cidrs     string
+	// options holds keyword and value pairs such as "priority 10"
+	options [][2]string
+}
+
+func splitRuleFields(parts []string) (*ruleFields, error) {
+	// the service runs from the direction up to the from/to keyword
+	wordIdx := -1
+	for i := 2; i < len(parts); i++ {
+		if word := strings.ToLower(parts[i]); word == "from" || word == "to" {
+			wordIdx = i
+			break
+		}
+	}
+	if len(parts) < 4 || wordIdx < 0 || wordIdx+1 >= len(parts) {
+		return nil, fmt.Errorf("invalid entry line: %s", strings.Join(parts, " "))
+	}
+
+	fields := &ruleFields{
+		policy:    parts[0],
+		direction: parts[1],
+		service:   parts[2:wordIdx],
+		word:      parts[wordIdx],
+		cidrs:     parts[wordIdx+1],
+	}
+	options := parts[wordIdx+2:]
+	for i := 0; i < len(options); i += 2 {
+		if i+1 >= len(options) {
+			return nil, fmt.Errorf("missing value for %s", strings.ToLower(options[i]))
+		}
+		fields.options = append(fields.options, [2]string{options[i], options[i+1]})
+	}
+	return fields, nil
+}
+
+func (p *Parser) parseRule(parts []string, comment string) ([]Entry, error) {
+	fields, err := splitRuleFields(parts)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := strings.Title(strings.ToLower(fields.policy))
+	if policy != ecs.PolicyAccept && policy != ecs.PolicyDrop {
+		return nil, fmt.Errorf("invalid policy: %s", fields.policy)
+	}
+
+	direction := strings.ToLower(fields.direction)
+	word := strings.ToLower(fields.word)
+	switch {
+	case direction == ecs.DirectionIngress && word == "from":
+	case direction == ecs.DirectionEgress && word == "to":
+	case direction == ecs.DirectionIngress || direction == ecs.DirectionEgress:
+		return nil, fmt.Errorf("invalid keyword %s for direction %s", fields.word, direction)
+	default:
+		return nil, fmt.Errorf("invalid direction: %s", fields.direction)
+	}
+
+	servicePorts, err := p.resolveService(fields.service)
+	if err != nil {
+		return nil, err
+	}
+
+	cidrIps, err := p.resolveCidrs(fields.cidrs)
+	if err != nil {
+		return nil, err
+	}
+
+	priority := DefaultPriority
+	var expireAt time.Time
+	hasUntil := false
+	noAggregate := false
+	owner := ""
+	for _, option := range fields.options {
+		key, value := strings.ToLower(option[0]), option[1]
+		switch key {
+		case "priority":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < MinPriority || n > MaxPriority {
+				return nil, fmt.Errorf("invalid priority: %s, expected %d to %d", value, MinPriority, MaxPriority)
+			}
+			priority = strconv.Itoa(n)
+		case "until":
+			hasUntil = true
+			if strings.ToLower(value) == UntilNever {
+				expireAt = time.Time{}
+				break
+			}
+			expireAt, err = time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid expire at format: %s", value)
+			}
+		case "aggregate":
+			switch strings.ToLower(value) {
+			case "yes":
+				noAggregate = false
+			case "no":
+				noAggregate = true
+			default:
+				return nil, fmt.Errorf("invalid aggregate value: %s, expected yes or no", value)
+			}
+		case "owner":
+			owner = value
+		default:
+			return nil, fmt.Errorf("unknown option: %s", option[0])
+		}
+	}
+
+	if !hasUntil {
+		return nil, fmt.Errorf("missing until: write 'until %s' for a rule that does not expire", UntilNever)
+	}
+
+	var entries []Entry
+	for _, cidrIp := range cidrIps {
+		for _, servicePort := range servicePorts {
+			entries = append(entries, Entry{
+				SecurityGroup: ecs.SecurityGroupRule{
+					Policy:      policy,
+					Direction:   direction,
+					IpProtocol:  servicePort.IpProtocol,
+					PortRange:   servicePort.PortRange,
+					CidrIp:      cidrIp,
+					Priority:    priority,
+					Description: comment,
+				},
+				ExpireAt:    expireAt,
+				NoAggregate: noAggregate,
+				Owner:       owner,
+			})
+		}
+	}
+
+	if p.ttlPolicy != nil {
+		for _, entry := range entries {
+			if err := p.ttlPolicy.Check(entry); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return entries, nil
+}
+
+// resolveService resolves "<protocol> <ports>", "<protocol>/<service>",
+// "<protocol>" or "<service>" into protocol and port range pairs
+func (p *Parser) resolveService(tokens []string) ([]ServicePort, error) {
+	switch len(tokens) {
+	case 1:
+		token := tokens[0]
+		if ipProtocol, ports, found := strings.Cut(token, "/"); found {
+			if !IsProtocol(ipProtocol) {
+				return nil, fmt.Errorf("invalid protocol: %s", ipProtocol)
+			}
+			return p.resolvePorts(strings.ToUpper(ipProtocol), ports)
+		}
+		if IsProtocol(token) {
+			ipProtocol := strings.ToUpper(token)
+			if ipProtocol == ProtocolTCP || ipProtocol == ProtocolUDP {
+				return nil, fmt.Errorf("missing port range for protocol %s", token)
+			}
+			return []ServicePort{{ipProtocol, PortRangeAll}}, nil
+		}
+		if servicePorts, ok := p.lookupService(token); ok {
+			return servicePorts, nil
+		}
+		return nil, fmt.Errorf("unknown protocol or service: %s", token)
+	case 2:
+		if !IsProtocol(tokens[0]) {
+			return nil, fmt.Errorf("invalid protocol: %s", tokens[0])
+		}
+		return p.resolvePorts(strings.ToUpper(tokens[0]), tokens[1])
+	default:
+		return nil, fmt.Errorf("invalid protocol and port range: %s", strings.Join(tokens, " "))
+	}
+}
+
+// resolvePorts resolves a comma-separated list of ports, port ranges and
+// service names for the given protocol
+func (p *Parser) resolvePorts(ipProtocol string, list string) ([]ServicePort, error) {
+	items, err := splitList(list)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port list: %s", list)
+	}
+
+	var servicePorts []ServicePort
+	for _, item := range items {
+		if named, ok := p.lookupService(item); ok {
+			var matched bool
+			for _, servicePort := range named {
+				if servicePort.IpProtocol == ipProtocol {
+					servicePorts = append(servicePorts, servicePort)
+					matched = true
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("service %s has no %s port", item, strings.ToLower(ipProtocol))
+			}
+			continue
+		}
+
+		portRange, err := normalizePortRange(ipProtocol, item)
+		if err != nil {
+			return nil, err
+		}
+		servicePorts = append(servicePorts, ServicePort{ipProtocol, portRange})
+	}
+	return servicePorts, nil
+}
+
+// lookupService finds user-defined services first, then built-in ones
+func (p *Parser) lookupService(name string) ([]ServicePort, bool) {
+	if servicePorts, ok := p.services[name]; ok {
+		return servicePorts, true
+	}
+	servicePorts, ok := builtinServices[strings.ToLower(name)]
+	return servicePorts, ok
+}
+
+// resolveCidrs resolves a comma-separated list of cidrs, addresses and
+// @aliases
+func (p *Parser) resolveCidrs(list string) ([]string, error) {
+	items, err := splitList(list)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr list: %s", list)
+	}
+
+	var cidrIps []string
+	for _, item := range items {
+		if name, found := strings.CutPrefix(item, "@"); found {
+			aliased, ok := p.cidrs[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown cidr alias: %s", item)
+			}
+			cidrIps = append(cidrIps, aliased...)
+			continue
+		}
+
+		cidrIp, err := normalizeCidrItem(item)
+		if err != nil {
+			return nil, err
+		}
+		cidrIps = append(cidrIps, cidrIp)
+	}
+	return cidrIps, nil
+}
+
+// normalizeCidrItem turns an address or cidr into a cidr masked to its
+// network address, e.g. 1.2.3.4/10 into 1.0.0.0/10
+func normalizeCidrItem(item string) (string, error) {
+	if addr, err := netip.ParseAddr(item); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()).String(), nil
+	}
+	cidrIp, err := utils.NormalizeCidr(item)
+	if err != nil {
+		return "", fmt.Errorf("invalid cidr: %s", item)
+	}
+	return cidrIp, nil
+}
+
+// splitList splits a comma-separated list, rejecting empty items
+func splitList(s string) ([]string, error) {
+	items := strings.Split(s, ",")
+	for _, item := range items {
+		if item == "" {
+			return nil, fmt.Errorf("empty item in list: %s", s)
+		}
+	}
+	return items, nil
+}
@@ -2,23 +2,40 @@ package reloader
 
 import (
 	"aliyun-security-group-mgr/internal/conf"
-	"log"
-	"os"
+	"aliyun-security-group-mgr/internal/logging"
+
+	"sync"
 	"time"
 )
 
+var logger = logging.Component("reloader")
+
 type Reloader struct {
 	Config *conf.GlobalConfiguration
 
-	reloadChan      chan struct{}
+	reloadChan chan struct{}
+	ttlPolicy  *TTLPolicy
+
+	// loadMu serializes the loads of the watcher and those asked for
+	loadMu  sync.Mutex
+	ruleset *Ruleset
+
+	// mu guards the expected entries and their revision, read by the
+	// service's tickers and API while they are reloaded
+	mu              sync.RWMutex
 	expectedEntries []Entry
-	lastReloadTime  time.Time
+	revision        string
 }
 
 func NewReloader(config *conf.GlobalConfiguration, reloadChan chan struct{}) (*Reloader, error) {
+	ttlPolicy, err := TTLPolicyFromConfig(config.Ttl)
+	if err != nil {
+		return nil, err
+	}
 	return &Reloader{
 		Config:     config,
 		reloadChan: reloadChan,
+		ttlPolicy:  ttlPolicy,
 	}, nil
 }
 
@@ -38,35 +55,67 @@ func (r *Reloader) watchEntries() {
 }
 
 func (r *Reloader) reloadEntries() {
-	// Check file modification time
-	fileInfo, err := os.Stat(*r.Config.Reloader.WatchPath)
-	if err != nil {
-		log.Printf("[Reloader] failed to stat file: %v", err)
+	r.loadMu.Lock()
+	// Check modification of the watched file and every included file
+	if r.ruleset != nil && !r.ruleset.Changed() {
+		// No changes
+		r.loadMu.Unlock()
 		return
 	}
-	if fileInfo.ModTime().Equal(r.lastReloadTime) {
-		// No changes
+	err := r.load()
+	r.loadMu.Unlock()
+	if err != nil {
 		return
 	}
-	r.lastReloadTime = fileInfo.ModTime()
 
-	// Read entries from file
-	entries, err := ReadEntriesFromFile(*r.Config.Reloader.WatchPath)
+	// Notify service to sync
+	r.reloadChan <- struct{}{}
+}
+
+// Reload loads the rules files now, changed or not, for a sync asked for
+// right after they were edited. The caller syncs; it is not notified.
+func (r *Reloader) Reload() error {
+	r.loadMu.Lock()
+	defer r.loadMu.Unlock()
+	return r.load()
+}
+
+func (r *Reloader) load() error {
+	// Read entries from files, remembering what was read even on failure
+	ruleset, err := LoadRulesWithOptions(*r.Config.Reloader.WatchPath, LoadOptions{TTLPolicy: r.ttlPolicy})
+	r.ruleset = ruleset
 	if err != nil {
-		log.Printf("[Reloader] failed to read entries from file: %v", err)
-		return
+		logger.Error("failed to read entries from file", logging.KeyError, err)
+		return err
 	}
 
 	// Update expected entries
-	r.expectedEntries = entries
+	r.mu.Lock()
+	r.expectedEntries = ruleset.Entries
+	r.revision = ruleset.Revision
+	r.mu.Unlock()
 
 	// Log reloading
-	log.Printf("[Reloader] reloading rules from %s", *r.Config.Reloader.WatchPath)
+	logger.Info("reloading rules", "path", *r.Config.Reloader.WatchPath, "files", len(ruleset.Files), "revision", ruleset.Revision)
+	return nil
+}
 
-	// Notify service to sync
-	r.reloadChan <- struct{}{}
+// GetRevision returns the revision of the expected entries
+func (r *Reloader) GetRevision() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.revision
 }
 
 func (r *Reloader) GetExpectedEntries() []Entry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.expectedEntries
 }
+
+// GetExpected returns the expected entries together with their revision
+func (r *Reloader) GetExpected() ([]Entry, string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.expectedEntries, r.revision
+}
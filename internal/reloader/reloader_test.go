@@ -0,0 +1,43 @@
+package reloader
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestReloaderConcurrentReads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.conf")
+	writeFile(t, path, "accept ingress ssh from 10.0.0.0/8 until never\n")
+
+	config := conf.NewConfig()
+	config.Reloader.WatchPath = &path
+	reloadChan := make(chan struct{}, 100)
+	r, err := NewReloader(config, reloadChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// run with -race: the service reads the expected entries from other
+	// goroutines while they are reloaded
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			r.ruleset = nil
+			r.reloadEntries()
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		entries, revision := r.GetExpected()
+		if revision != "" && len(entries) != 1 {
+			t.Errorf("GetExpected() = %d entries of revision %s; want 1", len(entries), revision)
+		}
+		r.GetRevision()
+		r.GetExpectedEntries()
+	}
+	wg.Wait()
+}
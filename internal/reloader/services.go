@@ -0,0 +1,175 @@
+package reloader
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ServicePort is a protocol and port range pair a service name resolves to
+type ServicePort struct {
+	IpProtocol string
+	PortRange  string
+}
+
+const (
+	ProtocolTCP    = "TCP"
+	ProtocolUDP    = "UDP"
+	ProtocolICMP   = "ICMP"
+	ProtocolICMPv6 = "ICMPV6"
+	ProtocolGRE    = "GRE"
+	ProtocolAll    = "ALL"
+
+	// PortRangeAll is Aliyun's port range for protocols without ports
+	PortRangeAll = "-1/-1"
+	// PortRangeAllTCP is Aliyun's full port range for TCP and UDP
+	PortRangeAllTCP = "1/65535"
+)
+
+var protocols = map[string]bool{
+	ProtocolTCP:    true,
+	ProtocolUDP:    true,
+	ProtocolICMP:   true,
+	ProtocolICMPv6: true,
+	ProtocolGRE:    true,
+	ProtocolAll:    true,
+}
+
+// builtinServiceNames keeps the lookup order of ServiceName deterministic
+var builtinServiceNames = []string{
+	"ssh", "http", "https", "rdp", "mysql", "redis", "postgres", "dns", "ping", "echo",
+}
+
+var builtinServices = map[string][]ServicePort{
+	"ssh":      {{ProtocolTCP, "22/22"}},
+	"http":     {{ProtocolTCP, "80/80"}},
+	"https":    {{ProtocolTCP, "443/443"}},
+	"rdp":      {{ProtocolTCP, "3389/3389"}},
+	"mysql":    {{ProtocolTCP, "3306/3306"}},
+	"redis":    {{ProtocolTCP, "6379/6379"}},
+	"postgres": {{ProtocolTCP, "5432/5432"}},
+	"dns":      {{ProtocolUDP, "53/53"}, {ProtocolTCP, "53/53"}},
+	"ping":     {{ProtocolICMP, PortRangeAll}},
+	"echo":     {{ProtocolICMP, PortRangeAll}},
+}
+
+// IsProtocol reports whether name is a protocol known to Aliyun
+func IsProtocol(name string) bool {
+	return protocols[strings.ToUpper(name)]
+}
+
+// defaultPortRange returns the port range used when a protocol is given
+// without ports, or "all" is used as a port
+func defaultPortRange(ipProtocol string) string {
+	if ipProtocol == ProtocolTCP || ipProtocol == ProtocolUDP {
+		return PortRangeAllTCP
+	}
+	return PortRangeAll
+}
+
+// ServiceName returns the built-in service name for a protocol and port
+// range, or "" if there is none
+func ServiceName(ipProtocol string, portRange string) string {
+	ipProtocol = strings.ToUpper(ipProtocol)
+	if ipProtocol == ProtocolAll {
+		return "all"
+	}
+	for _, name := range builtinServiceNames {
+		ports := builtinServices[name]
+		if len(ports) == 1 && ports[0].IpProtocol == ipProtocol && ports[0].PortRange == portRange {
+			return name
+		}
+	}
+	return ""
+}
+
+// normalizePortRange validates a single port or port range and returns it
+// in Aliyun's "from/to" form
+func normalizePortRange(ipProtocol string, s string) (string, error) {
+	if strings.ToLower(s) == "all" || s == PortRangeAll {
+		return defaultPortRange(ipProtocol), nil
+	}
+
+	from, to, found := strings.Cut(s, "/")
+	if !found {
+		to = from
+	}
+	fromPort, err := strconv.Atoi(from)
+	if err != nil {
+		return "", fmt.Errorf("invalid port: %s", s)
+	}
+	toPort, err := strconv.Atoi(to)
+	if err != nil {
+		return "", fmt.Errorf("invalid port: %s", s)
+	}
+	if fromPort < 1 || toPort > 65535 || fromPort > toPort {
+		return "", fmt.Errorf("invalid port range: %s", s)
+	}
+	return fmt.Sprintf("%d/%d", fromPort, toPort), nil
+}
+
+// ParseServiceSpec resolves a service name such as "ssh", or a protocol
+// with ports such as "tcp/3306" or "tcp/8000/8100", as used in
+// configuration
+func ParseServiceSpec(spec string) ([]ServicePort, error) {
+	return NewParser().resolveService([]string{spec})
+}
+
+// ParsePortRange returns the first and last port of an Aliyun port range;
+// "-1/-1" covers every port
+func ParsePortRange(portRange string) (int, int, error) {
+	if portRange == PortRangeAll {
+		return 1, 65535, nil
+	}
+	from, to, found := strings.Cut(portRange, "/")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid port range: %s", portRange)
+	}
+	fromPort, err := strconv.Atoi(from)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range: %s", portRange)
+	}
+	toPort, err := strconv.Atoi(to)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range: %s", portRange)
+	}
+	return fromPort, toPort, nil
+}
+
+// Overlaps reports whether a rule with the given protocol and port range
+// matches any traffic of the service port
+func (s ServicePort) Overlaps(ipProtocol string, portRange string) bool {
+	ipProtocol = strings.ToUpper(ipProtocol)
+	if ipProtocol != ProtocolAll && s.IpProtocol != ProtocolAll && ipProtocol != s.IpProtocol {
+		return false
+	}
+
+	from, to, err := ParsePortRange(portRange)
+	if err != nil {
+		return false
+	}
+	serviceFrom, serviceTo, err := ParsePortRange(s.PortRange)
+	if err != nil {
+		return false
+	}
+	return from <= serviceTo && serviceFrom <= to
+}
+
+// Covers reports whether all the traffic of a rule with the given protocol
+// and port range is traffic of the service port
+func (s ServicePort) Covers(ipProtocol string, portRange string) bool {
+	ipProtocol = strings.ToUpper(ipProtocol)
+	if s.IpProtocol != ProtocolAll && ipProtocol != s.IpProtocol {
+		return false
+	}
+
+	from, to, err := ParsePortRange(portRange)
+	if err != nil {
+		return false
+	}
+	serviceFrom, serviceTo, err := ParsePortRange(s.PortRange)
+	if err != nil {
+		return false
+	}
+	return serviceFrom <= from && to <= serviceTo
+}
@@ -0,0 +1,248 @@
+package reloader
+
+import (
+	"aliyun-security-group-mgr/internal/utils"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Format names of rules files
+const (
+	FormatLine = "conf"
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+// FileFormat returns the format of a rules file from its extension; any
+// extension other than .yaml, .yml and .json is the line format
+func FileFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".json":
+		return FormatJSON
+	default:
+		return FormatLine
+	}
+}
+
+// StructuredDocument is a YAML or JSON rules file, see
+// schema/rules.schema.json
+type StructuredDocument struct {
+	Include []string         `json:"include,omitempty" yaml:"include,omitempty"`
+	Rules   []StructuredRule `json:"rules" yaml:"rules"`
+}
+
+// StructuredRule is a rule of a StructuredDocument. It expands into one
+// entry per port and cidr, like a rule line.
+type StructuredRule struct {
+	Policy    string `json:"policy" yaml:"policy"`
+	Direction string `json:"direction" yaml:"direction"`
+	// Protocol is a protocol or a service name
+	Protocol string `json:"protocol" yaml:"protocol"`
+	// Ports holds ports, port ranges and service names
+	Ports    []string `json:"ports,omitempty" yaml:"ports,omitempty,flow"`
+	Cidrs    []string `json:"cidrs" yaml:"cidrs,flow"`
+	Priority int      `json:"priority,omitempty" yaml:"priority,omitempty"`
+	// Until is an RFC 3339 time or "never", required like in rule lines
+	Until       string `json:"until" yaml:"until"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	// Aggregate set to false keeps the rule out of cidr aggregation
+	Aggregate *bool  `json:"aggregate,omitempty" yaml:"aggregate,omitempty"`
+	Owner     string `json:"owner,omitempty" yaml:"owner,omitempty"`
+}
+
+// structuredRule is a decoded rule with the line it starts at
+type structuredRule struct {
+	StructuredRule
+	line int
+}
+
+// decodeStructured decodes a YAML or JSON document, keeping the line of
+// each rule for provenance
+func decodeStructured(format string, data []byte) ([]string, []structuredRule, error) {
+	if format == FormatJSON && !json.Valid(data) {
+		var v interface{}
+		return nil, nil, json.Unmarshal(data, &v)
+	}
+
+	// strict decoding to report unknown fields
+	var doc StructuredDocument
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&doc); err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	// and again as nodes for the line numbers
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, nil, err
+	}
+	lines := ruleLines(&root)
+
+	rules := make([]structuredRule, len(doc.Rules))
+	for i, rule := range doc.Rules {
+		rules[i] = structuredRule{StructuredRule: rule}
+		if i < len(lines) {
+			rules[i].line = lines[i]
+		}
+	}
+	return doc.Include, rules, nil
+}
+
+// ruleLines returns the line of each item of the "rules" sequence
+func ruleLines(root *yaml.Node) []int {
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return nil
+	}
+	mapping := root.Content[0]
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value != "rules" {
+			continue
+		}
+		var lines []int
+		for _, item := range mapping.Content[i+1].Content {
+			lines = append(lines, item.Line)
+		}
+		return lines
+	}
+	return nil
+}
+
+// parseStructured turns a structured rule into entries using the same
+// resolution as rule lines
+func (p *Parser) parseStructured(rule StructuredRule) ([]Entry, error) {
+	if len(rule.Cidrs) == 0 {
+		return nil, fmt.Errorf("rule has no cidrs")
+	}
+
+	word := "from"
+	if strings.ToLower(rule.Direction) == "egress" {
+		word = "to"
+	}
+	parts := []string{rule.Policy, rule.Direction, rule.Protocol}
+	if len(rule.Ports) > 0 {
+		parts = append(parts, strings.Join(rule.Ports, ","))
+	}
+	parts = append(parts, word, strings.Join(rule.Cidrs, ","))
+	if rule.Priority != 0 {
+		parts = append(parts, "priority", strconv.Itoa(rule.Priority))
+	}
+	if rule.Until != "" {
+		parts = append(parts, "until", rule.Until)
+	}
+	if rule.Aggregate != nil && !*rule.Aggregate {
+		parts = append(parts, "aggregate", "no")
+	}
+	if rule.Owner != "" {
+		parts = append(parts, "owner", rule.Owner)
+	}
+	for _, part := range parts {
+		if part == "" || strings.ContainsAny(part, " \t#") {
+			return nil, fmt.Errorf("invalid rule field: %q", part)
+		}
+	}
+
+	return p.parseRule(parts, strings.TrimSpace(rule.Description))
+}
+
+// EncodeStructured encodes entries as a YAML or JSON document, grouping
+// them like WriteEntriesToFile
+func EncodeStructured(format string, entries []Entry) ([]byte, error) {
+	return encodeStructured(format, nil, entries)
+}
+
+func encodeStructured(format string, includes []string, entries []Entry) ([]byte, error) {
+	doc := StructuredDocument{Include: includes, Rules: []StructuredRule{}}
+	for _, group := range GroupEntries(entries) {
+		doc.Rules = append(doc.Rules, structuredFromGroup(group))
+	}
+
+	switch format {
+	case FormatJSON:
+		data, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	case FormatYAML:
+		var buf bytes.Buffer
+		encoder := yaml.NewEncoder(&buf)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(doc); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported structured format: %s", format)
+	}
+}
+
+func structuredFromGroup(group []Entry) StructuredRule {
+	head := group[0].SecurityGroup
+	rule := StructuredRule{
+		Policy:      strings.ToLower(head.Policy),
+		Direction:   head.Direction,
+		Protocol:    strings.ToLower(head.IpProtocol),
+		Description: head.Description,
+	}
+	for _, entry := range group {
+		rule.Cidrs = appendUnique(rule.Cidrs, entry.SecurityGroup.CidrIp)
+		if entry.SecurityGroup.PortRange != PortRangeAll {
+			rule.Ports = appendUnique(rule.Ports, entry.SecurityGroup.PortRange)
+		}
+	}
+	if priority, err := strconv.Atoi(head.Priority); err == nil && head.Priority != DefaultPriority {
+		rule.Priority = priority
+	}
+	rule.Until = formatUntil(group[0].ExpireAt)
+	if group[0].NoAggregate {
+		aggregate := false
+		rule.Aggregate = &aggregate
+	}
+	rule.Owner = group[0].Owner
+	return rule
+}
+
+// EncodeLines encodes entries in the line format, grouping them like
+// WriteEntriesToFile
+func EncodeLines(entries []Entry) []byte {
+	var buf bytes.Buffer
+	for _, group := range GroupEntries(entries) {
+		buf.WriteString(EncodeEntries(group) + "\n")
+	}
+	return buf.Bytes()
+}
+
+// EncodeFile encodes entries in the given format
+func EncodeFile(format string, entries []Entry) ([]byte, error) {
+	if format == FormatLine {
+		return EncodeLines(entries), nil
+	}
+	return EncodeStructured(format, entries)
+}
+
+// WriteEntriesToFile atomically replaces path with the entries, in the
+// format given by its extension and grouped into as few rules as possible
+func WriteEntriesToFile(path string, entries []Entry) error {
+	data, err := EncodeFile(FileFormat(path), entries)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path, data, 0644)
+}
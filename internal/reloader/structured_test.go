@@ -0,0 +1,157 @@
+package reloader
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const structuredTestRules = "define cidr office 203.0.113.0/24,198.51.100.7\n" +
+	"accept ingress ssh from @office until 2024-12-31T23:59:59+08:00 owner alice # SSH from office\n" +
+	"drop ingress tcp 80,443,8000/8100 from 10.0.0.0/8 priority 20 until never\n" +
+	"accept egress all to 0.0.0.0/0,::/0 priority 100 until never\n"
+
+func TestStructuredRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	linePath := filepath.Join(dir, "rules.conf")
+	writeFile(t, linePath, structuredTestRules)
+
+	want, err := ReadEntriesFromFile(linePath)
+	if err != nil {
+		t.Fatalf("ReadEntriesFromFile returned error: %v", err)
+	}
+
+	for _, name := range []string{"rules.yaml", "rules.json", "copy.conf"} {
+		path := filepath.Join(dir, name)
+		if err := WriteEntriesToFile(path, want); err != nil {
+			t.Fatalf("WriteEntriesToFile(%s) returned error: %v", name, err)
+		}
+		got, err := ReadEntriesFromFile(path)
+		if err != nil {
+			t.Fatalf("ReadEntriesFromFile(%s) returned error: %v", name, err)
+		}
+
+		if len(got) != len(want) {
+			t.Fatalf("%s: got %d entries; want %d", name, len(got), len(want))
+		}
+		for i := range want {
+			if !got[i].EqualContent(want[i]) || !got[i].ExpireAt.Equal(want[i].ExpireAt) || got[i].Owner != want[i].Owner {
+				t.Errorf("%s: entry %d = %s; want %s", name, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestStructuredProvenance(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.yaml")
+	writeFile(t, path, "include:\n"+
+		"  - extra.conf\n"+
+		"rules:\n"+
+		"  - policy: accept\n"+
+		"    direction: ingress\n"+
+		"    protocol: ssh\n"+
+		"    cidrs: [10.0.0.0/8]\n"+
+		"    until: never\n"+
+		"  - policy: accept\n"+
+		"    direction: ingress\n"+
+		"    protocol: tcp\n"+
+		"    ports: [80, https]\n"+
+		"    cidrs: [10.0.0.0/8]\n"+
+		"    until: never\n")
+	writeFile(t, filepath.Join(dir, "extra.conf"), "accept ingress rdp from 10.0.0.0/8 until never\n")
+
+	entries, err := ReadEntriesFromFile(path)
+	if err != nil {
+		t.Fatalf("ReadEntriesFromFile returned error: %v", err)
+	}
+
+	want := []string{
+		filepath.Join(dir, "extra.conf") + ":1: accept ingress tcp 3389/3389 (rdp) from 10.0.0.0/8 priority 1",
+		path + ":4: accept ingress tcp 22/22 (ssh) from 10.0.0.0/8 priority 1",
+		path + ":9: accept ingress tcp 80/80 (http) from 10.0.0.0/8 priority 1",
+		path + ":9: accept ingress tcp 443/443 (https) from 10.0.0.0/8 priority 1",
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries; want %d", len(entries), len(want))
+	}
+	for i := range want {
+		if entries[i].String() != want[i] {
+			t.Errorf("entry %d = %q; want %q", i, entries[i], want[i])
+		}
+	}
+}
+
+func TestStructuredErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"unknown.yaml", "rules:\n  - policy: accept\n    port: 22\n", "field port not found"},
+		{"bad.json", "{\"rules\": [", "unexpected end of JSON input"},
+		{"rule.json", "{\"rules\": [{\"policy\": \"accept\", \"direction\": \"ingress\", \"protocol\": \"tcp\", \"cidrs\": [\"10.0.0.0/8\"]}]}", "rule.json:1: missing port range"},
+	}
+
+	dir := t.TempDir()
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		writeFile(t, path, test.content)
+		_, err := ReadEntriesFromFile(path)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("ReadEntriesFromFile(%s) error = %v; want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestConvertFileKeepsIncludes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.conf")
+	writeFile(t, path, "# Office access\n"+structuredTestRules+"include teams/*.conf\n")
+	writeFile(t, filepath.Join(dir, "teams", "web.conf"), "accept ingress tcp 8080 from 10.0.0.0/8 until never\n")
+
+	data, warnings, err := ConvertFile(path, FormatYAML)
+	if err != nil {
+		t.Fatalf("ConvertFile returned error: %v", err)
+	}
+	if len(warnings) != 2 {
+		t.Errorf("ConvertFile warnings = %q; want one for the define and one for the comment", warnings)
+	}
+	converted := filepath.Join(dir, "rules.yaml")
+	writeFile(t, converted, string(data))
+	if !strings.Contains(string(data), "teams/*.conf") {
+		t.Errorf("converted file lost its include:\n%s", data)
+	}
+
+	want, err := ReadEntriesFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadEntriesFromFile(converted)
+	if err != nil {
+		t.Fatalf("ReadEntriesFromFile of the converted file returned error: %v", err)
+	}
+	// structured files load their includes before their rules
+	rules := make(map[string]int)
+	for _, entry := range want {
+		entry.Source = Source{}
+		rules[entry.String()]++
+	}
+	for _, entry := range got {
+		entry.Source = Source{}
+		rules[entry.String()]--
+	}
+	for rule, n := range rules {
+		if n != 0 {
+			t.Errorf("converted file has %d more of %s", -n, rule)
+		}
+	}
+
+	back, warnings, err := ConvertFile(converted, FormatLine)
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("ConvertFile back = %v, %q", err, warnings)
+	}
+	if !strings.HasPrefix(string(back), "include teams/*.conf\n") {
+		t.Errorf("converted back file does not start with its include:\n%s", back)
+	}
+}
@@ -0,0 +1,116 @@
+package reloader
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/ecs"
+
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TTLClass limits the lifetime of ingress accept rules matching its ports
+type TTLClass struct {
+	Name   string
+	Ports  []ServicePort
+	MaxTTL time.Duration
+}
+
+// TTLPolicy holds the maximum lifetimes per port class. Ingress accept rules
+// matching a class must expire, and within the class's maximum.
+type TTLPolicy struct {
+	classes []TTLClass
+	now     func() time.Time
+}
+
+// NewTTLPolicy builds a policy from service specs, as accepted by
+// ParseServiceSpec, mapped to their maximum lifetimes
+func NewTTLPolicy(classes map[string]time.Duration) (*TTLPolicy, error) {
+	p := &TTLPolicy{now: time.Now}
+	for name, maxTTL := range classes {
+		ports, err := ParseServiceSpec(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ttl class %s: %w", name, err)
+		}
+		if maxTTL <= 0 {
+			return nil, fmt.Errorf("invalid ttl for class %s: %s", name, maxTTL)
+		}
+		p.classes = append(p.classes, TTLClass{Name: name, Ports: ports, MaxTTL: maxTTL})
+	}
+	sort.Slice(p.classes, func(i, j int) bool {
+		return p.classes[i].Name < p.classes[j].Name
+	})
+	return p, nil
+}
+
+// TTLPolicyFromConfig returns the configured policy, or nil if no class
+// is configured
+func TTLPolicyFromConfig(config *conf.Ttl) (*TTLPolicy, error) {
+	if config == nil || len(config.Max) == 0 {
+		return nil, nil
+	}
+	return NewTTLPolicy(config.Max)
+}
+
+// Class returns the strictest class whose ports an ingress accept entry
+// overlaps, or nil. An entry for all traffic opens every port, so it falls
+// in the strictest class of all.
+func (p *TTLPolicy) Class(entry Entry) *TTLClass {
+	rule := entry.SecurityGroup
+	if rule.Policy != ecs.PolicyAccept || rule.Direction != ecs.DirectionIngress {
+		return nil
+	}
+
+	var strictest *TTLClass
+	for i, class := range p.classes {
+		for _, port := range class.Ports {
+			if port.Overlaps(rule.IpProtocol, rule.PortRange) {
+				if strictest == nil || class.MaxTTL < strictest.MaxTTL {
+					strictest = &p.classes[i]
+				}
+				break
+			}
+		}
+	}
+	return strictest
+}
+
+// Check returns an error if the entry outlives the class it matches
+func (p *TTLPolicy) Check(entry Entry) error {
+	class := p.Class(entry)
+	if class == nil {
+		return nil
+	}
+	if entry.ExpireAt.IsZero() {
+		return fmt.Errorf("%s rules must have an expiry within %s", class.Name, formatTTL(class.MaxTTL))
+	}
+	if ttl := entry.ExpireAt.Sub(p.now()); ttl > class.MaxTTL {
+		return fmt.Errorf("%s rules must expire within %s, this one expires at %s",
+			class.Name, formatTTL(class.MaxTTL), entry.ExpireAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Cap limits the expiry of an entry to its class's maximum from now,
+// returning the class when the expiry was changed
+func (p *TTLPolicy) Cap(entry *Entry) *TTLClass {
+	class := p.Class(*entry)
+	if class == nil {
+		return nil
+	}
+	latest := p.now().Add(class.MaxTTL)
+	if entry.ExpireAt.IsZero() || entry.ExpireAt.After(latest) {
+		entry.ExpireAt = latest
+		return class
+	}
+	return nil
+}
+
+// formatTTL prints whole days as such, e.g. 168h as 7d
+func formatTTL(ttl time.Duration) string {
+	if ttl >= 24*time.Hour && ttl%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", ttl/(24*time.Hour))
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(ttl.String(), "0s"), "0m")
+}
@@ -0,0 +1,99 @@
+package reloader
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTTLPolicyCheck(t *testing.T) {
+	policy, err := NewTTLPolicy(map[string]time.Duration{
+		"ssh":        24 * time.Hour,
+		"mysql":      7 * 24 * time.Hour,
+		"tcp/1/1024": 30 * 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("NewTTLPolicy returned error: %v", err)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	policy.now = func() time.Time { return now }
+
+	parser := NewParser()
+	parser.SetTTLPolicy(policy)
+
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"accept ingress ssh from 203.0.113.0/24 until 2026-01-02T00:00:00Z", ""},
+		{"accept ingress ssh from 203.0.113.0/24 until 2026-01-03T00:00:00Z", "ssh rules must expire within 1d"},
+		{"accept ingress ssh from 203.0.113.0/24 until never", "ssh rules must have an expiry within 1d"},
+		{"accept ingress mysql from 203.0.113.0/24 until 2026-01-05T00:00:00Z", ""},
+		{"accept ingress mysql from 203.0.113.0/24 until 2026-01-10T00:00:00Z", "mysql rules must expire within 7d"},
+		// the strictest class matching the ports applies
+		{"accept ingress tcp 1/100 from 203.0.113.0/24 until 2026-01-10T00:00:00Z", "ssh rules must expire within 1d"},
+		{"accept ingress http from 203.0.113.0/24 until 2026-01-10T00:00:00Z", ""},
+		{"accept ingress https from 0.0.0.0/0 until never", "tcp/1/1024 rules must have an expiry within 30d"},
+		{"accept ingress tcp 8080 from 0.0.0.0/0 until never", ""},
+		{"drop ingress ssh from 0.0.0.0/0 until never", ""},
+		// only what is opened to the instances is limited
+		{"accept egress ssh to 203.0.113.0/24 until never", ""},
+		{"accept egress all to 0.0.0.0/0 until never", ""},
+		// all traffic opens ssh too
+		{"accept ingress all from 0.0.0.0/0 until never", "ssh rules must have an expiry within 1d"},
+		{"accept ingress all from 0.0.0.0/0 until 2026-01-03T00:00:00Z", "ssh rules must expire within 1d"},
+		{"accept ingress tcp 1/65535 from 0.0.0.0/0 until 2026-01-03T00:00:00Z", "ssh rules must expire within 1d"},
+		{"accept ingress icmp from 10.0.0.0/8 until never", ""},
+	}
+	for _, tt := range tests {
+		_, err := parser.ParseLine(tt.line)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("ParseLine(%q) returned error: %v", tt.line, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ParseLine(%q) error = %v; want %q", tt.line, err, tt.want)
+		}
+	}
+}
+
+func TestTTLPolicyCap(t *testing.T) {
+	policy, err := NewTTLPolicy(map[string]time.Duration{"ssh": 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("NewTTLPolicy returned error: %v", err)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	policy.now = func() time.Time { return now }
+
+	entry, err := DecodeEntry("accept ingress ssh from 203.0.113.0/24 until 2026-02-01T00:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if class := policy.Cap(entry); class == nil || class.Name != "ssh" {
+		t.Fatalf("Cap returned %v; want the ssh class", class)
+	}
+	if want := now.Add(24 * time.Hour); !entry.ExpireAt.Equal(want) {
+		t.Errorf("capped ExpireAt = %s; want %s", entry.ExpireAt, want)
+	}
+	if class := policy.Cap(entry); class != nil {
+		t.Errorf("Cap of a rule within its ttl returned %s", class.Name)
+	}
+
+	// a rule for all traffic is capped like ssh
+	entry, err = DecodeEntry("accept ingress all from 0.0.0.0/0 until never")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if class := policy.Cap(entry); class == nil || class.Name != "ssh" {
+		t.Fatalf("Cap of all traffic returned %v; want the ssh class", class)
+	}
+	if want := now.Add(24 * time.Hour); !entry.ExpireAt.Equal(want) {
+		t.Errorf("capped ExpireAt of all traffic = %s; want %s", entry.ExpireAt, want)
+	}
+
+	if _, err := NewTTLPolicy(map[string]time.Duration{"nope": time.Hour}); err == nil {
+		t.Errorf("NewTTLPolicy accepted an unknown service")
+	}
+}
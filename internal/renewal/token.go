@@ -0,0 +1,65 @@
+package renewal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned for tokens that are malformed or were not
+// signed with the secret
+var ErrInvalidToken = errors.New("invalid renewal token")
+
+// Claims identify the rule a token renews, as it was when the reminder
+// was sent. Renewing changes its expiry, so a token renews once.
+type Claims struct {
+	// Rule is the rule's cidr, protocol, port and direction
+	Rule     string    `json:"rule"`
+	File     string    `json:"file"`
+	Line     int       `json:"line"`
+	ExpireAt time.Time `json:"expire_at"`
+	// Duration is what the rule is extended by
+	Duration time.Duration `json:"duration"`
+}
+
+// Sign returns a token of the claims, the base64url encoded claims and
+// their HMAC-SHA256 separated by a dot
+func Sign(secret []byte, claims Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac(secret, encoded)), nil
+}
+
+// Verify checks the signature of a token and returns its claims
+func Verify(secret []byte, token string) (*Claims, error) {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found {
+		return nil, ErrInvalidToken
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sum, mac(secret, encoded)) {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	return &claims, nil
+}
+
+func mac(secret []byte, encoded string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(encoded))
+	return h.Sum(nil)
+}
@@ -0,0 +1,44 @@
+package renewal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	claims := Claims{
+		Rule:     "10.0.0.0/8|tcp|22/22|ingress",
+		File:     "rules.conf",
+		Line:     3,
+		ExpireAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		Duration: 4 * time.Hour,
+	}
+	token, err := Sign([]byte("secret"), claims)
+	if err != nil {
+		t.Fatalf("Sign returned error: %v", err)
+	}
+
+	got, err := Verify([]byte("secret"), token)
+	if err != nil {
+		t.Fatalf("Verify returned error: %v", err)
+	}
+	if *got != claims {
+		t.Errorf("Verify = %+v; want %+v", got, claims)
+	}
+
+	other, _ := Sign([]byte("secret"), Claims{Rule: claims.Rule, Duration: 400 * time.Hour})
+	for _, tc := range []struct {
+		name   string
+		secret string
+		token  string
+	}{
+		{"other secret", "other", token},
+		{"no signature", "secret", token[:len(token)-44]},
+		{"swapped claims", "secret", other[:len(other)-43] + token[len(token)-43:]},
+		{"garbage", "secret", "abc.def"},
+	} {
+		if _, err := Verify([]byte(tc.secret), tc.token); err != ErrInvalidToken {
+			t.Errorf("%s: Verify = %v; want ErrInvalidToken", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/logging"
+	"aliyun-security-group-mgr/internal/optimizer"
+	"aliyun-security-group-mgr/internal/reloader"
+)
+
+// aggregateEntries merges the cidrs of the expected entries when enabled,
+// logging which rules file lines each merged rule comes from
+func (s *Service) aggregateEntries(entries []reloader.Entry) []reloader.Entry {
+	if s.Config.Sync.Aggregate == nil || !*s.Config.Sync.Aggregate {
+		return entries
+	}
+
+	mappings := optimizer.Aggregate(entries)
+	aggregated := make([]reloader.Entry, len(mappings))
+	for i, mapping := range mappings {
+		aggregated[i] = mapping.Entry
+		if mapping.Aggregated() {
+			s.logger().Info("aggregated rules", logging.KeyRule, entryKey(mapping.Entry), "mapping", mapping.String())
+		}
+	}
+	if len(aggregated) < len(entries) {
+		s.logger().Info("aggregated cidrs", "rules", len(entries), "aggregated", len(aggregated))
+	}
+	return aggregated
+}
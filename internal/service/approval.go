@@ -0,0 +1,308 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/audit"
+	"aliyun-security-group-mgr/internal/logging"
+	"aliyun-security-group-mgr/internal/notify"
+	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/state"
+
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrRequestNotFound = errors.New("access request not found")
+	ErrRequestDecided  = errors.New("access request already decided")
+	// ErrNoRequests is returned when rules need approval but no state is
+	// kept to hold the access requests
+	ErrNoRequests = errors.New("access requests need a state directory")
+
+	// errPendingApproval aborts the edit of rules that need approval
+	errPendingApproval = errors.New("pending approval")
+)
+
+// approvalPorts returns the services that need approval
+func (s *Service) approvalPorts() ([]reloader.ServicePort, error) {
+	if s.Config.Approval == nil {
+		return nil, nil
+	}
+	var ports []reloader.ServicePort
+	for _, spec := range s.Config.Approval.Ports {
+		servicePorts, err := reloader.ParseServiceSpec(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid approval port: %w", err)
+		}
+		ports = append(ports, servicePorts...)
+	}
+	return ports, nil
+}
+
+// needsApproval reports whether any of the rules opens traffic of a
+// service that needs approval
+func needsApproval(ports []reloader.ServicePort, entries []reloader.Entry) bool {
+	for _, entry := range entries {
+		for _, port := range ports {
+			if port.Overlaps(entry.SecurityGroup.IpProtocol, entry.SecurityGroup.PortRange) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pendingRules counts the rules of the pending requests of a requester
+func (s *Service) pendingRules(requester string) (int, error) {
+	if s.State == nil {
+		return 0, nil
+	}
+	st, err := s.State.Load()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, request := range st.Requests {
+		if request.Status == state.RequestPending && request.Requester == requester {
+			count += len(request.Rules)
+		}
+	}
+	return count, nil
+}
+
+// submitRequest keeps rules asked for as a pending access request and
+// notifies the approvers
+func (s *Service) submitRequest(entries []reloader.Entry, ttl time.Duration, requester string) (*state.AccessRequest, error) {
+	if s.State == nil {
+		return nil, ErrNoRequests
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	request := &state.AccessRequest{
+		Id:        hex.EncodeToString(id),
+		Ttl:       ttl,
+		Requester: requester,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		Status:    state.RequestPending,
+	}
+	for _, entry := range entries {
+		entry.ExpireAt, entry.Owner, entry.Source = time.Time{}, "", reloader.Source{}
+		request.Rules = append(request.Rules, reloader.EncodeEntry(entry))
+	}
+	if err := s.State.Update(func(st *state.State) {
+		st.Requests = append(st.Requests, request)
+	}); err != nil {
+		return nil, err
+	}
+
+	s.logger().Info("access request submitted", "request", request.Id, "actor", requester, "rules", len(request.Rules))
+	s.auditRequest(request, audit.ActionRequest, requester, entries)
+	s.notify(notify.Event{
+		Kind:    notify.EventAccessRequest,
+		Time:    request.CreatedAt,
+		Summary: fmt.Sprintf("%s requests access for %s, pending approval as %s", requester, ttl, request.Id),
+		Items:   request.Rules,
+	})
+	return request, nil
+}
+
+// Requests returns the access requests of a status, all when empty,
+// oldest first
+func (s *Service) Requests(status string) ([]*state.AccessRequest, error) {
+	if s.State == nil {
+		return nil, ErrNoRequests
+	}
+	st, err := s.State.Load()
+	if err != nil {
+		return nil, err
+	}
+	requests := []*state.AccessRequest{}
+	for _, request := range st.Requests {
+		if status == "" || request.Status == status {
+			requests = append(requests, request)
+		}
+	}
+	return requests, nil
+}
+
+// Request returns the access request of an id
+func (s *Service) Request(id string) (*state.AccessRequest, error) {
+	if s.State == nil {
+		return nil, ErrNoRequests
+	}
+	st, err := s.State.Load()
+	if err != nil {
+		return nil, err
+	}
+	request := st.Request(id)
+	if request == nil {
+		return nil, ErrRequestNotFound
+	}
+	return request, nil
+}
+
+// ApproveRequest writes the rules of a pending access request to the
+// watched file, owned by the requester and expiring after its ttl counted
+// from now, and asks for a sync. Requesters cannot approve their own
+// requests.
+func (s *Service) ApproveRequest(id string, comment string, actor string) (*state.AccessRequest, []reloader.Entry, string, error) {
+	s.decisions.Lock()
+	defer s.decisions.Unlock()
+
+	request, err := s.pendingRequest(id, actor)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	created, revision, _, err := s.createRules(func(doc *reloader.Document) ([]reloader.Entry, error) {
+		var entries []reloader.Entry
+		for _, line := range request.Rules {
+			lineEntries, err := parseRuleLine(doc, line)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, lineEntries...)
+		}
+		return entries, nil
+	}, request.Ttl, true, "", request.Requester, nil)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	request, err = s.decide(id, state.RequestApproved, comment, actor, func(request *state.AccessRequest) {
+		request.Revision = revision
+		for _, entry := range created {
+			if request.ExpireAt.IsZero() || entry.ExpireAt.Before(request.ExpireAt) {
+				request.ExpireAt = entry.ExpireAt
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	s.logger().Info("access request approved", "request", id, "actor", actor, "requester", request.Requester)
+	s.auditRequest(request, audit.ActionApprove, actor, created)
+	s.TriggerSync()
+	return request, created, revision, nil
+}
+
+// DenyRequest closes a pending access request without writing its rules
+func (s *Service) DenyRequest(id string, comment string, actor string) (*state.AccessRequest, error) {
+	s.decisions.Lock()
+	defer s.decisions.Unlock()
+
+	if _, err := s.pendingRequest(id, ""); err != nil {
+		return nil, err
+	}
+	request, err := s.decide(id, state.RequestDenied, comment, actor, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.logger().Info("access request denied", "request", id, "actor", actor, "requester", request.Requester)
+	s.auditRequest(request, audit.ActionDeny, actor, s.requestEntries(request))
+	return request, nil
+}
+
+// pendingRequest returns an access request the approver may decide on
+func (s *Service) pendingRequest(id string, approver string) (*state.AccessRequest, error) {
+	request, err := s.Request(id)
+	if err != nil {
+		return nil, err
+	}
+	if request.Status != state.RequestPending {
+		return nil, fmt.Errorf("%w: %s", ErrRequestDecided, request.Status)
+	}
+	if approver != "" && request.Requester == approver {
+		return nil, fmt.Errorf("%w: requests are approved by someone else than their requester", ErrForbidden)
+	}
+	return request, nil
+}
+
+// decide records the decision on an access request
+func (s *Service) decide(id string, status string, comment string, actor string, update func(request *state.AccessRequest)) (*state.AccessRequest, error) {
+	var decided state.AccessRequest
+	err := s.State.Update(func(st *state.State) {
+		request := st.Request(id)
+		if request == nil {
+			return
+		}
+		request.Status = status
+		request.DecidedBy = actor
+		request.DecidedAt = time.Now().UTC().Truncate(time.Second)
+		request.Comment = comment
+		if update != nil {
+			update(request)
+		}
+		decided = *request
+	})
+	if err != nil {
+		return nil, err
+	}
+	if decided.Id == "" {
+		return nil, ErrRequestNotFound
+	}
+	return &decided, nil
+}
+
+// requestEntries returns the rules of an access request, as parsed in the
+// watched file; none when they no longer parse
+func (s *Service) requestEntries(request *state.AccessRequest) []reloader.Entry {
+	if s.Config.Reloader.WatchPath == nil {
+		return nil
+	}
+	ruleset, err := s.LoadRules()
+	if err != nil {
+		return nil
+	}
+	doc, err := readDocument(ruleset, *s.Config.Reloader.WatchPath)
+	if err != nil {
+		return nil
+	}
+	var entries []reloader.Entry
+	for _, line := range request.Rules {
+		lineEntries, err := parseRuleLine(doc, line)
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, lineEntries...)
+	}
+	return entries
+}
+
+// auditRequest appends a step of an access request to the audit log, one
+// record per rule, or a single one when the rules are unknown
+func (s *Service) auditRequest(request *state.AccessRequest, action string, actor string, entries []reloader.Entry) {
+	if s.Audit == nil {
+		return
+	}
+	record := audit.Record{
+		Time:          time.Now(),
+		Action:        action,
+		Trigger:       audit.TriggerApproval,
+		Actor:         actor,
+		Owner:         request.Requester,
+		Revision:      request.Revision,
+		AccessRequest: request.Id,
+		Comment:       request.Comment,
+	}
+	if s.Config.SecurityGroup.Id != nil {
+		record.SecurityGroupId = *s.Config.SecurityGroup.Id
+	}
+	records := []audit.Record{record}
+	if len(entries) > 0 {
+		records = nil
+		for _, entry := range entries {
+			rule := entry.SecurityGroup
+			record.After = &rule
+			records = append(records, record)
+		}
+	}
+	for i := range records {
+		if err := s.Audit.Append(&records[i]); err != nil {
+			s.logger().Error("failed to append to the audit log", "request", request.Id, logging.KeyError, err)
+		}
+	}
+}
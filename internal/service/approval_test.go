@@ -0,0 +1,123 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/audit"
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/state"
+
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessRequests(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.conf")
+	rules := "define cidr home 198.51.100.7\n" +
+		"accept ingress tcp 443 from 0.0.0.0/0 until never # web\n"
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	auditPath := filepath.Join(dir, "audit.jsonl")
+	config := conf.NewConfig()
+	config.Reloader.WatchPath = &path
+	config.Approval.Ports = []string{"mysql", "rdp"}
+	s := &Service{Config: config, syncRequests: make(chan struct{}, 1)}
+	s.State = state.NewStore(filepath.Join(dir, "state"), 0)
+	s.Audit = audit.NewLog(auditPath, true)
+	limits := &Limits{}
+
+	// rules opening a service needing approval wait for it
+	created, _, pending, err := s.CreateRule("accept ingress tcp 443,3306 from @home", 2*time.Hour, "", "bob", limits)
+	if err != nil || created != nil || pending == nil || pending.Status != state.RequestPending || len(pending.Rules) != 2 {
+		t.Fatalf("CreateRule of mysql = %v, %v, %v; want a pending request of 2 rules", created, pending, err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != rules {
+		t.Errorf("rules file after a pending request:\n%s", data)
+	}
+	if _, _, pending, err := s.AllowIp(netip.MustParseAddr("203.0.113.7"), "ssh", time.Hour, "", "bob", limits); err != nil || pending != nil {
+		t.Errorf("AllowIp of ssh = %v, %v; want the rule written", pending, err)
+	}
+	if _, _, pending, err := s.CreateRule("accept ingress rdp from 10.0.0.0/8", time.Hour, "", "admin", nil); err != nil || pending != nil {
+		t.Errorf("CreateRule of rdp without limits = %v, %v; want the rule written", pending, err)
+	}
+
+	requests, err := s.Requests(state.RequestPending)
+	if err != nil || len(requests) != 1 || requests[0].Id != pending.Id {
+		t.Fatalf("pending requests = %v, %v; want the mysql request", requests, err)
+	}
+	if _, _, _, err := s.ApproveRequest(pending.Id, "", "bob"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("ApproveRequest by the requester = %v; want ErrForbidden", err)
+	}
+
+	approved, approvedRules, _, err := s.ApproveRequest(pending.Id, "for the migration", "carol")
+	if err != nil {
+		t.Fatalf("ApproveRequest returned error: %v", err)
+	}
+	if approved.Status != state.RequestApproved || approved.DecidedBy != "carol" || len(approvedRules) != 2 {
+		t.Errorf("approved request = %+v, %d rules; want approved by carol with 2 rules", approved, len(approvedRules))
+	}
+	// expiry counts from approval
+	if earliest := approved.DecidedAt.Add(2 * time.Hour); approved.ExpireAt.Before(earliest) {
+		t.Errorf("expiry = %s; want 2h after the approval at %s", approved.ExpireAt, approved.DecidedAt)
+	}
+	entries, err := reloader.ReadEntriesFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owned := 0
+	for _, entry := range entries {
+		if entry.Owner == "bob" && entry.SecurityGroup.CidrIp == "198.51.100.7/32" {
+			owned++
+		}
+	}
+	if owned != 2 {
+		t.Errorf("rules after approval = %v; want the 2 rules of bob", entries)
+	}
+	select {
+	case <-s.syncRequests:
+	default:
+		t.Errorf("no sync asked for after approval")
+	}
+	if _, _, _, err := s.ApproveRequest(pending.Id, "", "carol"); !errors.Is(err, ErrRequestDecided) {
+		t.Errorf("second ApproveRequest = %v; want ErrRequestDecided", err)
+	}
+
+	_, _, pending, err = s.CreateRule("accept ingress mysql from 10.0.0.0/8", time.Hour, "", "bob", limits)
+	if err != nil || pending == nil {
+		t.Fatalf("CreateRule of mysql = %v, %v; want a pending request", pending, err)
+	}
+	denied, err := s.DenyRequest(pending.Id, "too broad", "carol")
+	if err != nil || denied.Status != state.RequestDenied || denied.Comment != "too broad" {
+		t.Errorf("DenyRequest = %+v, %v; want denied with the comment", denied, err)
+	}
+
+	if count, err := audit.Verify(auditPath); err != nil || count != 6 {
+		t.Fatalf("Verify = %d, %v; want 6 records", count, err)
+	}
+	data, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record audit.Record
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Trigger != audit.TriggerApproval || record.Owner != "bob" || record.AccessRequest == "" || record.After == nil {
+			t.Errorf("audit record = %+v; want an approval step of a rule of bob", record)
+		}
+		actions = append(actions, record.Action+" by "+record.Actor)
+	}
+	want := "request by bob,request by bob,approve by carol,approve by carol,request by bob,deny by carol"
+	if got := strings.Join(actions, ","); got != want {
+		t.Errorf("audited steps = %s; want %s", got, want)
+	}
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/audit"
+	"aliyun-security-group-mgr/internal/ecs"
+	"aliyun-security-group-mgr/internal/logging"
+	"aliyun-security-group-mgr/internal/state"
+
+	"time"
+)
+
+// auditChange appends a change of a rule made by a sync to the audit log,
+// when one is configured; failing to append is only logged. owner is who
+// asked for the rule, if known.
+func (s *Service) auditChange(record *state.SyncRecord, trigger string, action string, before *ecs.SecurityGroupRule, after *ecs.SecurityGroupRule, owner string, requestId string, err error) {
+	if s.Audit == nil {
+		return
+	}
+	auditRecord := &audit.Record{
+		Time:      time.Now(),
+		Action:    action,
+		Before:    before,
+		After:     after,
+		Trigger:   trigger,
+		Actor:     record.Actor,
+		Owner:     owner,
+		Revision:  record.Revision,
+		SyncId:    record.SyncId,
+		RequestId: requestId,
+	}
+	if s.Config.SecurityGroup.Id != nil {
+		auditRecord.SecurityGroupId = *s.Config.SecurityGroup.Id
+	}
+	if err != nil {
+		auditRecord.Error = err.Error()
+	}
+	if appendErr := s.Audit.Append(auditRecord); appendErr != nil {
+		s.logger().Error("failed to append to the audit log", logging.KeySyncId, record.SyncId, logging.KeyError, appendErr)
+	}
+}
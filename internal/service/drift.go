@@ -0,0 +1,176 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/audit"
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/logging"
+	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/state"
+
+	"fmt"
+	"time"
+)
+
+// Kinds of drift between the live rules and the rules files
+const (
+	// DriftUnmanaged is a live rule no rules file has
+	DriftUnmanaged = "unmanaged"
+	// DriftModified is a live rule changed since it was synced
+	DriftModified = "modified"
+	// DriftMissing is a rule of the rules files that is not live
+	DriftMissing = "missing"
+)
+
+// What a drift check does about a kind of drift
+const (
+	DriftReport    = "report"
+	DriftRemediate = "remediate"
+)
+
+// Drift is a difference between the live rules and the rules files made
+// outside of the worker, e.g. in the Aliyun console
+type Drift struct {
+	Kind string
+	// Expected is the rule of the rules files, unset for unmanaged rules
+	Expected reloader.Entry
+	// Live is the live rule, unset for missing rules
+	Live reloader.Entry
+}
+
+func (d Drift) String() string {
+	switch d.Kind {
+	case DriftUnmanaged:
+		return fmt.Sprintf("unmanaged rule %s: %s", d.Live.SecurityGroup.Id, d.Live)
+	case DriftModified:
+		return fmt.Sprintf("modified rule %s: %s, expected: %s", d.Live.SecurityGroup.Id, d.Live, d.Expected)
+	default:
+		return fmt.Sprintf("missing rule: %s", d.Expected)
+	}
+}
+
+// driftModes returns the configured action of every kind of drift,
+// reporting by default
+func driftModes(config *conf.Drift) (map[string]string, error) {
+	result := make(map[string]string)
+	for kind, mode := range map[string]*string{
+		DriftUnmanaged: config.Unmanaged,
+		DriftModified:  config.Modified,
+		DriftMissing:   config.Missing,
+	} {
+		switch {
+		case mode == nil || *mode == "":
+			result[kind] = DriftReport
+		case *mode == DriftReport || *mode == DriftRemediate:
+			result[kind] = *mode
+		default:
+			return nil, fmt.Errorf("invalid drift mode for %s rules: %s", kind, *mode)
+		}
+	}
+	return result, nil
+}
+
+// classifyDrift turns the plan of a sync into drift. Live rules only
+// deleted because their expected entry expired are not drift.
+func classifyDrift(plan *Plan, expectedEntries []reloader.Entry) []Drift {
+	expectedEntriesMap := buildMap(expectedEntries)
+
+	var drift []Drift
+	for _, entry := range plan.Add {
+		drift = append(drift, Drift{Kind: DriftMissing, Expected: entry})
+	}
+	for _, update := range plan.Update {
+		drift = append(drift, Drift{Kind: DriftModified, Expected: update.New, Live: update.Old})
+	}
+	for _, entry := range plan.Delete {
+		if _, exists := expectedEntriesMap[entryKey(entry)]; !exists {
+			drift = append(drift, Drift{Kind: DriftUnmanaged, Live: entry})
+		}
+	}
+	return drift
+}
+
+// remediationPlan keeps the changes of a plan undoing the drift configured
+// to be remediated, in the order of the plan
+func remediationPlan(drift []Drift, modes map[string]string) *Plan {
+	plan := &Plan{}
+	for _, d := range drift {
+		if modes[d.Kind] != DriftRemediate {
+			continue
+		}
+		switch d.Kind {
+		case DriftMissing:
+			plan.Add = append(plan.Add, d.Expected)
+		case DriftModified:
+			plan.Update = append(plan.Update, Update{Old: d.Live, New: d.Expected})
+		case DriftUnmanaged:
+			plan.Delete = append(plan.Delete, d.Live)
+		}
+	}
+	return plan
+}
+
+// detectDrift compares the live rules with the expected entries as a sync
+// would, and returns the drift with the live entries compared
+func (s *Service) detectDrift(expectedEntries []reloader.Entry) ([]Drift, []reloader.Entry, error) {
+	expectedEntries, err := s.prepareEntries(expectedEntries)
+	if err != nil {
+		return nil, nil, err
+	}
+	currentEntries, err := s.getCurrentEntries()
+	if err != nil {
+		return nil, nil, err
+	}
+	plan := buildPlan(expectedEntries, currentEntries, time.Now())
+	return classifyDrift(plan, expectedEntries), currentEntries, nil
+}
+
+// DetectDrift reports the differences between the live rules and the
+// expected entries, without changing anything
+func (s *Service) DetectDrift(expectedEntries []reloader.Entry) ([]Drift, error) {
+	drift, _, err := s.detectDrift(expectedEntries)
+	return drift, err
+}
+
+// checkDrift checks the live rules against the rules files last loaded
+func (s *Service) checkDrift() error {
+	// nothing is known to be managed before the rules files are loaded
+	expectedEntries, revision := s.Reloader.GetExpected()
+	if revision == "" {
+		return nil
+	}
+
+	return s.remediateDrift(expectedEntries, revision)
+}
+
+// remediateDrift logs the drift from the expected entries of a revision,
+// and undoes the kinds of drift configured to be remediated
+func (s *Service) remediateDrift(expectedEntries []reloader.Entry, revision string) error {
+	drift, currentEntries, err := s.detectDrift(expectedEntries)
+	if err != nil {
+		s.logger().Error("drift check failed", logging.KeyError, err)
+		return err
+	}
+	for _, d := range drift {
+		rule := d.Live
+		if d.Kind == DriftMissing {
+			rule = d.Expected
+		}
+		s.logger().Warn("drift detected", "kind", d.Kind, "mode", s.driftModes[d.Kind], logging.KeyRule, entryKey(rule), "drift", d.String())
+	}
+	s.notifyDrift(drift)
+
+	plan := remediationPlan(drift, s.driftModes)
+	if plan.Empty() {
+		return nil
+	}
+	now := time.Now()
+	record := &state.SyncRecord{
+		SyncId:    state.NewSyncId(now),
+		StartedAt: now,
+		Actor:     s.actor(),
+		Trigger:   audit.TriggerDrift,
+		Revision:  revision,
+	}
+	s.logger().Info("remediating drift", logging.KeySyncId, record.SyncId)
+	return s.executePlan(plan, currentEntries, record)
+}
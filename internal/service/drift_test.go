@@ -0,0 +1,89 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+
+	"testing"
+)
+
+func TestDriftModes(t *testing.T) {
+	remediate, invalid := DriftRemediate, "fix"
+	modes, err := driftModes(&conf.Drift{Missing: &remediate})
+	if err != nil {
+		t.Fatalf("driftModes returned error: %v", err)
+	}
+	if modes[DriftMissing] != DriftRemediate || modes[DriftUnmanaged] != DriftReport || modes[DriftModified] != DriftReport {
+		t.Errorf("driftModes = %v; want only missing rules remediated", modes)
+	}
+	if _, err := driftModes(&conf.Drift{Unmanaged: &invalid}); err == nil {
+		t.Errorf("driftModes should reject an unknown mode")
+	}
+}
+
+func TestRemediateDrift(t *testing.T) {
+	live := decodeEntries(t,
+		"accept ingress ssh from 10.0.0.0/8 priority 10 until never # managed",
+		"accept ingress http from 0.0.0.0/0 priority 1 until never # modified in the console",
+		"accept ingress rdp from 0.0.0.0/0 priority 1 until never # added in the console",
+		"accept ingress https from 192.0.2.0/24 until 2025-01-01T00:00:00Z # expired",
+	)
+	expected := decodeEntries(t,
+		"accept ingress ssh from 10.0.0.0/8 priority 10 until never # managed",
+		"accept ingress http from 0.0.0.0/0 priority 5 until never # modified in the console",
+		"accept ingress mysql from 10.0.0.0/8 priority 1 until never # deleted in the console",
+		"accept ingress https from 192.0.2.0/24 until 2025-01-01T00:00:00Z # expired",
+	)
+
+	s, fake := newFakeService(t, live)
+	drift, err := s.DetectDrift(expected)
+	if err != nil {
+		t.Fatalf("DetectDrift returned error: %v", err)
+	}
+	want := map[string]string{
+		DriftMissing:   "3306/3306",
+		DriftModified:  "80/80",
+		DriftUnmanaged: "3389/3389",
+	}
+	if len(drift) != len(want) {
+		t.Fatalf("DetectDrift = %v; want %d differences", drift, len(want))
+	}
+	for _, d := range drift {
+		portRange := d.Live.SecurityGroup.PortRange
+		if d.Kind == DriftMissing {
+			portRange = d.Expected.SecurityGroup.PortRange
+		}
+		if want[d.Kind] != portRange {
+			t.Errorf("drift %s is %s; want %s", d, d.Kind, want[d.Kind])
+		}
+	}
+	if len(fake.Snapshots) != 0 {
+		t.Errorf("DetectDrift changed the live rules")
+	}
+
+	// reporting only changes nothing
+	s.driftModes, _ = driftModes(&conf.Drift{})
+	if err := s.remediateDrift(expected, "abc"); err != nil {
+		t.Fatalf("remediateDrift returned error: %v", err)
+	}
+	if len(fake.Snapshots) != 0 {
+		t.Errorf("remediateDrift changed the live rules while reporting only")
+	}
+
+	// unmanaged rules are removed, the rest is left to report
+	remediate := DriftRemediate
+	s.driftModes, _ = driftModes(&conf.Drift{Unmanaged: &remediate})
+	if err := s.remediateDrift(expected, "abc"); err != nil {
+		t.Fatalf("remediateDrift returned error: %v", err)
+	}
+	if len(fake.Rules) != 3 {
+		t.Fatalf("remediateDrift left %d rules; want 3", len(fake.Rules))
+	}
+	for _, rule := range fake.Rules {
+		if rule.PortRange == "3389/3389" {
+			t.Errorf("unmanaged rule %s was not removed", rule.Id)
+		}
+		if rule.PortRange == "80/80" && rule.Priority != "1" {
+			t.Errorf("modified rule %s was remediated", rule.Id)
+		}
+	}
+}
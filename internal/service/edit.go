@@ -0,0 +1,370 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/ecs"
+	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/state"
+
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+var (
+	ErrRuleNotFound = errors.New("rule not found")
+	ErrRuleExists   = errors.New("a rule for the same cidr, protocol, port and direction exists")
+	ErrInvalidRule  = errors.New("invalid rule")
+	// ErrRevisionMismatch is returned when the rules files are not at the
+	// revision a change was based on, or were edited during the change
+	ErrRevisionMismatch = errors.New("the rules files changed")
+	ErrNotEditable      = errors.New("only rules files in the line format can be edited")
+	ErrNoSync           = errors.New("no sync recorded")
+)
+
+// RuleId identifies an expected entry by its cidr, protocol, port and
+// direction, which are unique among the rules synced
+func RuleId(entry reloader.Entry) string {
+	sum := sha256.Sum256([]byte(entryKey(entry)))
+	return hex.EncodeToString(sum[:6])
+}
+
+// LoadRules reads the rules files the worker watches
+func (s *Service) LoadRules() (*reloader.Ruleset, error) {
+	if s.Config.Reloader.WatchPath == nil || *s.Config.Reloader.WatchPath == "" {
+		return nil, fmt.Errorf("no watch path configured")
+	}
+	return reloader.LoadRules(*s.Config.Reloader.WatchPath)
+}
+
+// FindRule returns the rule of an id and the revision of the rules files
+func (s *Service) FindRule(id string) (*reloader.Entry, string, error) {
+	ruleset, err := s.LoadRules()
+	if err != nil {
+		return nil, "", err
+	}
+	entry, err := findRule(ruleset, id)
+	return entry, ruleset.Revision, err
+}
+
+func findRule(ruleset *reloader.Ruleset, id string) (*reloader.Entry, error) {
+	for i, entry := range ruleset.Entries {
+		if RuleId(entry) == id {
+			return &ruleset.Entries[i], nil
+		}
+	}
+	return nil, ErrRuleNotFound
+}
+
+// editRules applies an edit to a rules file and returns the new revision
+// of the rules files. The edit gets the rules files as loaded and returns
+// the document it changed. With a revision given, the rules files must be
+// at it; either way they must not change while the edit is made, be it by
+// a person or another edit, or ErrRevisionMismatch is returned.
+func (s *Service) editRules(revision string, edit func(ruleset *reloader.Ruleset) (*reloader.Document, error)) (string, error) {
+	s.edits.Lock()
+	defer s.edits.Unlock()
+
+	ruleset, err := s.LoadRules()
+	if err != nil {
+		return "", err
+	}
+	if revision != "" && revision != ruleset.Revision {
+		return "", ErrRevisionMismatch
+	}
+	doc, err := edit(ruleset)
+	if err != nil {
+		return "", err
+	}
+
+	current, err := s.LoadRules()
+	if err != nil {
+		return "", err
+	}
+	if current.Revision != ruleset.Revision {
+		return "", ErrRevisionMismatch
+	}
+	if err := doc.WriteFile(); err != nil {
+		return "", err
+	}
+	edited, err := s.LoadRules()
+	if err != nil {
+		return "", err
+	}
+	return edited.Revision, nil
+}
+
+// readDocument reads a rules file of a ruleset to edit it, resolving the
+// aliases in scope in the ruleset
+func readDocument(ruleset *reloader.Ruleset, path string) (*reloader.Document, error) {
+	if reloader.FileFormat(path) != reloader.FormatLine {
+		return nil, ErrNotEditable
+	}
+	doc, err := reloader.ReadDocument(path)
+	if err != nil {
+		return nil, err
+	}
+	doc.SetRuleset(ruleset)
+	return doc, nil
+}
+
+// CreateRule appends a temporary rule to the watched file, expiring after
+// ttl, owned by the actor. The line may use the aliases defined in the
+// file and expand into several rules, none of which may exist already or
+// go beyond the limits of the actor. Rules needing approval are not
+// written but returned as a pending access request.
+func (s *Service) CreateRule(line string, ttl time.Duration, revision string, actor string, limits *Limits) ([]reloader.Entry, string, *state.AccessRequest, error) {
+	if strings.ContainsAny(line, "\r\n") {
+		return nil, "", nil, fmt.Errorf("%w: a rule is a single line", ErrInvalidRule)
+	}
+	return s.createRules(func(doc *reloader.Document) ([]reloader.Entry, error) {
+		return parseRuleLine(doc, line)
+	}, ttl, false, revision, actor, limits)
+}
+
+// parseRuleLine parses a rule line as if it ended a rules file, so that it
+// may use the aliases the file defines. The expiry of the rules comes from
+// their ttl, so the line needs no until clause.
+func parseRuleLine(doc *reloader.Document, line string) ([]reloader.Entry, error) {
+	n := doc.Len() + 1
+	if err := doc.InsertLine(n, reloader.WithUntil(line, reloader.UntilNever)); err != nil {
+		return nil, err
+	}
+	defer doc.RemoveLine(n)
+	entries, err := doc.Entries(n)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRule, errors.Unwrap(err))
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidRule, line)
+	}
+	return entries, nil
+}
+
+// AllowIp opens a service, as accepted by reloader.ParseServiceSpec, to a
+// single address for ttl, capped by the allow-me maximum and the TTL
+// policy. The rules are owned by
+// the actor and described as asked for by them.
+func (s *Service) AllowIp(addr netip.Addr, serviceSpec string, ttl time.Duration, revision string, actor string, limits *Limits) ([]reloader.Entry, string, *state.AccessRequest, error) {
+	servicePorts, err := reloader.ParseServiceSpec(serviceSpec)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+	}
+	if maxTtl := s.Config.Api.AllowMaxTtl; maxTtl != nil && *maxTtl > 0 && ttl > *maxTtl {
+		ttl = *maxTtl
+	}
+	addr = addr.Unmap()
+	cidrIp := netip.PrefixFrom(addr, addr.BitLen()).String()
+	return s.createRules(func(doc *reloader.Document) ([]reloader.Entry, error) {
+		var entries []reloader.Entry
+		for _, servicePort := range servicePorts {
+			entries = append(entries, reloader.Entry{
+				SecurityGroup: ecs.SecurityGroupRule{
+					Policy:      ecs.PolicyAccept,
+					Direction:   ecs.DirectionIngress,
+					IpProtocol:  servicePort.IpProtocol,
+					PortRange:   servicePort.PortRange,
+					CidrIp:      cidrIp,
+					Priority:    reloader.DefaultPriority,
+					Description: "allow-me by " + actor,
+				},
+			})
+		}
+		return entries, nil
+	}, ttl, true, revision, actor, limits)
+}
+
+// createRules appends the rules made by parse to the watched file,
+// expiring after ttl and owned by the actor. The TTL policy and the
+// maximum ttl of the actor either cap their expiry or refuse them; the
+// rest of the limits of the actor are checked before the file is written,
+// so that nothing they do not allow reaches a sync. Rules opening a service
+// that needs approval to an actor with limits are kept in an access request
+// instead, returned pending.
+func (s *Service) createRules(parse func(doc *reloader.Document) ([]reloader.Entry, error), ttl time.Duration, capTtl bool, revision string, actor string, limits *Limits) ([]reloader.Entry, string, *state.AccessRequest, error) {
+	if ttl <= 0 {
+		return nil, "", nil, fmt.Errorf("%w: temporary rules need a positive ttl", ErrInvalidRule)
+	}
+	ttl, err := limits.capTtl(ttl, capTtl)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	// the owner is written in the rule line
+	if actor == "" || strings.ContainsAny(actor, " \t#") {
+		return nil, "", nil, fmt.Errorf("%w: invalid owner %q", ErrInvalidRule, actor)
+	}
+	approvalPorts, err := s.approvalPorts()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	pending := 0
+	if limits != nil {
+		if pending, err = s.pendingRules(actor); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	var created, requested []reloader.Entry
+	revision, err = s.editRules(revision, func(ruleset *reloader.Ruleset) (*reloader.Document, error) {
+		doc, err := readDocument(ruleset, *s.Config.Reloader.WatchPath)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := parse(doc)
+		if err != nil {
+			return nil, err
+		}
+		if err := limits.checkCount(ruleset, actor, len(entries)+pending); err != nil {
+			return nil, err
+		}
+
+		existing := buildMap(ruleset.Entries)
+		expireAt := time.Now().Add(ttl).UTC().Truncate(time.Second)
+		ttlPolicy, err := reloader.TTLPolicyFromConfig(s.Config.Ttl)
+		if err != nil {
+			return nil, err
+		}
+		for i := range entries {
+			if _, ok := existing[entryKey(entries[i])]; ok {
+				return nil, fmt.Errorf("%w: %s", ErrRuleExists, entryKey(entries[i]))
+			}
+			if err := limits.checkEntry(entries[i]); err != nil {
+				return nil, err
+			}
+			entries[i].ExpireAt = expireAt
+			entries[i].Owner = actor
+			if ttlPolicy == nil {
+				continue
+			}
+			if capTtl {
+				if ttlPolicy.Cap(&entries[i]) != nil {
+					entries[i].ExpireAt = entries[i].ExpireAt.UTC().Truncate(time.Second)
+				}
+			} else if err := ttlPolicy.Check(entries[i]); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+			}
+		}
+		if limits != nil && needsApproval(approvalPorts, entries) {
+			requested = entries
+			return nil, errPendingApproval
+		}
+		for _, group := range reloader.GroupEntries(entries) {
+			n := doc.Len() + 1
+			if err := doc.InsertLine(n, reloader.EncodeEntries(group)); err != nil {
+				return nil, err
+			}
+			for _, entry := range group {
+				entry.Source = reloader.Source{File: doc.Path, Line: n}
+				created = append(created, entry)
+			}
+		}
+		return doc, nil
+	})
+	if errors.Is(err, errPendingApproval) {
+		request, err := s.submitRequest(requested, ttl, actor)
+		return nil, "", request, err
+	}
+	if err != nil {
+		return nil, "", nil, err
+	}
+	for _, entry := range created {
+		s.logger().Info("rule created", "rule", entry.String(), "actor", actor)
+	}
+	return created, revision, nil, nil
+}
+
+// DeleteRule removes the rule of an id from its rules file. Other rules
+// written on the same line are kept. Actors with limits may only remove
+// the rules they own.
+func (s *Service) DeleteRule(id string, revision string, actor string, limits *Limits) (string, error) {
+	var deleted *reloader.Entry
+	revision, err := s.editRules(revision, func(ruleset *reloader.Ruleset) (*reloader.Document, error) {
+		entry, err := findRule(ruleset, id)
+		if err != nil {
+			return nil, err
+		}
+		if err := limits.checkOwner(*entry, actor); err != nil {
+			return nil, err
+		}
+		doc, err := readDocument(ruleset, entry.Source.File)
+		if err != nil {
+			return nil, err
+		}
+		if err := doc.RemoveRule(*entry); err != nil {
+			return nil, err
+		}
+		deleted = entry
+		return doc, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	s.logger().Info("rule deleted", "rule", deleted.String(), "actor", actor)
+	return revision, nil
+}
+
+// RenewRule extends the rule of an id by duration, or by what renewal
+// links extend it by when duration is 0. Actors with limits may only renew
+// the rules they own, up to their maximum ttl from now.
+func (s *Service) RenewRule(id string, duration time.Duration, revision string, actor string, limits *Limits) (*reloader.Entry, string, error) {
+	var renewed *reloader.Entry
+	revision, err := s.editRules(revision, func(ruleset *reloader.Ruleset) (*reloader.Document, error) {
+		entry, err := findRule(ruleset, id)
+		if err != nil {
+			return nil, err
+		}
+		if entry.ExpireAt.IsZero() {
+			return nil, fmt.Errorf("%w: the rule does not expire", ErrInvalidRule)
+		}
+		if err := limits.checkOwner(*entry, actor); err != nil {
+			return nil, err
+		}
+		if duration <= 0 {
+			var st *state.State
+			if s.State != nil {
+				st, _ = s.State.Load()
+			}
+			duration = s.renewalDuration(*entry, st)
+		}
+		if duration, err = limits.capRenewal(*entry, duration); err != nil {
+			return nil, err
+		}
+		doc, err := readDocument(ruleset, entry.Source.File)
+		if err != nil {
+			return nil, err
+		}
+		renewed, err = s.renewEntry(doc, *entry, duration)
+		return doc, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	s.logger().Info("rule renewed", "rule", renewed.String(), "actor", actor)
+	return renewed, revision, nil
+}
+
+// TriggerSync asks the worker to reload and sync the rules files now; a
+// sync already asked for and not started yet covers it
+func (s *Service) TriggerSync() {
+	select {
+	case s.syncRequests <- struct{}{}:
+	default:
+	}
+}
+
+// LastSync returns the record of the last sync
+func (s *Service) LastSync() (*state.SyncRecord, error) {
+	if s.State == nil {
+		return nil, ErrNoSync
+	}
+	st, err := s.State.Load()
+	if err != nil {
+		return nil, err
+	}
+	if len(st.History) == 0 {
+		return nil, ErrNoSync
+	}
+	return st.History[len(st.History)-1], nil
+}
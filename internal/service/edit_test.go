@@ -0,0 +1,82 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEditRules(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.conf")
+	rules := "define cidr home 198.51.100.7\n" +
+		"accept ingress tcp 443 from 0.0.0.0/0 until never # web\n"
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := conf.NewConfig()
+	config.Reloader.WatchPath = &path
+	s := &Service{Config: config}
+
+	ruleset, err := s.LoadRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, revision, _, err := s.CreateRule("accept ingress tcp 22,3389 from @home", 4*time.Hour, ruleset.Revision, "alice", nil)
+	if err != nil {
+		t.Fatalf("CreateRule returned error: %v", err)
+	}
+	if len(created) != 2 || created[0].Owner != "alice" || created[0].ExpireAt.IsZero() || revision == ruleset.Revision {
+		t.Errorf("CreateRule = %v, %s; want 2 rules owned by alice and a new revision", created, revision)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.HasPrefix(string(data), rules) || !strings.Contains(string(data), "from 198.51.100.7/32 priority 1 until ") ||
+		!strings.Contains(string(data), " owner alice\n") {
+		t.Errorf("rules file after CreateRule:\n%s", data)
+	}
+
+	for _, tc := range []struct {
+		line     string
+		ttl      time.Duration
+		revision string
+		want     error
+	}{
+		{"accept ingress ssh from @home until never", time.Hour, "", ErrRuleExists},
+		{"accept ingress ssh from 10.0.0.0/8 until never", time.Hour, ruleset.Revision, ErrRevisionMismatch},
+		{"accept ingress ssh from @office until never", time.Hour, "", ErrInvalidRule},
+		{"accept ingress ssh from 10.0.0.0/8 until never", 0, "", ErrInvalidRule},
+		{"accept ingress ssh from 10.0.0.0/8 until never\ninclude /etc/passwd", time.Hour, "", ErrInvalidRule},
+	} {
+		if _, _, _, err := s.CreateRule(tc.line, tc.ttl, tc.revision, "alice", nil); !errors.Is(err, tc.want) {
+			t.Errorf("CreateRule(%q) = %v; want %v", tc.line, err, tc.want)
+		}
+	}
+
+	renewed, revision, err := s.RenewRule(RuleId(created[0]), 2*time.Hour, revision, "alice", nil)
+	if err != nil {
+		t.Fatalf("RenewRule returned error: %v", err)
+	}
+	if want := created[0].ExpireAt.Add(2 * time.Hour); !renewed.ExpireAt.Equal(want) {
+		t.Errorf("renewed expiry = %s; want %s", renewed.ExpireAt, want)
+	}
+
+	if _, err := s.DeleteRule(RuleId(created[0]), revision, "alice", nil); err != nil {
+		t.Fatalf("DeleteRule returned error: %v", err)
+	}
+	entries, err := reloader.ReadEntriesFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entryKey(entries[1]) != entryKey(created[1]) || !entries[1].ExpireAt.Equal(renewed.ExpireAt) {
+		t.Errorf("rules after DeleteRule = %v; want https and the renewed rdp rule", entries)
+	}
+	if _, err := s.DeleteRule(RuleId(created[0]), "", "alice", nil); !errors.Is(err, ErrRuleNotFound) {
+		t.Errorf("second DeleteRule = %v; want ErrRuleNotFound", err)
+	}
+}
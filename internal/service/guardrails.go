@@ -0,0 +1,42 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/logging"
+	"aliyun-security-group-mgr/internal/notify"
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"fmt"
+)
+
+// applyGuardrails checks the expected entries before a sync. In block mode
+// any violation refuses the sync; in skip mode the offending entries are
+// left out, so they are not added, or removed if they are live.
+func (s *Service) applyGuardrails(entries []reloader.Entry) ([]reloader.Entry, error) {
+	if s.Guard == nil {
+		return entries, nil
+	}
+
+	allowed, violations := s.Guard.Filter(entries)
+	if len(violations) == 0 {
+		s.notifyChanged(notify.Event{Kind: notify.EventGuardrail})
+		return entries, nil
+	}
+
+	items := make([]string, len(violations))
+	for i, violation := range violations {
+		s.logger().Warn("guardrail violation", "policy", violation.Policy, logging.KeyRule, entryKey(violation.Entry), "violation", violation.String())
+		items[i] = violation.String()
+	}
+	event := notify.Event{Kind: notify.EventGuardrail, Items: items}
+	if s.Guard.Blocking() {
+		s.logger().Error("sync blocked by guardrail violations", "violations", len(violations))
+		event.Summary = fmt.Sprintf("sync blocked by %d guardrail violations", len(violations))
+		s.notifyChanged(event)
+		return nil, fmt.Errorf("sync blocked by %d guardrail violations", len(violations))
+	}
+
+	s.logger().Warn("skipping rules violating guardrails", "rules", len(entries)-len(allowed))
+	event.Summary = fmt.Sprintf("skipping %d rules violating guardrails", len(entries)-len(allowed))
+	s.notifyChanged(event)
+	return allowed, nil
+}
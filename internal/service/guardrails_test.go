@@ -0,0 +1,39 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/guard"
+
+	"testing"
+)
+
+func TestGuardrailsIgnoreExpiredRules(t *testing.T) {
+	live := decodeEntries(t,
+		"accept ingress ssh from 0.0.0.0/0 until never",
+		"accept ingress https from 0.0.0.0/0 until never",
+	)
+	// the world-open ssh rule expired: the sync revoking it is not blocked
+	expected := decodeEntries(t,
+		"accept ingress ssh from 0.0.0.0/0 until 2025-01-01T00:00:00Z",
+		"accept ingress https from 0.0.0.0/0 until never",
+	)
+
+	s, fake := newFakeService(t, live)
+	mode := guard.ModeBlock
+	g, err := guard.NewGuard(&conf.Guard{Mode: &mode, AdminPorts: []string{"ssh"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Guard = g
+	if err := s.syncEntries(expected, syncCause{actor: "test"}); err != nil {
+		t.Fatalf("syncEntries returned error: %v", err)
+	}
+	if len(fake.Rules) != 1 || fake.Rules[0].PortRange != "443/443" {
+		t.Errorf("rules after sync = %+v; want only https", fake.Rules)
+	}
+
+	expected = decodeEntries(t, "accept ingress ssh from 0.0.0.0/0 until never")
+	if err := s.syncEntries(expected, syncCause{actor: "test"}); err == nil {
+		t.Errorf("syncEntries of an unexpired world-open ssh rule was not blocked")
+	}
+}
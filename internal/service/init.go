@@ -2,7 +2,9 @@ package service
 
 import (
 	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/logging"
 	"flag"
+	"os"
 )
 
 var (
@@ -22,6 +24,10 @@ func Init() (*Service, error) {
 		return nil, err
 	}
 
+	if err := logging.Setup(config, os.Stderr); err != nil {
+		return nil, err
+	}
+
 	service, err := NewService(config)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/ecs"
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+var (
+	// ErrForbidden is returned when a user asks for a change their limits do not allow
+	ErrForbidden = errors.New("not allowed")
+	// ErrLimitExceeded is returned when a user already owns as many
+	// temporary rules as they may
+	ErrLimitExceeded = errors.New("too many temporary rules")
+)
+
+// Limits restrict the changes a user of the API may make. A nil *Limits
+// allows any change.
+type Limits struct {
+	// Ports the rules may open, any when empty
+	Ports []reloader.ServicePort
+	// Cidrs the rules may open to, any when empty
+	Cidrs []netip.Prefix
+	// MaxTtl is the longest a rule may last, unlimited when 0
+	MaxTtl time.Duration
+	// MaxRules is how many unexpired temporary rules the user may own at
+	// once, unlimited when 0
+	MaxRules int
+}
+
+// capTtl returns ttl, capped by the maximum ttl with capTtl, or refused
+// above it otherwise
+func (l *Limits) capTtl(ttl time.Duration, capTtl bool) (time.Duration, error) {
+	if l == nil || l.MaxTtl <= 0 || ttl <= l.MaxTtl {
+		return ttl, nil
+	}
+	if capTtl {
+		return l.MaxTtl, nil
+	}
+	return 0, fmt.Errorf("%w: a ttl of at most %s", ErrForbidden, l.MaxTtl)
+}
+
+// capRenewal returns duration, shortened so that a rule renewed by it
+// lasts no longer than the maximum ttl from now
+func (l *Limits) capRenewal(entry reloader.Entry, duration time.Duration) (time.Duration, error) {
+	if l == nil || l.MaxTtl <= 0 {
+		return duration, nil
+	}
+	now := time.Now()
+	from := entry.ExpireAt
+	if from.Before(now) {
+		from = now
+	}
+	if limit := now.Add(l.MaxTtl); from.Add(duration).After(limit) {
+		duration = limit.Sub(from)
+	}
+	if duration < time.Minute {
+		return 0, fmt.Errorf("%w: the rule already lasts close to the ttl of at most %s", ErrForbidden, l.MaxTtl)
+	}
+	return duration, nil
+}
+
+// checkEntry refuses a rule opening a port or a cidr not allowed. Users
+// with limits may only add accept ingress rules at the default priority:
+// a drop or egress rule, or one taking precedence over the rules files,
+// would cut off the access of others.
+func (l *Limits) checkEntry(entry reloader.Entry) error {
+	if l == nil {
+		return nil
+	}
+	rule := entry.SecurityGroup
+	if rule.Policy != ecs.PolicyAccept || rule.Direction != ecs.DirectionIngress {
+		return fmt.Errorf("%w: %s %s rules", ErrForbidden, rule.Policy, rule.Direction)
+	}
+	if rule.Priority != reloader.DefaultPriority {
+		return fmt.Errorf("%w: priority %s", ErrForbidden, rule.Priority)
+	}
+	if len(l.Ports) > 0 && !coveredByPorts(l.Ports, rule.IpProtocol, rule.PortRange) {
+		return fmt.Errorf("%w: port %s %s", ErrForbidden, rule.IpProtocol, rule.PortRange)
+	}
+	if len(l.Cidrs) > 0 && !coveredByCidrs(l.Cidrs, rule.CidrIp) {
+		return fmt.Errorf("%w: cidr %s", ErrForbidden, rule.CidrIp)
+	}
+	return nil
+}
+
+// checkCount refuses adding rules to the unexpired temporary rules a user
+// owns beyond the maximum
+func (l *Limits) checkCount(ruleset *reloader.Ruleset, owner string, adding int) error {
+	if l == nil || l.MaxRules <= 0 {
+		return nil
+	}
+	owned := 0
+	now := time.Now()
+	for _, entry := range ruleset.Entries {
+		if entry.Owner == owner && !entry.ExpireAt.IsZero() && entry.ExpireAt.After(now) {
+			owned++
+		}
+	}
+	if owned+adding > l.MaxRules {
+		return fmt.Errorf("%w: %s owns %d of at most %d", ErrLimitExceeded, owner, owned, l.MaxRules)
+	}
+	return nil
+}
+
+// checkOwner refuses changing a rule owned by someone else; only users
+// without limits may
+func (l *Limits) checkOwner(entry reloader.Entry, actor string) error {
+	if l == nil || entry.Owner == actor {
+		return nil
+	}
+	return fmt.Errorf("%w: the rule is not owned by %s", ErrForbidden, actor)
+}
+
+func coveredByPorts(ports []reloader.ServicePort, ipProtocol string, portRange string) bool {
+	for _, port := range ports {
+		if port.Covers(ipProtocol, portRange) {
+			return true
+		}
+	}
+	return false
+}
+
+func coveredByCidrs(cidrs []netip.Prefix, cidrIp string) bool {
+	prefix, err := netip.ParsePrefix(cidrIp)
+	if err != nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		if cidr.Bits() <= prefix.Bits() && cidr.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.conf")
+	rules := "accept ingress tcp 443 from 0.0.0.0/0 until never # web\n"
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := conf.NewConfig()
+	config.Reloader.WatchPath = &path
+	s := &Service{Config: config}
+
+	ssh, _ := reloader.ParseServiceSpec("ssh")
+	highPorts, _ := reloader.ParseServiceSpec("tcp/8000/8100")
+	limits := &Limits{
+		Ports:    append(ssh, highPorts...),
+		Cidrs:    []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")},
+		MaxTtl:   4 * time.Hour,
+		MaxRules: 2,
+	}
+
+	for _, tc := range []struct {
+		line string
+		ttl  time.Duration
+		want error
+	}{
+		{"accept ingress rdp from 198.51.100.7 until never", time.Hour, ErrForbidden},
+		{"accept ingress tcp 8000/8200 from 198.51.100.7 until never", time.Hour, ErrForbidden},
+		{"accept ingress ssh from 198.51.0.0/16 until never", time.Hour, ErrForbidden},
+		{"accept ingress ssh from 203.0.113.7 until never", time.Hour, ErrForbidden},
+		{"accept ingress ssh from 198.51.100.7 until never", 8 * time.Hour, ErrForbidden},
+		{"drop ingress ssh from 198.51.100.7 until never", time.Hour, ErrForbidden},
+		{"accept egress ssh to 198.51.100.7 until never", time.Hour, ErrForbidden},
+		{"accept ingress ssh from 198.51.100.7 priority 2 until never", time.Hour, ErrForbidden},
+		{"accept ingress tcp 22,8080 from 198.51.100.7 until never", time.Hour, nil},
+		{"accept ingress ssh from 198.51.100.8 until never", time.Hour, ErrLimitExceeded},
+	} {
+		if _, _, _, err := s.CreateRule(tc.line, tc.ttl, "", "bob", limits); !errors.Is(err, tc.want) {
+			t.Errorf("CreateRule(%q) = %v; want %v", tc.line, err, tc.want)
+		}
+	}
+
+	// allow-me caps the ttl rather than refusing it
+	created, _, _, err := s.AllowIp(netip.MustParseAddr("198.51.100.9"), "ssh", 8*time.Hour, "", "carol", limits)
+	if err != nil {
+		t.Fatalf("AllowIp returned error: %v", err)
+	}
+	if limit := time.Now().Add(4 * time.Hour); created[0].ExpireAt.After(limit) {
+		t.Errorf("AllowIp expiry = %s; want at most %s", created[0].ExpireAt, limit)
+	}
+
+	// the rules of someone else cannot be changed, and renewals are capped
+	id := RuleId(created[0])
+	if _, _, err := s.RenewRule(id, time.Hour, "", "bob", limits); !errors.Is(err, ErrForbidden) {
+		t.Errorf("RenewRule of a rule of carol by bob = %v; want ErrForbidden", err)
+	}
+	if _, err := s.DeleteRule(id, "", "bob", limits); !errors.Is(err, ErrForbidden) {
+		t.Errorf("DeleteRule of a rule of carol by bob = %v; want ErrForbidden", err)
+	}
+	if _, _, err := s.RenewRule(id, time.Hour, "", "carol", limits); !errors.Is(err, ErrForbidden) {
+		t.Errorf("RenewRule past the maximum ttl = %v; want ErrForbidden", err)
+	}
+	if _, err := s.DeleteRule(id, "", "carol", limits); err != nil {
+		t.Errorf("DeleteRule of a rule of carol by carol returned error: %v", err)
+	}
+
+	// users without limits may change any rule
+	ruleset, err := s.LoadRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DeleteRule(RuleId(ruleset.Entries[0]), "", "admin", nil); err != nil {
+		t.Errorf("DeleteRule without limits returned error: %v", err)
+	}
+}
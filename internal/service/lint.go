@@ -0,0 +1,15 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/analyzer"
+
+	"time"
+)
+
+// lintExpectedEntries logs the rules found unnecessary or conflicting by
+// the analyzer; they are still synced
+func (s *Service) lintExpectedEntries() {
+	for _, finding := range analyzer.Analyze(s.Reloader.GetExpectedEntries(), time.Now()) {
+		s.logger().Warn("lint warning", "finding", finding.String())
+	}
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/logging"
+	"aliyun-security-group-mgr/internal/notify"
+	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/state"
+
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// notify sends an event about the security group, when notifications are
+// configured. Events are queued while the service loop runs, and delivered
+// at once otherwise, e.g. for a rollback from the CLI.
+func (s *Service) notify(event notify.Event) {
+	if !s.Notifier.Enabled(event.Kind) {
+		return
+	}
+	if s.Config.SecurityGroup.Id != nil {
+		event.SecurityGroupId = *s.Config.SecurityGroup.Id
+	}
+	if !s.running.Load() {
+		s.Notifier.SendNow(event)
+		return
+	}
+	s.Notifier.Send(event)
+}
+
+// notifySync notifies a sync that did not complete
+func (s *Service) notifySync(record *state.SyncRecord, result string, err error) {
+	if result == state.ResultOk {
+		return
+	}
+	summary := "sync " + result
+	if err != nil {
+		summary += ": " + err.Error()
+	}
+	s.notify(notify.Event{
+		Kind:    notify.EventSyncFailed,
+		SyncId:  record.SyncId,
+		Summary: summary,
+	})
+}
+
+// notifyChanged notifies an event listing items, unless the last event of
+// its kind listed the same items, as checks repeat. An event without items
+// is not notified, but a later one with the same items as before is.
+func (s *Service) notifyChanged(event notify.Event) {
+	if s.notified == nil {
+		s.notified = make(map[string]string)
+	}
+	items := strings.Join(event.Items, "\n")
+	if items == s.notified[event.Kind] {
+		return
+	}
+	s.notified[event.Kind] = items
+	if len(event.Items) > 0 {
+		s.notify(event)
+	}
+}
+
+// notifyDrift notifies drift, unless the same drift was notified last
+func (s *Service) notifyDrift(drift []Drift) {
+	items := make([]string, len(drift))
+	for i, d := range drift {
+		items[i] = s.driftModes[d.Kind] + ": " + d.String()
+	}
+	s.notifyChanged(notify.Event{
+		Kind:    notify.EventDrift,
+		Summary: fmt.Sprintf("%d differences between the live rules and the rules files", len(drift)),
+		Items:   items,
+	})
+}
+
+// expiryNotice is the last reminder of an expiring rule
+type expiryNotice struct {
+	expireAt time.Time
+	lead     time.Duration
+}
+
+// expiryLeads returns the configured lead times of reminders, shortest
+// first
+func (s *Service) expiryLeads() []time.Duration {
+	leads := []time.Duration{24 * time.Hour}
+	if s.Config.Notify.ExpiryLead != nil {
+		leads = nil
+		for _, lead := range s.Config.Notify.ExpiryLead {
+			if lead > 0 {
+				leads = append(leads, lead)
+			}
+		}
+	}
+	sort.Slice(leads, func(i, j int) bool { return leads[i] < leads[j] })
+	return leads
+}
+
+// notifyExpiring logs and notifies the expected entries expiring within
+// each configured lead time, once per lead time for each rule and expiry.
+// Reminders carry a renewal link when renewals are configured.
+func (s *Service) notifyExpiring(entries []reloader.Entry, now time.Time) {
+	leads := s.expiryLeads()
+	if len(leads) == 0 {
+		return
+	}
+	if s.notifiedExpiry == nil {
+		s.notifiedExpiry = make(map[string]expiryNotice)
+	}
+	for key, notice := range s.notifiedExpiry {
+		if !notice.expireAt.After(now) {
+			delete(s.notifiedExpiry, key)
+		}
+	}
+
+	expiring := make(map[time.Duration][]reloader.Entry)
+	for _, entry := range entries {
+		if entry.ExpireAt.IsZero() || entry.IsExpired(now) {
+			continue
+		}
+		// the shortest lead time the rule expires within
+		i := sort.Search(len(leads), func(i int) bool { return leads[i] >= entry.ExpireAt.Sub(now) })
+		if i == len(leads) {
+			continue
+		}
+		key := entryKey(entry)
+		if notice, ok := s.notifiedExpiry[key]; ok && notice.expireAt.Equal(entry.ExpireAt) && notice.lead <= leads[i] {
+			continue
+		}
+		s.notifiedExpiry[key] = expiryNotice{expireAt: entry.ExpireAt, lead: leads[i]}
+		s.logger().Warn("rule expires soon", logging.KeyRule, key, "source", entry.Source.String(), "expire_at", entry.ExpireAt)
+		expiring[leads[i]] = append(expiring[leads[i]], entry)
+	}
+	if len(expiring) == 0 || !s.Notifier.Enabled(notify.EventExpiring) {
+		return
+	}
+
+	var st *state.State
+	if s.State != nil {
+		var err error
+		if st, err = s.State.Load(); err != nil {
+			s.logger().Error("failed to load the state for renewal links", logging.KeyError, err)
+		}
+	}
+	for _, lead := range leads {
+		entries := expiring[lead]
+		if len(entries) == 0 {
+			continue
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].ExpireAt.Before(entries[j].ExpireAt)
+		})
+		items := make([]string, len(entries))
+		for i, entry := range entries {
+			items[i] = entry.String()
+			if link := s.renewalLink(entry, st); link != "" {
+				items[i] += "\n  renew: " + link
+			}
+		}
+		s.notify(notify.Event{
+			Kind:    notify.EventExpiring,
+			Summary: fmt.Sprintf("%d rules expire within %s", len(entries), lead),
+			Items:   items,
+		})
+	}
+}
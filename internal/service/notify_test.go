@@ -0,0 +1,115 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/ecs"
+	"aliyun-security-group-mgr/internal/notify"
+
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServiceNotifications(t *testing.T) {
+	events := make(chan notify.Event, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event notify.Event
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer server.Close()
+
+	live := decodeEntries(t, "accept ingress ssh from 10.0.0.0/8 priority 10 until never")
+	now := time.Now().UTC().Truncate(time.Second)
+	expected := decodeEntries(t,
+		"accept ingress ssh from 10.0.0.0/8 priority 10 until "+now.Add(12*time.Hour).Format(time.RFC3339),
+		"accept ingress https from 0.0.0.0/0 priority 1 until "+now.Add(48*time.Hour).Format(time.RFC3339),
+	)
+	s, fake := newFakeService(t, live)
+	groupId := "sg-1"
+	s.Config.SecurityGroup.Id = &groupId
+	notifier, err := notify.NewNotifier(&conf.Notify{Webhooks: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Notifier = notifier
+	go notifier.Run()
+
+	next := func() *notify.Event {
+		select {
+		case event := <-events:
+			return &event
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	}
+
+	fake.Fail = func(op string, rule ecs.SecurityGroupRule) error {
+		return fmt.Errorf("injected failure")
+	}
+	s.syncEntries(expected, syncCause{actor: "test"})
+	if event := next(); event == nil || event.Kind != notify.EventSyncFailed || event.SecurityGroupId != "sg-1" || event.SyncId == "" {
+		t.Errorf("after a failed sync got %+v; want a sync_failed event", event)
+	}
+	fake.Fail = nil
+
+	// the same drift is notified once
+	for i := 0; i < 2; i++ {
+		if err := s.remediateDrift(expected, "abc"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if event := next(); event == nil || event.Kind != notify.EventDrift || len(event.Items) != 1 {
+		t.Errorf("after drift checks got %+v; want one drift event with the missing rule", event)
+	}
+
+	// each expiring rule is notified once
+	s.notifyExpiring(expected, now)
+	s.notifyExpiring(expected, now.Add(time.Hour))
+	if event := next(); event == nil || event.Kind != notify.EventExpiring || len(event.Items) != 1 {
+		t.Errorf("after expiry checks got %+v; want one expiring event with the ssh rule", event)
+	}
+	s.notifyExpiring(expected, now.Add(24*time.Hour))
+	if event := next(); event == nil || event.Kind != notify.EventExpiring || len(event.Items) != 1 {
+		t.Errorf("after a day got %+v; want the https rule", event)
+	}
+
+	if event := next(); event != nil {
+		t.Errorf("got unexpected %+v", event)
+	}
+}
+
+func TestServiceNotificationsWithoutLoop(t *testing.T) {
+	events := make(chan notify.Event, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event notify.Event
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer server.Close()
+
+	// as for a rollback from the CLI, nothing runs the notifier
+	live := decodeEntries(t, "accept ingress ssh from 10.0.0.0/8 priority 10 until never")
+	s, fake := newFakeService(t, live)
+	notifier, err := notify.NewNotifier(&conf.Notify{Webhooks: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Notifier = notifier
+
+	fake.Fail = func(op string, rule ecs.SecurityGroupRule) error {
+		return fmt.Errorf("injected failure")
+	}
+	s.syncEntries(decodeEntries(t, "accept ingress https from 0.0.0.0/0 priority 1 until never"), syncCause{actor: "test"})
+	select {
+	case event := <-events:
+		if event.Kind != notify.EventSyncFailed || event.Time.IsZero() {
+			t.Errorf("got %+v; want a sync_failed event", event)
+		}
+	default:
+		t.Errorf("the sync_failed event was not delivered before the sync returned")
+	}
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/analyzer"
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Update replaces a live rule with an expected one
+type Update struct {
+	Old reloader.Entry
+	New reloader.Entry
+}
+
+// Plan is the changes bringing the live rules to the expected ones
+type Plan struct {
+	Add    []reloader.Entry
+	Update []Update
+	Delete []reloader.Entry
+
+	// DeleteFirst runs deletions before additions, when only that keeps
+	// the security group within its quota during the sync; access may
+	// then be dropped until the additions are done
+	DeleteFirst bool
+}
+
+// buildPlan compares the expected entries with the live ones. Expected
+// entries expired at now are deleted if live.
+//
+// Changes are ordered so that no state reached during the sync decides
+// any traffic other than the live rules or the expected rules do: no
+// access is opened that neither allows, and no access both allow is
+// dropped. Additions go from the highest precedence to the lowest, so a
+// rule is only added once every expected rule evaluated before it is in
+// place; updates follow in the same order; deletions go last, from the
+// lowest precedence to the highest, so the rules left decide as before.
+// Rules evaluated together are ordered by direction, protocol, port range
+// and cidr to make the order deterministic.
+func buildPlan(expectedEntries []reloader.Entry, currentEntries []reloader.Entry, now time.Time) *Plan {
+	expectedEntriesMap := buildMap(expectedEntries)
+	currentEntriesMap := buildMap(currentEntries)
+
+	plan := &Plan{}
+	for key, expectedEntry := range expectedEntriesMap {
+		isExpired := expectedEntry.IsExpired(now)
+		currentEntry, exists := currentEntriesMap[key]
+
+		switch {
+		// no existing and not expired -> add
+		case !exists && !isExpired:
+			plan.Add = append(plan.Add, expectedEntry)
+		// existing and not expired but different content -> modify
+		case exists && !isExpired && !expectedEntry.EqualContent(currentEntry):
+			plan.Update = append(plan.Update, Update{Old: currentEntry, New: expectedEntry})
+		// existing and expired -> delete, keeping the expiry to tell why
+		case exists && isExpired:
+			currentEntry.ExpireAt = expectedEntry.ExpireAt
+			currentEntry.Owner = expectedEntry.Owner
+			plan.Delete = append(plan.Delete, currentEntry)
+		}
+	}
+
+	for key, currentEntry := range currentEntriesMap {
+		// existing in current but not in expected -> delete
+		if _, exists := expectedEntriesMap[key]; !exists {
+			plan.Delete = append(plan.Delete, currentEntry)
+		}
+	}
+
+	sort.Slice(plan.Add, func(i, j int) bool {
+		return analyzer.ComparePrecedence(plan.Add[i], plan.Add[j]) < 0
+	})
+	sort.Slice(plan.Update, func(i, j int) bool {
+		return analyzer.ComparePrecedence(plan.Update[i].New, plan.Update[j].New) < 0
+	})
+	sort.Slice(plan.Delete, func(i, j int) bool {
+		return analyzer.ComparePrecedence(plan.Delete[i], plan.Delete[j]) > 0
+	})
+	return plan
+}
+
+// Empty reports whether the plan changes nothing
+func (p *Plan) Empty() bool {
+	return len(p.Add) == 0 && len(p.Update) == 0 && len(p.Delete) == 0
+}
+
+// FitQuota checks that the security group, holding current rules, stays
+// within quota through the plan. Additions go first so that access is not
+// interrupted, unless the group only fits when deletions go first. A
+// quota of 0 or less is not checked.
+func (p *Plan) FitQuota(current int, quota int) error {
+	if quota <= 0 {
+		return nil
+	}
+
+	final := current + len(p.Add) - len(p.Delete)
+	if final > quota {
+		return fmt.Errorf("sync needs %d rules but the security group allows %d, remove at least %d rules",
+			final, quota, final-quota)
+	}
+	p.DeleteFirst = current+len(p.Add) > quota
+	return nil
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/reloader"
+
+	"testing"
+	"time"
+)
+
+func decodeEntries(t *testing.T, lines ...string) []reloader.Entry {
+	t.Helper()
+	var entries []reloader.Entry
+	for _, line := range lines {
+		decoded, err := reloader.DecodeEntries(line)
+		if err != nil {
+			t.Fatalf("DecodeEntries(%q) returned error: %v", line, err)
+		}
+		entries = append(entries, decoded...)
+	}
+	return entries
+}
+
+func TestBuildPlan(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	expected := decodeEntries(t,
+		"accept ingress ssh from 10.0.0.1 until never # kept",
+		"accept ingress ssh from 10.0.0.2 until never # new",
+		"accept ingress ssh from 10.0.0.3 priority 5 until never # changed",
+		"accept ingress ssh from 10.0.0.4 until 2025-01-01T00:00:00Z # expired",
+	)
+	current := decodeEntries(t,
+		"accept ingress ssh from 10.0.0.1 until never # kept",
+		"accept ingress ssh from 10.0.0.3 until never # changed",
+		"accept ingress ssh from 10.0.0.4 until never # expired",
+		"accept ingress ssh from 10.0.0.5 until never # removed",
+	)
+
+	plan := buildPlan(expected, current, now)
+	if len(plan.Add) != 1 || plan.Add[0].SecurityGroup.CidrIp != "10.0.0.2/32" {
+		t.Errorf("Add = %v; want 10.0.0.2/32", plan.Add)
+	}
+	if len(plan.Update) != 1 || plan.Update[0].New.SecurityGroup.Priority != "5" {
+		t.Errorf("Update = %v; want 10.0.0.3/32 to priority 5", plan.Update)
+	}
+	if len(plan.Delete) != 2 {
+		t.Errorf("Delete = %v; want 10.0.0.4/32 and 10.0.0.5/32", plan.Delete)
+	}
+}
+
+func TestPlanFitQuota(t *testing.T) {
+	plan := &Plan{
+		Add:    decodeEntries(t, "accept ingress ssh from 10.0.0.1,10.0.0.2,10.0.0.3 until never"),
+		Delete: decodeEntries(t, "accept ingress ssh from 10.0.1.1,10.0.1.2 until never"),
+	}
+
+	tests := []struct {
+		current     int
+		quota       int
+		wantErr     bool
+		deleteFirst bool
+	}{
+		{current: 10, quota: 0},
+		{current: 10, quota: 20},
+		{current: 10, quota: 13},
+		{current: 10, quota: 12, deleteFirst: true},
+		{current: 10, quota: 11, deleteFirst: true},
+		{current: 10, quota: 10, wantErr: true},
+	}
+	for _, tt := range tests {
+		plan.DeleteFirst = false
+		err := plan.FitQuota(tt.current, tt.quota)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("FitQuota(%d, %d) error = %v; want error %v", tt.current, tt.quota, err, tt.wantErr)
+			continue
+		}
+		if err == nil && plan.DeleteFirst != tt.deleteFirst {
+			t.Errorf("FitQuota(%d, %d) DeleteFirst = %v; want %v", tt.current, tt.quota, plan.DeleteFirst, tt.deleteFirst)
+		}
+	}
+}
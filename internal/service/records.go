@@ -0,0 +1,105 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/logging"
+	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/state"
+
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"time"
+)
+
+// actor names who changes the rules, for the records kept of it
+func (s *Service) actor() string {
+	if s.Actor != "" {
+		return s.Actor
+	}
+	hostname, _ := os.Hostname()
+	return "worker@" + hostname
+}
+
+// recordSync adds a sync to the history and, for the changes applied,
+// records where each live rule comes from. Syncs that did not complete are
+// notified. It returns err, so that it can
+// end a sync; failing to record is only logged.
+func (s *Service) recordSync(record *state.SyncRecord, plan *Plan, result string, err error) error {
+	s.notifySync(record, result, err)
+	if s.State == nil {
+		return err
+	}
+
+	record.FinishedAt = time.Now()
+	record.Result = result
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	// rules changed by a failed sync that was not rolled back are live too
+	var liveEntries []reloader.Entry
+	if plan != nil {
+		record.Added, record.Updated, record.Deleted = len(plan.Add), len(plan.Update), len(plan.Delete)
+		var liveErr error
+		if liveEntries, liveErr = s.getCurrentEntries(); liveErr != nil {
+			s.logger().Error("failed to record the rules of a sync", logging.KeySyncId, record.SyncId, logging.KeyError, liveErr)
+			plan = nil
+		}
+	}
+
+	updateErr := s.State.Update(func(st *state.State) {
+		st.History = append(st.History, record)
+		if plan != nil {
+			s.recordRules(st, record, plan, liveEntries)
+		}
+	})
+	if updateErr != nil {
+		s.logger().Error("failed to record a sync", logging.KeySyncId, record.SyncId, logging.KeyError, updateErr)
+	}
+	return err
+}
+
+// recordRules records the rules added or updated by a sync under their
+// live ids, and forgets the deleted ones. Aliyun does not return the id of
+// an added rule, so rules are found by cidr, protocol, port and direction.
+func (s *Service) recordRules(st *state.State, record *state.SyncRecord, plan *Plan, liveEntries []reloader.Entry) {
+	for _, entry := range plan.Delete {
+		delete(st.Rules, entry.SecurityGroup.Id)
+	}
+
+	liveEntriesMap := buildMap(liveEntries)
+	applied := append([]reloader.Entry{}, plan.Add...)
+	for _, update := range plan.Update {
+		applied = append(applied, update.New)
+	}
+	for _, entry := range applied {
+		live, ok := liveEntriesMap[entryKey(entry)]
+		if !ok || !live.EqualContent(entry) {
+			continue
+		}
+		ruleRecord := &state.RuleRecord{
+			RuleId:      live.SecurityGroup.Id,
+			Rule:        reloader.EncodeEntry(entry),
+			ContentHash: contentHash(entry),
+			File:        entry.Source.File,
+			Line:        entry.Source.Line,
+			ExpireAt:    entry.ExpireAt,
+			Creator:     record.Actor,
+			AppliedAt:   record.FinishedAt,
+			SyncId:      record.SyncId,
+			Revision:    record.Revision,
+		}
+		if s.Config.SecurityGroup.Id != nil {
+			ruleRecord.SecurityGroupId = *s.Config.SecurityGroup.Id
+		}
+		st.Rules[ruleRecord.RuleId] = ruleRecord
+	}
+}
+
+// contentHash identifies the content of a rule, as compared by EqualContent
+func contentHash(entry reloader.Entry) string {
+	rule := entry.SecurityGroup
+	sum := sha256.Sum256([]byte(rule.Policy + "|" + rule.Direction + "|" + rule.IpProtocol + "|" +
+		rule.PortRange + "|" + rule.CidrIp + "|" + rule.Priority + "|" + rule.Description))
+	return hex.EncodeToString(sum[:8])
+}
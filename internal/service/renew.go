@@ -0,0 +1,168 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/logging"
+	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/renewal"
+	"aliyun-security-group-mgr/internal/state"
+
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrRenewalDisabled = errors.New("renewals are not configured")
+	ErrRenewalExpired  = errors.New("the renewal link has expired")
+	// ErrRuleChanged is returned when the rule of a renewal token no longer
+	// expires when the token says, as it was edited or already renewed
+	ErrRuleChanged = errors.New("the rule was changed or already renewed")
+)
+
+// renewalSecret returns the key signing renewal tokens, nil when renewals
+// are not configured
+func (s *Service) renewalSecret() []byte {
+	if s.Config.Renewal == nil || s.Config.Renewal.Secret == nil || *s.Config.Renewal.Secret == "" {
+		return nil
+	}
+	return []byte(*s.Config.Renewal.Secret)
+}
+
+// renewalDuration returns what a renewal extends an entry by: the duration
+// of its last renewal, or else the time from when it was applied to its
+// expiry, or else the configured default
+func (s *Service) renewalDuration(entry reloader.Entry, st *state.State) time.Duration {
+	if st != nil {
+		if duration, ok := st.Durations[entryKey(entry)]; ok {
+			return duration
+		}
+		hash := contentHash(entry)
+		for _, record := range st.Rules {
+			if record.ContentHash == hash && record.ExpireAt.Equal(entry.ExpireAt) && record.AppliedAt.Before(record.ExpireAt) {
+				return record.ExpireAt.Sub(record.AppliedAt).Round(time.Minute)
+			}
+		}
+	}
+	if s.Config.Renewal.DefaultDuration != nil && *s.Config.Renewal.DefaultDuration > 0 {
+		return *s.Config.Renewal.DefaultDuration
+	}
+	return 24 * time.Hour
+}
+
+// renewalLink returns the link renewing an entry, empty when renewals or
+// the API url are not configured
+func (s *Service) renewalLink(entry reloader.Entry, st *state.State) string {
+	secret := s.renewalSecret()
+	if secret == nil || s.Config.Api.BaseUrl == nil || *s.Config.Api.BaseUrl == "" || entry.Source.File == "" {
+		return ""
+	}
+	token, err := renewal.Sign(secret, renewal.Claims{
+		Rule:     entryKey(entry),
+		File:     entry.Source.File,
+		Line:     entry.Source.Line,
+		ExpireAt: entry.ExpireAt,
+		Duration: s.renewalDuration(entry, st),
+	})
+	if err != nil {
+		s.logger().Error("failed to sign a renewal token", logging.KeyRule, entryKey(entry), logging.KeyError, err)
+		return ""
+	}
+	return strings.TrimSuffix(*s.Config.Api.BaseUrl, "/") + "/renew?token=" + url.QueryEscape(token)
+}
+
+// Renew extends the rule of a renewal token by the token's duration, as
+// renewEntry does; the reloader then picks the change up
+func (s *Service) Renew(token string, actor string) (*reloader.Entry, error) {
+	secret := s.renewalSecret()
+	if secret == nil {
+		return nil, ErrRenewalDisabled
+	}
+	claims, err := renewal.Verify(secret, token)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	grace := time.Duration(0)
+	if s.Config.Renewal.Grace != nil {
+		grace = *s.Config.Renewal.Grace
+	}
+	if now.After(claims.ExpireAt.Add(grace)) {
+		return nil, ErrRenewalExpired
+	}
+
+	var renewed *reloader.Entry
+	_, err = s.editRules("", func(ruleset *reloader.Ruleset) (*reloader.Document, error) {
+		doc, err := readDocument(ruleset, claims.File)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := doc.Entries(claims.Line)
+		if err != nil {
+			return nil, ErrRuleChanged
+		}
+		for _, entry := range entries {
+			if entryKey(entry) == claims.Rule && entry.ExpireAt.Equal(claims.ExpireAt) {
+				renewed, err = s.renewEntry(doc, entry, claims.Duration)
+				return doc, err
+			}
+		}
+		return nil, ErrRuleChanged
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.logger().Info("rule renewed", "rule", renewed.String(), "actor", actor)
+
+	if s.State != nil {
+		err := s.State.Update(func(st *state.State) {
+			if st.Durations == nil {
+				st.Durations = make(map[string]time.Duration)
+			}
+			st.Durations[claims.Rule] = claims.Duration
+		})
+		if err != nil {
+			s.logger().Error("failed to record a renewal", logging.KeyRule, claims.Rule, logging.KeyError, err)
+		}
+	}
+	return renewed, nil
+}
+
+// renewEntry extends entry by duration, from its expiry or from now if it
+// has expired already. The until clause of the entry's line is rewritten,
+// so the rules written on the same line are renewed together, capped by
+// the strictest TTL class among them.
+func (s *Service) renewEntry(doc *reloader.Document, entry reloader.Entry, duration time.Duration) (*reloader.Entry, error) {
+	previous := entry.ExpireAt
+	from := entry.ExpireAt
+	if now := time.Now(); from.Before(now) {
+		from = now
+	}
+	entry.ExpireAt = from.Add(duration).UTC().Truncate(time.Second)
+	ttlPolicy, err := reloader.TTLPolicyFromConfig(s.Config.Ttl)
+	if err != nil {
+		return nil, err
+	}
+	if ttlPolicy != nil {
+		lineEntries, err := doc.Entries(entry.Source.Line)
+		if err != nil {
+			return nil, err
+		}
+		var strictest *reloader.TTLClass
+		for _, lineEntry := range lineEntries {
+			lineEntry.ExpireAt = entry.ExpireAt
+			if class := ttlPolicy.Cap(&lineEntry); class != nil {
+				entry.ExpireAt = lineEntry.ExpireAt.Truncate(time.Second)
+				strictest = class
+			}
+		}
+		if strictest != nil && !entry.ExpireAt.After(previous) {
+			return nil, fmt.Errorf("%s rules cannot be renewed past %s", strictest.Name, entry.ExpireAt.Format(time.RFC3339))
+		}
+	}
+	if err := doc.SetExpiry(entry.Source.Line, entry.ExpireAt); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/notify"
+	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/state"
+
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpiryReminders(t *testing.T) {
+	items := make(chan []string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event notify.Event
+		json.NewDecoder(r.Body).Decode(&event)
+		items <- event.Items
+	}))
+	defer server.Close()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.conf")
+	rules := "# access\naccept ingress ssh from 10.0.0.0/8 until " + now.Add(2*time.Hour).Format(time.RFC3339) + " # alice\n"
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := reloader.ReadEntriesFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := conf.NewConfig()
+	secret, baseUrl := "secret", "https://sgmgr.example.com/"
+	config.Renewal.Secret = &secret
+	config.Api.BaseUrl = &baseUrl
+	config.Reloader.WatchPath = &path
+	config.Notify.ExpiryLead = []time.Duration{24 * time.Hour, time.Hour}
+	s := &Service{Config: config, State: state.NewStore(filepath.Join(dir, "state"), 0)}
+	// the rule was applied 4 hours before it expires
+	err = s.State.Update(func(st *state.State) {
+		st.Rules["sgr-1"] = &state.RuleRecord{ContentHash: contentHash(entries[0]), ExpireAt: entries[0].ExpireAt, AppliedAt: now.Add(-2 * time.Hour)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Notifier, err = notify.NewNotifier(&conf.Notify{Webhooks: []string{server.URL}}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Notifier.Run()
+
+	next := func() []string {
+		select {
+		case items := <-items:
+			return items
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	}
+
+	// reminded once within each lead time
+	s.notifyExpiring(entries, now)
+	reminder := next()
+	if len(reminder) != 1 || !strings.Contains(reminder[0], "renew: https://sgmgr.example.com/renew?token=") {
+		t.Fatalf("first reminder = %q; want the ssh rule with a renewal link", reminder)
+	}
+	s.notifyExpiring(entries, now.Add(30*time.Minute))
+	if reminder := next(); reminder != nil {
+		t.Errorf("got %q again within the same lead time", reminder)
+	}
+	s.notifyExpiring(entries, now.Add(90*time.Minute))
+	if reminder = next(); len(reminder) != 1 {
+		t.Fatalf("reminders within an hour = %q; want the ssh rule", reminder)
+	}
+
+	link, err := url.Parse(strings.TrimSpace(reminder[0][strings.Index(reminder[0], "renew: ")+len("renew: "):]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := link.Query().Get("token")
+
+	renewed, err := s.Renew(token, "test")
+	if err != nil {
+		t.Fatalf("Renew returned error: %v", err)
+	}
+	if want := now.Add(6 * time.Hour); !renewed.ExpireAt.Equal(want) {
+		t.Errorf("renewed expiry = %s; want %s, extended by the 4h the rule was written for", renewed.ExpireAt, want)
+	}
+	data, _ := os.ReadFile(path)
+	if want := "until " + now.Add(6*time.Hour).Format(time.RFC3339) + " # alice\n"; !strings.HasPrefix(string(data), "# access\n") || !strings.HasSuffix(string(data), want) {
+		t.Errorf("rules file after renewal:\n%s\nwant the until clause updated in place", data)
+	}
+
+	if _, err := s.Renew(token, "test"); !errors.Is(err, ErrRuleChanged) {
+		t.Errorf("second Renew = %v; want ErrRuleChanged", err)
+	}
+	if _, err := s.Renew(token[:len(token)-2]+"xx", "test"); err == nil {
+		t.Errorf("Renew of a tampered token should fail")
+	}
+
+	// the renewal's duration is kept for the next one
+	st, _ := s.State.Load()
+	if st.Durations[entryKey(entries[0])] != 4*time.Hour {
+		t.Errorf("recorded durations = %v; want 4h", st.Durations)
+	}
+}
+
+func TestRenewLimits(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	path := filepath.Join(t.TempDir(), "rules.conf")
+	rules := "accept ingress ssh from 10.0.0.0/8 until " + now.Add(-2*time.Hour).Format(time.RFC3339) + "\n" +
+		"accept ingress https from 10.0.0.0/8 until " + now.Add(time.Hour).Format(time.RFC3339) + "\n" +
+		"accept ingress tcp 80,3306 from 10.0.0.0/8 until " + now.Add(time.Hour).Format(time.RFC3339) + "\n"
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := reloader.ReadEntriesFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := conf.NewConfig()
+	secret, baseUrl, grace := "secret", "https://sgmgr.example.com", time.Hour
+	config.Renewal.Secret = &secret
+	config.Renewal.Grace = &grace
+	config.Api.BaseUrl = &baseUrl
+	config.Reloader.WatchPath = &path
+	config.Ttl.Max = map[string]time.Duration{"https": 2 * time.Hour, "mysql": 3 * time.Hour}
+	s := &Service{Config: config}
+	token := func(entry reloader.Entry) string {
+		link, _ := url.Parse(s.renewalLink(entry, nil))
+		return link.Query().Get("token")
+	}
+
+	if _, err := s.Renew(token(entries[0]), "test"); !errors.Is(err, ErrRenewalExpired) {
+		t.Errorf("Renew past the grace time = %v; want ErrRenewalExpired", err)
+	}
+
+	// the default 24h renewal is capped by the ttl of https rules
+	renewed, err := s.Renew(token(entries[1]), "test")
+	if err != nil {
+		t.Fatalf("Renew returned error: %v", err)
+	}
+	if max := time.Now().Add(2 * time.Hour); renewed.ExpireAt.After(max) {
+		t.Errorf("renewed expiry = %s; want at most %s", renewed.ExpireAt, max)
+	}
+
+	// renewing the http rule renews the mysql rule on its line too, so the
+	// mysql ttl caps it
+	renewed, err = s.Renew(token(entries[2]), "test")
+	if err != nil {
+		t.Fatalf("Renew returned error: %v", err)
+	}
+	if max := time.Now().Add(3 * time.Hour); renewed.ExpireAt.After(max) {
+		t.Errorf("renewed expiry of a line with a mysql rule = %s; want at most %s", renewed.ExpireAt, max)
+	}
+	if _, err := reloader.ReadEntriesFromFile(path); err != nil {
+		t.Errorf("rules file after renewals does not load: %v", err)
+	}
+}
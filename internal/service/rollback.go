@@ -0,0 +1,94 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/audit"
+	"aliyun-security-group-mgr/internal/logging"
+	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/state"
+
+	"fmt"
+	"time"
+)
+
+// saveSnapshot saves the live rules before a sync, when a state directory
+// is configured
+func (s *Service) saveSnapshot(syncId string, currentEntries []reloader.Entry) error {
+	if s.State == nil {
+		return nil
+	}
+	snapshot := &state.Snapshot{
+		SyncId:    syncId,
+		CreatedAt: time.Now(),
+	}
+	if s.Config.SecurityGroup.Id != nil {
+		snapshot.SecurityGroupId = *s.Config.SecurityGroup.Id
+	}
+	for _, entry := range currentEntries {
+		snapshot.Rules = append(snapshot.Rules, entry.SecurityGroup)
+	}
+	return s.State.SaveSnapshot(snapshot)
+}
+
+// restoreEntries brings the live rules back to saved ones for a sync, with
+// the same ordering. Rules deleted since are added again with new ids. The
+// changes are audited as a rollback rather than under the sync's trigger.
+func (s *Service) restoreEntries(savedEntries []reloader.Entry, record *state.SyncRecord) (*Plan, error) {
+	currentEntries, err := s.getCurrentEntries()
+	if err != nil {
+		return nil, err
+	}
+	plan := buildPlan(savedEntries, currentEntries, time.Now())
+	// the saved rules did fit, only the order matters here
+	plan.FitQuota(len(currentEntries), s.ruleQuota())
+	restore := *record
+	restore.Trigger = audit.TriggerRollback
+	return plan, s.applyPlan(plan, &restore)
+}
+
+// Rollback restores the live rules saved before a sync, on demand from the
+// CLI. The live rules are saved first too, so a rollback can be rolled
+// back. Snapshots of another security group are refused.
+func (s *Service) Rollback(syncId string) (string, error) {
+	if s.State == nil {
+		return "", fmt.Errorf("no state directory configured")
+	}
+	snapshot, err := s.State.LoadSnapshot(syncId)
+	if err != nil {
+		return "", err
+	}
+	var securityGroupId string
+	if s.Config.SecurityGroup.Id != nil {
+		securityGroupId = *s.Config.SecurityGroup.Id
+	}
+	if snapshot.SecurityGroupId != securityGroupId {
+		return "", fmt.Errorf("sync %s was of security group %s, not the configured %s", syncId, snapshot.SecurityGroupId, securityGroupId)
+	}
+	savedEntries := make([]reloader.Entry, len(snapshot.Rules))
+	for i, rule := range snapshot.Rules {
+		savedEntries[i] = reloader.Entry{SecurityGroup: rule}
+	}
+
+	now := time.Now()
+	record := &state.SyncRecord{
+		SyncId:     state.NewSyncId(now),
+		StartedAt:  now,
+		Actor:      s.actor(),
+		Trigger:    audit.TriggerCli,
+		RollbackOf: syncId,
+	}
+	currentEntries, err := s.getCurrentEntries()
+	if err != nil {
+		return "", s.recordSync(record, nil, state.ResultFailed, err)
+	}
+	if err := s.saveSnapshot(record.SyncId, currentEntries); err != nil {
+		return "", s.recordSync(record, nil, state.ResultRefused, err)
+	}
+
+	s.logger().Info("rolling back to the live rules from before a sync", "rollback_of", syncId, logging.KeySyncId, record.SyncId)
+	plan, err := s.restoreEntries(savedEntries, record)
+	if err != nil {
+		return record.SyncId, s.recordSync(record, plan, state.ResultFailed, err)
+	}
+	s.logger().Info("rollback completed", logging.KeySyncId, record.SyncId)
+	return record.SyncId, s.recordSync(record, plan, state.ResultOk, nil)
+}
@@ -1,24 +1,82 @@
 package service
 
 import (
+	"aliyun-security-group-mgr/internal/audit"
 	"aliyun-security-group-mgr/internal/conf"
 	"aliyun-security-group-mgr/internal/ecs"
+	"aliyun-security-group-mgr/internal/guard"
+	"aliyun-security-group-mgr/internal/logging"
+	"aliyun-security-group-mgr/internal/notify"
 	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/state"
+
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Service struct {
 	Config   *conf.GlobalConfiguration
-	Ecs      *ecs.Clerk
+	Ecs      ecs.Backend
 	Reloader *reloader.Reloader
+	Guard    *guard.Guard
+	State    *state.Store
+	Audit    *audit.Log
+	Notifier *notify.Notifier
+
+	// Actor names who changes the rules in the records kept, the worker
+	// and its hostname by default
+	Actor string
+
+	// action of the drift check for each kind of drift
+	driftModes map[string]string
+	// items last notified by event kind, not to notify the same drift
+	// or violations on every check
+	notified map[string]string
+	// expiring rules already reminded of, by rule
+	notifiedExpiry map[string]expiryNotice
+	// edits serializes the changes made to the rules files
+	edits sync.Mutex
+	// decisions serializes the decisions on access requests
+	decisions sync.Mutex
+	// syncRequests asks the service loop for a sync
+	syncRequests chan struct{}
+	// running is set while Start runs the service loop and the notifier
+	running atomic.Bool
 }
 
 func NewService(config *conf.GlobalConfiguration) (*Service, error) {
-	return &Service{
-		Config: config,
-	}, nil
+	s := &Service{
+		Config:       config,
+		syncRequests: make(chan struct{}, 1),
+	}
+	if config.State.Dir != nil && *config.State.Dir != "" {
+		keep := 0
+		if config.State.Keep != nil {
+			keep = *config.State.Keep
+		}
+		s.State = state.NewStore(*config.State.Dir, keep)
+	}
+	if config.Audit.Path != nil && *config.Audit.Path != "" {
+		chain := config.Audit.Chain == nil || *config.Audit.Chain
+		s.Audit = audit.NewLog(*config.Audit.Path, chain)
+	}
+	driftModes, err := driftModes(config.Drift)
+	if err != nil {
+		return nil, err
+	}
+	s.driftModes = driftModes
+	if len(config.Notify.Webhooks) > 0 || (config.Notify.SmtpAddr != nil && *config.Notify.SmtpAddr != "") {
+		if s.Notifier, err = notify.NewNotifier(config.Notify); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
-func (s *Service) Start() error {
+// Connect creates the ECS clerk and the guard of the configuration
+func (s *Service) Connect() error {
 	// New ECS Clerk
 	ecsClerk, err := ecs.NewClerk(s.Config)
 	if err != nil {
@@ -26,6 +84,23 @@ func (s *Service) Start() error {
 	}
 	s.Ecs = ecsClerk
 
+	// New Guard
+	if s.Config.Guard.Enabled != nil && *s.Config.Guard.Enabled {
+		guard, err := guard.NewGuard(s.Config.Guard)
+		if err != nil {
+			return err
+		}
+		s.Guard = guard
+	}
+	return nil
+}
+
+func (s *Service) Start() error {
+	err := s.Connect()
+	if err != nil {
+		return err
+	}
+
 	// Check and create watch file if not exists
 	err = s.checkWatchFile()
 	if err != nil {
@@ -42,8 +117,48 @@ func (s *Service) Start() error {
 
 	go s.Reloader.Start()
 
-	for range reloadChan {
-		s.syncSecurityGroupEntries()
+	if s.Notifier != nil {
+		go s.Notifier.Run()
 	}
-	return nil
+	s.running.Store(true)
+	defer s.running.Store(false)
+
+	// Drift checks run between syncs, never during one
+	var driftChan <-chan time.Time
+	if s.Config.Drift.Interval != nil && *s.Config.Drift.Interval > 0 {
+		driftTicker := time.NewTicker(*s.Config.Drift.Interval)
+		defer driftTicker.Stop()
+		driftChan = driftTicker.C
+	}
+	// Expiring rules are logged even when they are not notified
+	var expiryChan <-chan time.Time
+	if s.Config.Notify.ExpiryInterval != nil && *s.Config.Notify.ExpiryInterval > 0 {
+		expiryTicker := time.NewTicker(*s.Config.Notify.ExpiryInterval)
+		defer expiryTicker.Stop()
+		expiryChan = expiryTicker.C
+	}
+
+	for {
+		select {
+		case <-reloadChan:
+			s.lintExpectedEntries()
+			s.syncSecurityGroupEntries()
+		case <-s.syncRequests:
+			s.syncRequestedEntries()
+		case <-driftChan:
+			s.checkDrift()
+		case <-expiryChan:
+			s.notifyExpiring(s.Reloader.GetExpectedEntries(), time.Now())
+		}
+	}
+}
+
+var serviceLogger = logging.Component("service")
+
+// logger returns the logger of the service, with the security group synced
+func (s *Service) logger() *slog.Logger {
+	if s.Config.SecurityGroup.Id == nil {
+		return serviceLogger
+	}
+	return serviceLogger.With(logging.KeySecurityGroup, *s.Config.SecurityGroup.Id)
 }
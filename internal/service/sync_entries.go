@@ -1,16 +1,19 @@
 package service
 
 import (
+	"aliyun-security-group-mgr/internal/audit"
+	"aliyun-security-group-mgr/internal/logging"
 	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/state"
 
-	"log"
+	"errors"
 	"time"
 )
 
 func (s *Service) getCurrentEntries() ([]reloader.Entry, error) {
 	securityRule, err := s.Ecs.DescribeSecurityGroupAttribute()
 	if err != nil {
-		log.Printf("[Service] failed to get current entries: %v", err)
+		s.logger().Error("failed to get the live rules", logging.KeyError, err)
 		return nil, err
 	}
 	var entries []reloader.Entry
@@ -23,104 +26,204 @@ func (s *Service) getCurrentEntries() ([]reloader.Entry, error) {
 	return entries, nil
 }
 
-func buildMap(entries []reloader.Entry) map[string]reloader.Entry {
-	buildKey := func(entry reloader.Entry) string {
-		return entry.SecurityGroup.CidrIp + "|" + entry.SecurityGroup.IpProtocol + "|" + entry.SecurityGroup.PortRange + "|" + entry.SecurityGroup.Direction
-	}
+// entryKey identifies a live rule; the other fields can be modified in place
+func entryKey(entry reloader.Entry) string {
+	return entry.SecurityGroup.CidrIp + "|" + entry.SecurityGroup.IpProtocol + "|" + entry.SecurityGroup.PortRange + "|" + entry.SecurityGroup.Direction
+}
 
+// buildMap indexes entries by entryKey; of entries sharing a key the last
+// one is kept, lint reports the others as analyzer.KindCollision
+func buildMap(entries []reloader.Entry) map[string]reloader.Entry {
 	result := make(map[string]reloader.Entry)
 	for _, entry := range entries {
-		key := buildKey(entry)
+		key := entryKey(entry)
 		result[key] = entry
 	}
 	return result
 }
 
 func (s *Service) syncSecurityGroupEntries() error {
-	expectedEntries := s.Reloader.GetExpectedEntries()
-	currentEntries, err := s.getCurrentEntries()
-	if err != nil {
+	expectedEntries, revision := s.Reloader.GetExpected()
+	return s.syncEntries(expectedEntries, syncCause{
+		revision: revision,
+		actor:    s.actor(),
+		trigger:  audit.TriggerFileChange,
+	})
+}
+
+// syncRequestedEntries syncs the rules files as they are now: a sync asked
+// for through the API follows edits the reloader has not polled yet
+func (s *Service) syncRequestedEntries() error {
+	if err := s.Reloader.Reload(); err != nil {
 		return err
 	}
+	s.lintExpectedEntries()
+	return s.syncSecurityGroupEntries()
+}
 
-	expectedEntriesMap := buildMap(expectedEntries)
-	currentEntriesMap := buildMap(currentEntries)
+// syncCause tells what started a sync, for the records kept of it
+type syncCause struct {
+	// revision of the rules files synced
+	revision string
+	actor    string
+	trigger  string
+}
 
+// syncEntries brings the live rules to the expected entries, see buildPlan
+// for the order of the changes. The live rules are saved before any
+// change, and restored if a change fails.
+func (s *Service) syncEntries(expectedEntries []reloader.Entry, cause syncCause) error {
 	now := time.Now()
-	entriesToAdd := []string{}
-	entriesToUpdate := []string{}
-	entriesToDelete := []string{}
-
-	// Determine entries to add, update, delete
-	for key, expectedEntry := range expectedEntriesMap {
-		isExpired := expectedEntry.ExpireAt.Before(now)
-		currentEntry, exists := currentEntriesMap[key]
-
-		// no existing and not expired -> add
-		if !exists && !isExpired {
-			entriesToAdd = append(entriesToAdd, key)
-			continue
-		}
+	record := &state.SyncRecord{
+		SyncId:    state.NewSyncId(now),
+		StartedAt: now,
+		Actor:     cause.actor,
+		Trigger:   cause.trigger,
+		Revision:  cause.revision,
+	}
 
-		// existing and not expired but different content -> modify
-		if exists && !isExpired && !expectedEntry.EqualContent(currentEntry) {
-			entriesToUpdate = append(entriesToUpdate, key)
-			continue
-		}
+	expectedEntries, err := s.prepareEntries(expectedEntries)
+	if err != nil {
+		return s.recordSync(record, nil, state.ResultRefused, err)
+	}
+	currentEntries, err := s.getCurrentEntries()
+	if err != nil {
+		return s.recordSync(record, nil, state.ResultFailed, err)
+	}
 
-		// existing and expired -> delete
-		if exists && isExpired {
-			entriesToDelete = append(entriesToDelete, key)
-			continue
-		}
+	return s.executePlan(buildPlan(expectedEntries, currentEntries, now), currentEntries, record)
+}
+
+// prepareEntries turns the entries of the rules files into the rules to
+// sync, applying the guardrails and cidr aggregation
+func (s *Service) prepareEntries(expectedEntries []reloader.Entry) ([]reloader.Entry, error) {
+	expectedEntries, err := s.applyGuardrails(expectedEntries)
+	if err != nil {
+		return nil, err
+	}
+	return s.aggregateEntries(expectedEntries), nil
+}
+
+// executePlan applies a plan within the rule quota, saving the current
+// entries first and restoring them on failure, and records the result
+func (s *Service) executePlan(plan *Plan, currentEntries []reloader.Entry, record *state.SyncRecord) error {
+	if err := plan.FitQuota(len(currentEntries), s.ruleQuota()); err != nil {
+		s.logger().Error("sync refused", logging.KeySyncId, record.SyncId, logging.KeyError, err)
+		return s.recordSync(record, nil, state.ResultRefused, err)
+	}
+	if plan.Empty() {
+		s.logger().Info("synchronizing, nothing to change")
+		return nil
 	}
 
-	for key := range currentEntriesMap {
-		_, exists := expectedEntriesMap[key]
+	syncId := record.SyncId
+	if err := s.saveSnapshot(syncId, currentEntries); err != nil {
+		s.logger().Error("sync refused, failed to save the live rules", logging.KeySyncId, syncId, logging.KeyError, err)
+		return s.recordSync(record, nil, state.ResultRefused, err)
+	}
 
-		// existing in current but not in expected -> delete
-		if !exists {
-			entriesToDelete = append(entriesToDelete, key)
+	s.logger().Info("synchronizing", logging.KeySyncId, syncId, "trigger", record.Trigger,
+		"add", len(plan.Add), "update", len(plan.Update), "delete", len(plan.Delete))
+	if err := s.applyPlan(plan, record); err != nil {
+		s.logger().Error("sync failed, restoring the live rules from before it", logging.KeySyncId, syncId, logging.KeyError, err)
+		if _, restoreErr := s.restoreEntries(currentEntries, record); restoreErr != nil {
+			s.logger().Error("failed to restore the live rules, run sgmgr rollback "+syncId, logging.KeySyncId, syncId, logging.KeyError, restoreErr)
+			return s.recordSync(record, plan, state.ResultFailed, errors.Join(err, restoreErr))
 		}
+		s.logger().Info("restored the live rules from before the sync", logging.KeySyncId, syncId)
+		return s.recordSync(record, nil, state.ResultRolledBack, err)
 	}
 
-	log.Printf("[Service] synchronizing - to add: %d, to update: %d, to delete: %d", len(entriesToAdd), len(entriesToUpdate), len(entriesToDelete))
+	s.logger().Info("synchronization completed", logging.KeySyncId, syncId)
+
+	return s.recordSync(record, plan, state.ResultOk, nil)
+}
 
-	// Additions
-	for _, key := range entriesToAdd {
-		entry := expectedEntriesMap[key]
-		err := s.Ecs.AddSecurityGroupRule(entry.SecurityGroup)
+// applyPlan runs the changes of a plan for a sync, stopping at the first
+// failure
+func (s *Service) applyPlan(plan *Plan, record *state.SyncRecord) error {
+	steps := []func() error{
+		func() error { return s.addEntries(plan.Add, record) },
+		func() error { return s.updateEntries(plan.Update, record) },
+		func() error { return s.deleteEntries(plan.Delete, record) },
+	}
+	if plan.DeleteFirst {
+		s.logger().Warn("deleting rules before adding to stay within the quota", logging.KeySyncId, record.SyncId)
+		steps = []func() error{steps[2], steps[0], steps[1]}
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Service) addEntries(entries []reloader.Entry, record *state.SyncRecord) error {
+	for _, entry := range entries {
+		requestId, err := s.Ecs.AddSecurityGroupRule(entry.SecurityGroup)
+		s.auditChange(record, record.Trigger, audit.ActionAdd, nil, &entry.SecurityGroup, entry.Owner, requestId, err)
 		if err != nil {
-			log.Printf("[Service] failed to add rule: %+v, error: %v", entry.SecurityGroup, err)
-		} else {
-			log.Printf("[Service] successfully added rule: %+v", entry.SecurityGroup)
+			s.logger().Error("failed to add rule", logging.KeySyncId, record.SyncId, logging.KeyRule, entryKey(entry),
+				"entry", entry.String(), "request_id", requestId, logging.KeyError, err)
+			return err
 		}
+		s.logger().Info("added rule", logging.KeySyncId, record.SyncId, logging.KeyRule, entryKey(entry),
+			"entry", entry.String(), "request_id", requestId)
 	}
+	return nil
+}
 
-	// Updates
-	for _, key := range entriesToUpdate {
-		oldEntry := currentEntriesMap[key]
-		newEntry := expectedEntriesMap[key]
-		err := s.Ecs.ModifySecurityGroupRule(oldEntry.SecurityGroup.Id, newEntry.SecurityGroup)
+func (s *Service) updateEntries(updates []Update, record *state.SyncRecord) error {
+	for _, update := range updates {
+		requestId, err := s.Ecs.ModifySecurityGroupRule(update.Old.SecurityGroup.Id, update.New.SecurityGroup)
+		s.auditChange(record, record.Trigger, audit.ActionModify, &update.Old.SecurityGroup, &update.New.SecurityGroup, update.New.Owner, requestId, err)
 		if err != nil {
-			log.Printf("[Service] failed to update rule from: %+v to: %+v, error: %v", oldEntry.SecurityGroup, newEntry.SecurityGroup, err)
-		} else {
-			log.Printf("[Service] successfully updated rule from: %+v to: %+v", oldEntry.SecurityGroup, newEntry.SecurityGroup)
+			s.logger().Error("failed to update rule", logging.KeySyncId, record.SyncId, logging.KeyRule, entryKey(update.Old),
+				"from", update.Old.String(), "to", update.New.String(), "request_id", requestId, logging.KeyError, err)
+			return err
 		}
+		s.logger().Info("updated rule", logging.KeySyncId, record.SyncId, logging.KeyRule, entryKey(update.Old),
+			"from", update.Old.String(), "to", update.New.String(), "request_id", requestId)
 	}
+	return nil
+}
 
-	// Deletions
-	for _, key := range entriesToDelete {
-		entry := currentEntriesMap[key]
-		err := s.Ecs.RemoveSecurityGroupRule(entry.SecurityGroup)
+func (s *Service) deleteEntries(entries []reloader.Entry, record *state.SyncRecord) error {
+	now := time.Now()
+	for _, entry := range entries {
+		trigger := record.Trigger
+		if entry.IsExpired(now) {
+			trigger = audit.TriggerExpiry
+		}
+		requestId, err := s.Ecs.RemoveSecurityGroupRule(entry.SecurityGroup)
+		s.auditChange(record, trigger, audit.ActionRevoke, &entry.SecurityGroup, nil, entry.Owner, requestId, err)
 		if err != nil {
-			log.Printf("[Service] failed to delete rule: %+v, error: %v", entry.SecurityGroup, err)
-		} else {
-			log.Printf("[Service] successfully deleted rule: %+v", entry.SecurityGroup)
+			s.logger().Error("failed to delete rule", logging.KeySyncId, record.SyncId, logging.KeyRule, entryKey(entry),
+				"entry", entry.String(), "trigger", trigger, "request_id", requestId, logging.KeyError, err)
+			return err
 		}
+		s.logger().Info("deleted rule", logging.KeySyncId, record.SyncId, logging.KeyRule, entryKey(entry),
+			"entry", entry.String(), "trigger", trigger, "request_id", requestId)
 	}
+	return nil
+}
 
-	log.Printf("[Service] synchronization completed")
+// ruleQuota returns the rule quota of the security group, fetched from the
+// Quota Center when a quota code is configured
+func (s *Service) ruleQuota() int {
+	quota := 0
+	if s.Config.Sync.Quota != nil {
+		quota = *s.Config.Sync.Quota
+	}
+	if s.Config.Sync.QuotaCode == nil || *s.Config.Sync.QuotaCode == "" {
+		return quota
+	}
 
-	return nil
+	fetched, err := s.Ecs.GetRuleQuota(*s.Config.Sync.QuotaCode)
+	if err != nil {
+		s.logger().Warn("failed to fetch the rule quota, using the configured one", "quota", quota, logging.KeyError, err)
+		return quota
+	}
+	return fetched
 }
@@ -0,0 +1,342 @@
+package service
+
+import (
+	"aliyun-security-group-mgr/internal/analyzer"
+	"aliyun-security-group-mgr/internal/audit"
+	"aliyun-security-group-mgr/internal/conf"
+	"aliyun-security-group-mgr/internal/ecs"
+	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/state"
+
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newFakeService(t *testing.T, live []reloader.Entry) (*Service, *ecs.Fake) {
+	t.Helper()
+	fake := &ecs.Fake{}
+	for _, entry := range live {
+		if _, err := fake.AddSecurityGroupRule(entry.SecurityGroup); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.Snapshots = nil
+	return &Service{Config: conf.NewConfig(), Ecs: fake}, fake
+}
+
+func liveDecisions(rules []ecs.SecurityGroupRule, packets []analyzer.Packet) []bool {
+	entries := make([]reloader.Entry, len(rules))
+	for i, rule := range rules {
+		entries[i] = reloader.Entry{SecurityGroup: rule}
+	}
+	decisions := make([]bool, len(packets))
+	for i, packet := range packets {
+		decisions[i] = analyzer.Evaluate(entries, packet, time.Now()).Allowed
+	}
+	return decisions
+}
+
+func TestSyncEntriesSafeOrder(t *testing.T) {
+	live := decodeEntries(t,
+		"accept ingress ssh from 10.0.0.0/8 priority 10 until never",
+		"accept ingress http from 0.0.0.0/0 priority 1 until never",
+		"drop ingress all from 192.0.2.0/24 priority 5 until never",
+		"accept ingress https from 192.0.2.0/24 priority 20 until never",
+	)
+	expected := decodeEntries(t,
+		"accept ingress ssh from 10.0.0.0/8 priority 10 until never",
+		"drop ingress ssh from 10.1.0.0/16 priority 5 until never",
+		"accept ingress ssh from 10.1.2.0/24 priority 1 until never",
+		"drop ingress http from 0.0.0.0/0 priority 1 until never",
+		"accept ingress https from 192.0.2.0/24 priority 20 until never",
+		"accept ingress tcp 8080 from 192.0.2.0/24 priority 30 until never",
+	)
+
+	var packets []analyzer.Packet
+	for _, probe := range []struct {
+		addr string
+		port int
+	}{
+		{"10.1.2.3", 22}, {"10.1.9.9", 22}, {"10.2.0.1", 22},
+		{"203.0.113.1", 80},
+		{"192.0.2.1", 443}, {"192.0.2.1", 8080}, {"192.0.2.1", 22},
+	} {
+		packets = append(packets, analyzer.Packet{
+			Direction:  ecs.DirectionIngress,
+			Addr:       netip.MustParseAddr(probe.addr),
+			IpProtocol: reloader.ProtocolTCP,
+			Port:       probe.port,
+		})
+	}
+
+	var firstRun [][]ecs.SecurityGroupRule
+	for run := 0; run < 10; run++ {
+		s, fake := newFakeService(t, live)
+		before := liveDecisions(fake.Rules, packets)
+		if err := s.syncEntries(expected, syncCause{actor: "test"}); err != nil {
+			t.Fatalf("syncEntries returned error: %v", err)
+		}
+		after := liveDecisions(fake.Rules, packets)
+
+		for n, snapshot := range fake.Snapshots {
+			for i, allowed := range liveDecisions(snapshot, packets) {
+				if allowed != before[i] && allowed != after[i] {
+					t.Fatalf("after change %d, %+v is allowed=%v, but %v before and after the sync",
+						n+1, packets[i], allowed, before[i])
+				}
+			}
+		}
+		if len(fake.Rules) != len(expected) {
+			t.Errorf("sync left %d rules; want %d", len(fake.Rules), len(expected))
+		}
+
+		// the same changes in the same order on every run
+		if run == 0 {
+			firstRun = fake.Snapshots
+		} else if !reflect.DeepEqual(fmt.Sprint(fake.Snapshots), fmt.Sprint(firstRun)) {
+			t.Fatalf("run %d changed rules in a different order", run)
+		}
+	}
+}
+
+func TestSyncEntriesRollbackOnFailure(t *testing.T) {
+	live := decodeEntries(t,
+		"accept ingress ssh from 10.0.0.0/8 priority 10 until never",
+		"accept ingress http from 0.0.0.0/0 priority 1 until never",
+	)
+	expected := decodeEntries(t,
+		"accept ingress ssh from 10.0.0.0/8 priority 10 until never",
+		"accept ingress https from 0.0.0.0/0 priority 1 until never",
+		"accept ingress tcp 8080 from 0.0.0.0/0 priority 2 until never",
+	)
+
+	s, fake := newFakeService(t, live)
+	s.State = state.NewStore(t.TempDir(), 0)
+	fake.Fail = func(op string, rule ecs.SecurityGroupRule) error {
+		if op == "add" && rule.PortRange == "8080/8080" {
+			return fmt.Errorf("injected failure")
+		}
+		return nil
+	}
+
+	if err := s.syncEntries(expected, syncCause{actor: "test"}); err == nil {
+		t.Fatalf("syncEntries returned no error")
+	}
+	if len(fake.Rules) != len(live) {
+		t.Fatalf("sync left %d rules after failing; want the %d live rules", len(fake.Rules), len(live))
+	}
+	for i, rule := range fake.Rules {
+		if rule.PortRange != live[i].SecurityGroup.PortRange || rule.CidrIp != live[i].SecurityGroup.CidrIp {
+			t.Errorf("rule %d = %+v after rollback; want %+v", i, rule, live[i].SecurityGroup)
+		}
+	}
+
+	// the failed sync can be found and rolled back again on demand
+	syncIds, err := s.State.Snapshots()
+	if err != nil || len(syncIds) != 1 {
+		t.Fatalf("Snapshots() = %v, %v; want one snapshot", syncIds, err)
+	}
+	fake.Fail = nil
+	if err := s.syncEntries(expected, syncCause{actor: "test"}); err != nil {
+		t.Fatalf("syncEntries returned error: %v", err)
+	}
+	syncIds, _ = s.State.Snapshots()
+	if _, err := s.Rollback(syncIds[len(syncIds)-1]); err != nil {
+		t.Fatalf("Rollback returned error: %v", err)
+	}
+	if len(fake.Rules) != len(live) || fake.Rules[1].PortRange != "80/80" {
+		t.Errorf("rules after Rollback = %+v; want the live rules", fake.Rules)
+	}
+
+	// snapshots of another security group are not restored
+	otherId := "sg-other"
+	s.Config.SecurityGroup.Id = &otherId
+	syncIds, _ = s.State.Snapshots()
+	if _, err := s.Rollback(syncIds[len(syncIds)-1]); err == nil {
+		t.Errorf("Rollback of a snapshot of another security group returned no error")
+	}
+	if len(fake.Rules) != len(live) || fake.Rules[1].PortRange != "80/80" {
+		t.Errorf("rules after a refused Rollback = %+v; want them unchanged", fake.Rules)
+	}
+}
+
+func TestSyncEntriesRecords(t *testing.T) {
+	live := decodeEntries(t,
+		"accept ingress ssh from 10.0.0.0/8 priority 10 until never",
+		"accept ingress http from 0.0.0.0/0 priority 1 until never",
+	)
+	expected := decodeEntries(t,
+		"accept ingress ssh from 10.0.0.0/8 priority 5 until never",
+		"accept ingress https from 0.0.0.0/0 priority 1 until never",
+	)
+	for i := range expected {
+		expected[i].Source = reloader.Source{File: "rules.conf", Line: i + 1}
+	}
+
+	s, fake := newFakeService(t, live)
+	s.State = state.NewStore(t.TempDir(), 0)
+	if err := s.syncEntries(expected, syncCause{revision: "abc", actor: "test"}); err != nil {
+		t.Fatalf("syncEntries returned error: %v", err)
+	}
+
+	st, err := s.State.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.History) != 1 || st.History[0].Result != state.ResultOk || st.History[0].Added != 1 ||
+		st.History[0].Updated != 1 || st.History[0].Deleted != 1 || st.History[0].Revision != "abc" {
+		t.Errorf("History = %+v; want one ok sync of revision abc with 1 change of each kind", st.History)
+	}
+	if len(st.Rules) != len(fake.Rules) {
+		t.Fatalf("recorded %d rules; want %d", len(st.Rules), len(fake.Rules))
+	}
+	for _, rule := range fake.Rules {
+		record, ok := st.Rules[rule.Id]
+		if !ok {
+			t.Errorf("no record of live rule %s", rule.Id)
+			continue
+		}
+		wantLine := 1
+		if rule.PortRange == "443/443" {
+			wantLine = 2
+		}
+		if record.File != "rules.conf" || record.Line != wantLine || record.Creator != "test" || record.Revision != "abc" {
+			t.Errorf("record of %s = %+v; want rules.conf:%d applied by test from abc", rule.Id, record, wantLine)
+		}
+	}
+}
+
+func TestSyncEntriesAudit(t *testing.T) {
+	live := decodeEntries(t,
+		"accept ingress ssh from 10.0.0.0/8 priority 10 until never",
+		"accept ingress http from 0.0.0.0/0 priority 1 until never",
+	)
+	expected := decodeEntries(t,
+		"accept ingress ssh from 10.0.0.0/8 priority 10 until 2025-01-01T00:00:00Z owner alice",
+		"accept ingress https from 0.0.0.0/0 priority 1 until never owner bob",
+	)
+
+	s, _ := newFakeService(t, live)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	s.Audit = audit.NewLog(path, true)
+	if err := s.syncEntries(expected, syncCause{revision: "abc", actor: "test", trigger: audit.TriggerFileChange}); err != nil {
+		t.Fatalf("syncEntries returned error: %v", err)
+	}
+
+	if count, err := audit.Verify(path); err != nil || count != 3 {
+		t.Fatalf("Verify = %d, %v; want 3 records", count, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []audit.Record
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record audit.Record
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+
+	want := []struct {
+		action  string
+		trigger string
+		port    string
+		owner   string
+	}{
+		{audit.ActionAdd, audit.TriggerFileChange, "443/443", "bob"},
+		{audit.ActionRevoke, audit.TriggerExpiry, "22/22", "alice"},
+		{audit.ActionRevoke, audit.TriggerFileChange, "80/80", ""},
+	}
+	for i, record := range records {
+		rule := record.After
+		if rule == nil {
+			rule = record.Before
+		}
+		if record.Action != want[i].action || record.Trigger != want[i].trigger || rule.PortRange != want[i].port || record.Owner != want[i].owner {
+			t.Errorf("record %d = %s %s of %s owned by %q; want %s %s of %s owned by %q", i, record.Action, record.Trigger, rule.PortRange,
+				record.Owner, want[i].action, want[i].trigger, want[i].port, want[i].owner)
+		}
+		if record.RequestId == "" || record.Revision != "abc" || record.Actor != "test" || record.SyncId == "" {
+			t.Errorf("record %d = %+v; want the request id, revision, actor and sync id", i, record)
+		}
+	}
+}
+
+func TestSyncEntriesAuditRollback(t *testing.T) {
+	live := decodeEntries(t, "accept ingress http from 0.0.0.0/0 priority 1 until never")
+	expected := decodeEntries(t,
+		"accept ingress https from 0.0.0.0/0 priority 1 until never",
+		"accept ingress tcp 8080 from 0.0.0.0/0 priority 2 until never",
+	)
+
+	s, fake := newFakeService(t, live)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	s.Audit = audit.NewLog(path, true)
+	fake.Fail = func(op string, rule ecs.SecurityGroupRule) error {
+		if op == "add" && rule.PortRange == "8080/8080" {
+			return fmt.Errorf("injected failure")
+		}
+		return nil
+	}
+	if err := s.syncEntries(expected, syncCause{actor: "test", trigger: audit.TriggerFileChange}); err == nil {
+		t.Fatalf("syncEntries returned no error")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var triggers []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record audit.Record
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		triggers = append(triggers, record.Action+" "+record.Trigger)
+	}
+	// the failed add is recorded under the sync's trigger, the revoke
+	// undoing the https add as a rollback
+	want := []string{"add file change", "add file change", "revoke rollback"}
+	if strings.Join(triggers, ", ") != strings.Join(want, ", ") {
+		t.Errorf("audited %q; want %q", triggers, want)
+	}
+}
+
+func TestSyncRequestedEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.conf")
+	if err := os.WriteFile(path, []byte("accept ingress ssh from 10.0.0.0/8 until never\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, fake := newFakeService(t, nil)
+	s.Config.Reloader.WatchPath = &path
+	r, err := reloader.NewReloader(s.Config, make(chan struct{}, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Reloader = r
+	if err := s.syncRequestedEntries(); err != nil {
+		t.Fatalf("syncRequestedEntries returned error: %v", err)
+	}
+
+	// an edit through the API is synced when asked for, before the reloader
+	// polls the files
+	if _, _, _, err := s.CreateRule("accept ingress https from 10.0.0.0/8", time.Hour, "", "alice", nil); err != nil {
+		t.Fatalf("CreateRule returned error: %v", err)
+	}
+	if err := s.syncRequestedEntries(); err != nil {
+		t.Fatalf("syncRequestedEntries returned error: %v", err)
+	}
+	if len(fake.Rules) != 2 || fake.Rules[1].PortRange != "443/443" {
+		t.Errorf("rules after a requested sync = %+v; want ssh and https", fake.Rules)
+	}
+}
@@ -1,9 +1,10 @@
 package service
 
 import (
+	"aliyun-security-group-mgr/internal/logging"
 	"aliyun-security-group-mgr/internal/reloader"
+	"aliyun-security-group-mgr/internal/utils"
 
-	"log"
 	"os"
 	"time"
 )
@@ -11,34 +12,76 @@ import (
 func (s *Service) createNewWatchFile() error {
 	f, err := os.Create(*s.Config.Reloader.WatchPath)
 	if err != nil {
-		log.Printf("[Service] failed to create watch file: %v", err)
+		s.logger().Error("failed to create the watch file", logging.KeyError, err)
 		return err
 	}
 	f.Close()
-	log.Printf("[Service] created watch file: %s", *s.Config.Reloader.WatchPath)
-	log.Printf("[Service] fetching rules from ECS")
+	s.logger().Info("created the watch file, importing the live rules", "path", *s.Config.Reloader.WatchPath)
 	currentEntries, err := s.getCurrentEntries()
 	if err != nil {
 		return err
 	}
-	for i := range currentEntries {
-		currentEntries[i].ExpireAt, _ = time.Parse(time.RFC3339, "2100-01-01T00:00:00Z")
-	}
 
-	err = reloader.WriteEntriesToFile(*s.Config.Reloader.WatchPath, currentEntries)
+	data, err := s.importEntries(*s.Config.Reloader.WatchPath, currentEntries)
+	if err != nil {
+		return err
+	}
+	err = utils.WriteFileAtomic(*s.Config.Reloader.WatchPath, data, 0644)
 	if err != nil {
-		log.Printf("[Service] failed to write current rules to watch file: %v", err)
+		s.logger().Error("failed to write the live rules to the watch file", logging.KeyError, err)
 		return err
 	}
 
-	log.Printf("[Service] writing current rules to watch file")
+	s.logger().Info("wrote the live rules to the watch file", "rules", len(currentEntries))
 	return nil
 }
 
+// importEntries encodes the live rules for a new watch file. Rules do not
+// expire unless an import ttl is configured, and are capped to the maximum
+// lifetime of their port class; capped rules are logged and, in the line
+// format, written below a comment so they are reviewed.
+func (s *Service) importEntries(path string, entries []reloader.Entry) ([]byte, error) {
+	ttlPolicy, err := reloader.TTLPolicyFromConfig(s.Config.Ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	var expireAt time.Time
+	if s.Config.Ttl.ImportDefault != nil && *s.Config.Ttl.ImportDefault > 0 {
+		expireAt = time.Now().Add(*s.Config.Ttl.ImportDefault).Truncate(time.Second)
+	}
+
+	var kept, capped []reloader.Entry
+	for _, entry := range entries {
+		entry.ExpireAt = expireAt
+		if ttlPolicy != nil {
+			if class := ttlPolicy.Cap(&entry); class != nil {
+				entry.ExpireAt = entry.ExpireAt.Truncate(time.Second)
+				s.logger().Warn("imported rule exceeds the ttl of its service, capping it", logging.KeyRule, entryKey(entry),
+					"service", class.Name, "max_ttl", class.MaxTTL, "expire_at", entry.ExpireAt, "entry", entry.String())
+				capped = append(capped, entry)
+				continue
+			}
+		}
+		kept = append(kept, entry)
+	}
+
+	format := reloader.FileFormat(path)
+	if format != reloader.FormatLine || len(capped) == 0 {
+		return reloader.EncodeFile(format, append(kept, capped...))
+	}
+	data := reloader.EncodeLines(kept)
+	if len(data) > 0 {
+		data = append(data, '\n')
+	}
+	data = append(data, "# imported rules capped to the maximum ttl of their service, review before they expire\n"...)
+	return append(data, reloader.EncodeLines(capped)...), nil
+}
+
 func (s *Service) checkWatchFile() error {
 	_, err := os.Stat(*s.Config.Reloader.WatchPath)
 	if err != nil {
-		log.Printf("[Service] reloader watch path does not exist: %v", err)
+		s.logger().Warn("reloader watch path does not exist", logging.KeyError, err)
 		err = s.createNewWatchFile()
 		if err != nil {
 			return err
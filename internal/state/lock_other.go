@@ -0,0 +1,13 @@
+//go:build !unix
+
+package state
+
+import (
+	"os"
+)
+
+// lockFile does nothing where flock is not available; updates are then
+// only serialized within a process
+func lockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,135 @@
+package state
+
+import (
+	"aliyun-security-group-mgr/internal/ecs"
+	"aliyun-security-group-mgr/internal/utils"
+
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot is the live rules of a security group before a sync
+type Snapshot struct {
+	SyncId          string                  `json:"sync_id"`
+	SecurityGroupId string                  `json:"security_group_id"`
+	CreatedAt       time.Time               `json:"created_at"`
+	Rules           []ecs.SecurityGroupRule `json:"rules"`
+}
+
+// Store keeps the state of the worker in a directory
+type Store struct {
+	// mu serializes updates of the state file, which the sync loop and the
+	// HTTP API both make
+	mu  sync.Mutex
+	dir string
+	// keep is the number of snapshots kept, 0 to keep all
+	keep int
+}
+
+func NewStore(dir string, keep int) *Store {
+	return &Store{dir: dir, keep: keep}
+}
+
+// NewSyncId returns a unique id for a sync started at now; ids sort by time
+func NewSyncId(now time.Time) string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	now = now.UTC()
+	return fmt.Sprintf("%s%03dZ-%s", now.Format("20060102T150405"), now.Nanosecond()/1e6, hex.EncodeToString(b))
+}
+
+func (s *Store) snapshotDir() string {
+	return filepath.Join(s.dir, "snapshots")
+}
+
+func (s *Store) snapshotPath(syncId string) (string, error) {
+	if syncId == "" || strings.ContainsAny(syncId, `/\.`) {
+		return "", fmt.Errorf("invalid sync id: %q", syncId)
+	}
+	return filepath.Join(s.snapshotDir(), syncId+".json"), nil
+}
+
+// SaveSnapshot writes a snapshot, then removes the oldest snapshots beyond
+// the number kept
+func (s *Store) SaveSnapshot(snapshot *Snapshot) error {
+	path, err := s.snapshotPath(snapshot.SyncId)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.snapshotDir(), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := utils.WriteFileAtomic(path, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return s.pruneSnapshots()
+}
+
+// LoadSnapshot reads the snapshot taken before a sync
+func (s *Store) LoadSnapshot(syncId string) (*Snapshot, error) {
+	path, err := s.snapshotPath(syncId)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no snapshot for sync %s", syncId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", path, err)
+	}
+	return &snapshot, nil
+}
+
+// Snapshots lists the sync ids of the stored snapshots, oldest first
+func (s *Store) Snapshots() ([]string, error) {
+	files, err := os.ReadDir(s.snapshotDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var syncIds []string
+	for _, file := range files {
+		if syncId, ok := strings.CutSuffix(file.Name(), ".json"); ok && !file.IsDir() {
+			syncIds = append(syncIds, syncId)
+		}
+	}
+	sort.Strings(syncIds)
+	return syncIds, nil
+}
+
+func (s *Store) pruneSnapshots() error {
+	if s.keep <= 0 {
+		return nil
+	}
+	syncIds, err := s.Snapshots()
+	if err != nil {
+		return err
+	}
+	for len(syncIds) > s.keep {
+		path, _ := s.snapshotPath(syncIds[0])
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		syncIds = syncIds[1:]
+	}
+	return nil
+}
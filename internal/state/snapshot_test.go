@@ -0,0 +1,49 @@
+package state
+
+import (
+	"aliyun-security-group-mgr/internal/ecs"
+
+	"testing"
+	"time"
+)
+
+func TestStoreSnapshots(t *testing.T) {
+	store := NewStore(t.TempDir(), 2)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var syncIds []string
+	for i := 0; i < 3; i++ {
+		syncId := NewSyncId(start.Add(time.Duration(i) * time.Millisecond))
+		syncIds = append(syncIds, syncId)
+		snapshot := &Snapshot{
+			SyncId:    syncId,
+			CreatedAt: start,
+			Rules:     []ecs.SecurityGroupRule{{Id: "sgr-1", CidrIp: "10.0.0.0/8", PortRange: "22/22", IpProtocol: "TCP"}},
+		}
+		if err := store.SaveSnapshot(snapshot); err != nil {
+			t.Fatalf("SaveSnapshot returned error: %v", err)
+		}
+	}
+
+	stored, err := store.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 || stored[0] != syncIds[1] || stored[1] != syncIds[2] {
+		t.Errorf("Snapshots() = %v; want the last two of %v", stored, syncIds)
+	}
+
+	snapshot, err := store.LoadSnapshot(syncIds[2])
+	if err != nil {
+		t.Fatalf("LoadSnapshot returned error: %v", err)
+	}
+	if len(snapshot.Rules) != 1 || snapshot.Rules[0].CidrIp != "10.0.0.0/8" {
+		t.Errorf("LoadSnapshot rules = %+v", snapshot.Rules)
+	}
+	if _, err := store.LoadSnapshot(syncIds[0]); err == nil {
+		t.Errorf("LoadSnapshot of a pruned snapshot returned no error")
+	}
+	if _, err := store.LoadSnapshot("../x"); err == nil {
+		t.Errorf("LoadSnapshot accepted a path")
+	}
+}
@@ -0,0 +1,201 @@
+package state
+
+import (
+	"aliyun-security-group-mgr/internal/utils"
+
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Sync results
+const (
+	ResultOk         = "ok"
+	ResultRefused    = "refused"
+	ResultFailed     = "failed"
+	ResultRolledBack = "rolled back"
+)
+
+// RuleRecord is what the worker knows of a live rule it created or
+// changed, keyed by the rule's SecurityGroupRuleId
+type RuleRecord struct {
+	RuleId          string `json:"rule_id"`
+	SecurityGroupId string `json:"security_group_id"`
+	// Rule is the rule line as applied
+	Rule        string    `json:"rule"`
+	ContentHash string    `json:"content_hash"`
+	File        string    `json:"file,omitempty"`
+	Line        int       `json:"line,omitempty"`
+	ExpireAt    time.Time `json:"expire_at"`
+	Creator     string    `json:"creator"`
+	AppliedAt   time.Time `json:"applied_at"`
+	SyncId      string    `json:"sync_id"`
+	// Revision is the revision of the rules files the rule was applied from
+	Revision string `json:"revision,omitempty"`
+}
+
+// SyncRecord is the result of a sync or a rollback
+type SyncRecord struct {
+	SyncId     string    `json:"sync_id"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Actor      string    `json:"actor"`
+	Trigger    string    `json:"trigger,omitempty"`
+	Revision   string    `json:"revision,omitempty"`
+	// RollbackOf is the sync rolled back, for rollbacks
+	RollbackOf string `json:"rollback_of,omitempty"`
+	Added      int    `json:"added"`
+	Updated    int    `json:"updated"`
+	Deleted    int    `json:"deleted"`
+	Result     string `json:"result"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Statuses of an access request
+const (
+	RequestPending  = "pending"
+	RequestApproved = "approved"
+	RequestDenied   = "denied"
+)
+
+// maxDecidedRequests is how many approved or denied access requests are kept
+const maxDecidedRequests = 200
+
+// AccessRequest is a change asked for through the API that waits for an
+// approver before it is written to the rules files
+type AccessRequest struct {
+	Id string `json:"id"`
+	// Rules are the rule lines asked for, without expiry and owner
+	Rules []string `json:"rules"`
+	// Ttl is how long the rules last from their approval
+	Ttl       time.Duration `json:"ttl"`
+	Requester string        `json:"requester"`
+	CreatedAt time.Time     `json:"created_at"`
+	Status    string        `json:"status"`
+	DecidedBy string        `json:"decided_by,omitempty"`
+	DecidedAt time.Time     `json:"decided_at"`
+	Comment   string        `json:"comment,omitempty"`
+	// ExpireAt is when the rules approved expire
+	ExpireAt time.Time `json:"expire_at"`
+	// Revision is the revision of the rules files the approved rules were written in
+	Revision string `json:"revision,omitempty"`
+}
+
+// State is the state file of the worker
+type State struct {
+	Rules   map[string]*RuleRecord `json:"rules"`
+	History []*SyncRecord          `json:"history"`
+	// Durations are what renewals extend rules by, keyed by the rule's
+	// cidr, protocol, port and direction, as renewed rules no longer show
+	// the duration they were written with
+	Durations map[string]time.Duration `json:"durations,omitempty"`
+	// Requests are the access requests, pending and decided, oldest first
+	Requests []*AccessRequest `json:"requests,omitempty"`
+}
+
+func (s *Store) statePath() string {
+	return filepath.Join(s.dir, "state.json")
+}
+
+// lockPath is the file locked while the state file is updated, as the
+// worker and the CLI may update it at once
+func (s *Store) lockPath() string {
+	return filepath.Join(s.dir, "state.lock")
+}
+
+// Load reads the state file; a missing file is an empty state
+func (s *Store) Load() (*State, error) {
+	st := &State{Rules: make(map[string]*RuleRecord)}
+	data, err := os.ReadFile(s.statePath())
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", s.statePath(), err)
+	}
+	if st.Rules == nil {
+		st.Rules = make(map[string]*RuleRecord)
+	}
+	return st, nil
+}
+
+// Save writes the state file, keeping as many sync records as snapshots,
+// every pending access request and the last decided ones. It does not
+// lock the state, changes go through Update.
+func (s *Store) Save(st *State) error {
+	if s.keep > 0 && len(st.History) > s.keep {
+		st.History = st.History[len(st.History)-s.keep:]
+	}
+	st.Requests = trimRequests(st.Requests)
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.statePath(), append(data, '\n'), 0644)
+}
+
+// Update loads the state, applies fn and saves it, holding a lock on the
+// state directory against other processes
+func (s *Store) Update(fn func(st *State)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(s.lockPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return fmt.Errorf("failed to lock %s: %w", s.lockPath(), err)
+	}
+	// closing the file releases the lock
+
+	st, err := s.Load()
+	if err != nil {
+		return err
+	}
+	fn(st)
+	return s.Save(st)
+}
+
+// trimRequests drops the oldest decided requests beyond the ones kept
+func trimRequests(requests []*AccessRequest) []*AccessRequest {
+	decided := 0
+	for _, request := range requests {
+		if request.Status != RequestPending {
+			decided++
+		}
+	}
+	if decided <= maxDecidedRequests {
+		return requests
+	}
+	var kept []*AccessRequest
+	for _, request := range requests {
+		if request.Status != RequestPending && decided > maxDecidedRequests {
+			decided--
+			continue
+		}
+		kept = append(kept, request)
+	}
+	return kept
+}
+
+// Request returns the access request of an id, or nil
+func (st *State) Request(id string) *AccessRequest {
+	for _, request := range st.Requests {
+		if request.Id == id {
+			return request
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package state
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStoreUpdateSharedDirectory(t *testing.T) {
+	// two stores on one directory stand for the worker and the CLI
+	dir := t.TempDir()
+	stores := []*Store{NewStore(dir, 0), NewStore(dir, 0)}
+
+	const updates = 50
+	var wg sync.WaitGroup
+	for _, store := range stores {
+		wg.Add(1)
+		go func(store *Store) {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				err := store.Update(func(st *State) {
+					st.History = append(st.History, &SyncRecord{SyncId: NewSyncId(time.Now()), Result: ResultOk})
+				})
+				if err != nil {
+					t.Errorf("Update returned error: %v", err)
+					return
+				}
+			}
+		}(store)
+	}
+	wg.Wait()
+
+	st, err := stores[0].Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := len(stores) * updates; len(st.History) != want {
+		t.Errorf("History has %d records; want %d, updates were lost", len(st.History), want)
+	}
+}
@@ -0,0 +1,20 @@
+package utils
+
+import (
+	"net/netip"
+)
+
+// IsIpv6Cidr reports whether a cidr is an IPv6 one
+func IsIpv6Cidr(cidr string) bool {
+	prefix, err := netip.ParsePrefix(cidr)
+	return err == nil && prefix.Addr().Is6()
+}
+
+// normalize a cidr to its network address, e.g. 1.2.3.4/10 to 1.0.0.0/10
+func NormalizeCidr(cidr string) (string, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return "", err
+	}
+	return prefix.Masked().String(), nil
+}